@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/morvencao/minicni/pkg/agent"
+	"github.com/morvencao/minicni/pkg/firewall"
+	"github.com/morvencao/minicni/pkg/nettool"
+	"github.com/morvencao/minicni/pkg/policy"
+)
+
+func main() {
+	var kubeconfig, nodeName, backendName, firewallBackend, hostSettings string
+	var networkPolicy bool
+	var resyncPeriod time.Duration
+	var opts backendOptions
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "path to the kubeconfig file, the in-cluster config is used if it's empty")
+	flag.StringVar(&nodeName, "node-name", os.Getenv("NODE_NAME"), "name of the local node")
+	flag.StringVar(&backendName, "backend", agent.BackendHostGW, "backend to reach the pods on the remote nodes")
+	flag.DurationVar(&resyncPeriod, "resync-period", 5*time.Minute, "period to sync the backend with all the nodes")
+	flag.StringVar(&opts.stateDir, "state-dir", "/var/lib/minicni", "directory to keep the state of the node across restarts")
+	flag.IntVar(&opts.vxlanVNI, "vxlan-vni", agent.DefaultVXLANVNI, "VXLAN network identifier of the vxlan backend")
+	flag.IntVar(&opts.vxlanPort, "vxlan-port", agent.DefaultVXLANPort, "UDP port of the vxlan backend")
+	flag.IntVar(&opts.wireGuardPort, "wireguard-port", agent.DefaultWireGuardPort, "UDP port of the wireguard backend")
+	flag.BoolVar(&networkPolicy, "network-policy", false, "enforce the network policies of the pods on the local node")
+	flag.StringVar(&firewallBackend, "firewall-backend", "", "firewall backend to enforce the network policies: iptables or nftables, detected if it's empty")
+	flag.StringVar(&hostSettings, "host-settings", "check", "what to do with the forwarding and bridge netfilter sysctls of the node: check, enable or off")
+	flag.Parse()
+
+	if nodeName == "" {
+		log.Fatal("node name is not set")
+	}
+
+	if err := ensureHostSettings(hostSettings); err != nil {
+		log.Fatal(err)
+	}
+
+	config, err := buildConfig(kubeconfig)
+	if err != nil {
+		log.Fatalf("failed to build kubernetes client config: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("failed to create kubernetes client: %v", err)
+	}
+	backend, err := newBackend(backendName, client, &opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stopCh := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		close(stopCh)
+	}()
+
+	if networkPolicy {
+		fw, err := firewall.New(firewallBackend)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("starting network policy controller on node %q", nodeName)
+			if err := policy.New(client, nodeName, fw, resyncPeriod).Run(stopCh); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	log.Printf("starting minicni agent on node %q with %s backend", nodeName, backend.Name())
+	if err := agent.New(client, nodeName, backend, resyncPeriod).Run(stopCh); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func buildConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig == "" {
+		return rest.InClusterConfig()
+	}
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
+}
+
+// ensureHostSettings checks or enables the sysctls of the node the pod traffic relies on,
+// the sysctls which are not set are only logged in check mode.
+func ensureHostSettings(mode string) error {
+	sysctls := append(nettool.ForwardingSysctls(true), nettool.HostSysctl{Key: "net.bridge.bridge-nf-call-iptables", Value: "1"})
+	switch mode {
+	case "off":
+		return nil
+	case "check":
+		if err := nettool.EnsureHostSysctls(sysctls, false); err != nil {
+			log.Printf("warning: %v", err)
+		}
+		return nil
+	case "enable":
+		return nettool.EnsureHostSysctls(sysctls, true)
+	default:
+		return fmt.Errorf("unknown host settings: %q", mode)
+	}
+}
+
+// backendOptions are the flags of the backends
+type backendOptions struct {
+	stateDir      string
+	vxlanVNI      int
+	vxlanPort     int
+	wireGuardPort int
+}
+
+func newBackend(name string, client kubernetes.Interface, opts *backendOptions) (agent.Backend, error) {
+	switch name {
+	case agent.BackendHostGW:
+		return agent.NewHostGWBackend(), nil
+	case agent.BackendVXLAN:
+		return agent.NewVXLANBackend(opts.vxlanVNI, opts.vxlanPort), nil
+	case agent.BackendWireGuard:
+		return agent.NewWireGuardBackend(client, opts.stateDir, opts.wireGuardPort)
+	default:
+		return nil, fmt.Errorf("unknown backend: %q", name)
+	}
+}
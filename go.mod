@@ -4,6 +4,12 @@ go 1.15
 
 require (
 	github.com/containernetworking/plugins v0.8.7
+	github.com/coreos/go-iptables v0.4.5
+	github.com/google/nftables v0.0.0-20220808154552-2eca00135732
 	github.com/vishvananda/netlink v0.0.0-20181108222139-023a6dafdcdf
-	golang.org/x/tools v0.1.0 // indirect
+	golang.org/x/sys v0.0.0-20211205182925-97ca703d548d
+	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20200205215550-e35592f146e4
+	k8s.io/api v0.20.15
+	k8s.io/apimachinery v0.20.15
+	k8s.io/client-go v0.20.15
 )
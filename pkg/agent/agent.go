@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// retryInterval is how long to wait before syncing the backend again after a failure
+const retryInterval = 5 * time.Second
+
+// Backend programs the data plane of the node to reach the pods on the remote nodes
+type Backend interface {
+	// Name returns the name of the backend
+	Name() string
+	// Sync makes the pod subnets of the remote nodes reachable from the local node,
+	// the state for the nodes not in the list is removed.
+	Sync(local *Node, remotes []*Node) error
+}
+
+// Agent watches the nodes of the cluster and keeps the backend in sync with them
+type Agent struct {
+	client       kubernetes.Interface
+	nodeName     string
+	backend      Backend
+	resyncPeriod time.Duration
+	// trigger has a pending sync if it's not empty
+	trigger chan struct{}
+}
+
+// New returns the agent of the local node, the backend is synced with all the nodes every resync period
+// besides the node changes.
+func New(client kubernetes.Interface, nodeName string, backend Backend, resyncPeriod time.Duration) *Agent {
+	return &Agent{
+		client:       client,
+		nodeName:     nodeName,
+		backend:      backend,
+		resyncPeriod: resyncPeriod,
+		trigger:      make(chan struct{}, 1),
+	}
+}
+
+// Run syncs the backend whenever the nodes join, change or leave until the stop channel is closed
+func (a *Agent) Run(stopCh <-chan struct{}) error {
+	factory := informers.NewSharedInformerFactory(a.client, a.resyncPeriod)
+	nodes := factory.Core().V1().Nodes()
+	nodes.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { a.enqueue() },
+		UpdateFunc: func(interface{}, interface{}) { a.enqueue() },
+		DeleteFunc: func(interface{}) { a.enqueue() },
+	})
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, nodes.Informer().HasSynced) {
+		return fmt.Errorf("failed to wait for the nodes cache to sync")
+	}
+
+	a.enqueue()
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-stopCh:
+			return nil
+		case <-a.trigger:
+		case <-retry:
+		}
+		retry = nil
+		if err := a.sync(nodes.Lister()); err != nil {
+			log.Printf("failed to sync %s backend: %v", a.backend.Name(), err)
+			retry = time.After(retryInterval)
+		}
+	}
+}
+
+// enqueue requests a sync, the requests are merged while a sync is pending
+func (a *Agent) enqueue() {
+	select {
+	case a.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// sync passes the local node and the remote nodes in the cache to the backend
+func (a *Agent) sync(lister listersv1.NodeLister) error {
+	objs, err := lister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %v", err)
+	}
+	var local *Node
+	var remotes []*Node
+	for _, obj := range objs {
+		node, err := nodeFromObject(obj)
+		if err != nil {
+			if obj.Name == a.nodeName {
+				return err
+			}
+			// the other nodes are still reachable without the broken one
+			log.Printf("skipping node: %v", err)
+			continue
+		}
+		if node.Name == a.nodeName {
+			local = node
+			continue
+		}
+		remotes = append(remotes, node)
+	}
+	if local == nil {
+		return fmt.Errorf("local node %q not found", a.nodeName)
+	}
+	sort.Slice(remotes, func(i, j int) bool { return remotes[i].Name < remotes[j].Name })
+	return a.backend.Sync(local, remotes)
+}
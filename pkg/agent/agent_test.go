@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeBackend records the names of the remote nodes of every sync
+type fakeBackend struct {
+	syncs chan []string
+}
+
+func (b *fakeBackend) Name() string {
+	return "fake"
+}
+
+func (b *fakeBackend) Sync(local *Node, remotes []*Node) error {
+	var names []string
+	for _, node := range remotes {
+		names = append(names, node.Name)
+	}
+	b.syncs <- names
+	return nil
+}
+
+func newNodeObject(name, podCIDR, internalIP string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{PodCIDR: podCIDR},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeHostName, Address: name},
+				{Type: corev1.NodeInternalIP, Address: internalIP},
+			},
+		},
+	}
+}
+
+// waitForSync waits for the backend to be synced with the remote nodes
+func waitForSync(t *testing.T, backend *fakeBackend, want []string) {
+	timeout := time.After(5 * time.Second)
+	var got []string
+	for {
+		select {
+		case got = <-backend.syncs:
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("backend is not synced with remote nodes %v, last synced with %v", want, got)
+		}
+	}
+}
+
+func TestAgentReconcilesNodes(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newNodeObject("node1", "10.244.1.0/24", "192.168.0.1"),
+		newNodeObject("node2", "10.244.2.0/24", "192.168.0.2"),
+	)
+	backend := &fakeBackend{syncs: make(chan []string, 10)}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go func() {
+		if err := New(client, "node1", backend, 0).Run(stopCh); err != nil {
+			t.Errorf("agent stopped with error: %v", err)
+		}
+	}()
+	waitForSync(t, backend, []string{"node2"})
+
+	// a node joins the cluster
+	nodes := client.CoreV1().Nodes()
+	if _, err := nodes.Create(context.TODO(), newNodeObject("node3", "10.244.3.0/24", "192.168.0.3"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForSync(t, backend, []string{"node2", "node3"})
+
+	// a node leaves the cluster
+	if err := nodes.Delete(context.TODO(), "node2", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForSync(t, backend, []string{"node3"})
+}
+
+func TestNodeFromObject(t *testing.T) {
+	tests := []struct {
+		name    string
+		obj     *corev1.Node
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "single stack",
+			obj:  newNodeObject("node1", "10.244.1.0/24", "192.168.0.1"),
+			want: "192.168.0.1",
+		},
+		{
+			name: "dual stack",
+			obj: &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+				Spec:       corev1.NodeSpec{PodCIDR: "fd00:244:1::/64", PodCIDRs: []string{"fd00:244:1::/64", "10.244.1.0/24"}},
+				Status: corev1.NodeStatus{
+					Addresses: []corev1.NodeAddress{
+						{Type: corev1.NodeInternalIP, Address: "192.168.0.1"},
+						{Type: corev1.NodeInternalIP, Address: "fd00::1"},
+					},
+				},
+			},
+			want: "fd00::1",
+		},
+		{
+			name:    "invalid pod CIDR",
+			obj:     newNodeObject("node1", "10.244.1.0", "192.168.0.1"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := nodeFromObject(tt.obj)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("nodeFromObject() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := node.InternalIPFor(node.PodCIDRs[0]); got.String() != tt.want {
+				t.Errorf("InternalIPFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
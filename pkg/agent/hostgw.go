@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"log"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+// BackendHostGW is the backend routing the pod subnets of the remote nodes via their internal IPs
+const BackendHostGW = "host-gw"
+
+// hostGWBackend requires all the nodes on the same L2 segment, the kernel resolves the link to
+// the internal IP of the remote node.
+type hostGWBackend struct{}
+
+// NewHostGWBackend returns the host-gw backend
+func NewHostGWBackend() Backend {
+	return &hostGWBackend{}
+}
+
+func (b *hostGWBackend) Name() string {
+	return BackendHostGW
+}
+
+func (b *hostGWBackend) Sync(local *Node, remotes []*Node) error {
+	var routes []*netlink.Route
+	for _, node := range remotes {
+		for _, cidr := range node.PodCIDRs {
+			gw := node.InternalIPFor(cidr)
+			if gw == nil {
+				log.Printf("node %q has no internal IP to route pod CIDR %q", node.Name, cidr)
+				continue
+			}
+			routes = append(routes, &netlink.Route{Dst: cidr, Gw: gw})
+		}
+	}
+	return nettool.SyncRoutes(routes)
+}
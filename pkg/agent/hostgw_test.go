@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+// addNodeLink adds the link with the node IP as the uplink of the node
+func addNodeLink(name, ip string) error {
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "p"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return err
+	}
+	addr, err := netlink.ParseAddr(ip)
+	if err != nil {
+		return err
+	}
+	if err := netlink.AddrAdd(veth, addr); err != nil {
+		return err
+	}
+	for _, n := range []string{name, name + "p"} {
+		l, err := netlink.LinkByName(n)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mustNode(t *testing.T, name, podCIDR, internalIP string) *Node {
+	node, err := nodeFromObject(newNodeObject(name, podCIDR, internalIP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// minicniRoutes returns the gateways of the routes programmed by minicni keyed by destination
+func minicniRoutes() (map[string]string, error) {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Protocol: nettool.RouteProtocol}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return nil, err
+	}
+	got := map[string]string{}
+	for _, r := range routes {
+		got[r.Dst.String()] = r.Gw.String()
+	}
+	return got, nil
+}
+
+func TestHostGWBackendSync(t *testing.T) {
+	local := mustNode(t, "node1", "10.244.1.0/24", "192.168.100.1")
+	node2 := mustNode(t, "node2", "10.244.2.0/24", "192.168.100.2")
+	node3 := mustNode(t, "node3", "10.244.3.0/24", "192.168.100.3")
+
+	testns.Run(t, func() error {
+		if err := addNodeLink("uplink0", "192.168.100.1/24"); err != nil {
+			return err
+		}
+		// the routes not programmed by minicni are left alone
+		_, other, _ := net.ParseCIDR("10.100.0.0/16")
+		uplink, err := netlink.LinkByName("uplink0")
+		if err != nil {
+			return err
+		}
+		if err := netlink.RouteAdd(&netlink.Route{LinkIndex: uplink.Attrs().Index, Dst: other, Gw: net.ParseIP("192.168.100.254")}); err != nil {
+			return err
+		}
+
+		backend := NewHostGWBackend()
+		steps := []struct {
+			remotes []*Node
+			want    map[string]string
+		}{
+			{
+				remotes: []*Node{node2, node3},
+				want:    map[string]string{"10.244.2.0/24": "192.168.100.2", "10.244.3.0/24": "192.168.100.3"},
+			},
+			{
+				remotes: []*Node{node3},
+				want:    map[string]string{"10.244.3.0/24": "192.168.100.3"},
+			},
+		}
+		for i, step := range steps {
+			if err := backend.Sync(local, step.remotes); err != nil {
+				return err
+			}
+			got, err := minicniRoutes()
+			if err != nil {
+				return err
+			}
+			if fmt.Sprint(got) != fmt.Sprint(step.want) {
+				return fmt.Errorf("step %d: routes are %v, want %v", i, got, step.want)
+			}
+		}
+
+		routes, err := netlink.RouteList(uplink, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		for _, r := range routes {
+			if r.Dst != nil && r.Dst.String() == other.String() {
+				return nil
+			}
+		}
+		return fmt.Errorf("route to %v is removed", other)
+	})
+}
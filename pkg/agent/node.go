@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Node is the kubernetes node with the subnets of its pods
+type Node struct {
+	Name        string
+	PodCIDRs    []*net.IPNet
+	InternalIPs []net.IP
+	Annotations map[string]string
+}
+
+// nodeFromObject returns the node of the kubernetes node object
+func nodeFromObject(obj *corev1.Node) (*Node, error) {
+	node := &Node{Name: obj.Name, Annotations: obj.Annotations}
+	cidrs := obj.Spec.PodCIDRs
+	if len(cidrs) == 0 && obj.Spec.PodCIDR != "" {
+		cidrs = []string{obj.Spec.PodCIDR}
+	}
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pod CIDR %q of node %q: %v", cidr, obj.Name, err)
+		}
+		node.PodCIDRs = append(node.PodCIDRs, ipnet)
+	}
+	for _, addr := range obj.Status.Addresses {
+		if addr.Type != corev1.NodeInternalIP {
+			continue
+		}
+		ip := net.ParseIP(addr.Address)
+		if ip == nil {
+			return nil, fmt.Errorf("failed to parse internal IP %q of node %q", addr.Address, obj.Name)
+		}
+		node.InternalIPs = append(node.InternalIPs, ip)
+	}
+	return node, nil
+}
+
+// InternalIPFor returns the internal IP of the node in the same family as the pod CIDR,
+// nil is returned if the node has no such IP.
+func (n *Node) InternalIPFor(podCIDR *net.IPNet) net.IP {
+	ipv4 := podCIDR.IP.To4() != nil
+	for _, ip := range n.InternalIPs {
+		if (ip.To4() != nil) == ipv4 {
+			return ip
+		}
+	}
+	return nil
+}
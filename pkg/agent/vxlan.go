@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+const (
+	// BackendVXLAN is the backend tunneling the pod traffic to the remote nodes over VXLAN
+	BackendVXLAN = "vxlan"
+	// DefaultVXLANVNI is the VXLAN network identifier of the pod traffic
+	DefaultVXLANVNI = 1
+	// DefaultVXLANPort is the IANA assigned VXLAN port
+	DefaultVXLANPort = 4789
+)
+
+// vxlanBackend only requires the nodes to reach each other over UDP, the pod subnets of the remote nodes
+// are routed through the VXLAN device to their VTEPs. Only the IPv4 pod subnets are supported.
+type vxlanBackend struct {
+	vni  int
+	port int
+}
+
+// NewVXLANBackend returns the vxlan backend with the VXLAN network identifier and UDP port
+func NewVXLANBackend(vni, port int) Backend {
+	return &vxlanBackend{vni: vni, port: port}
+}
+
+func (b *vxlanBackend) Name() string {
+	return BackendVXLAN
+}
+
+func (b *vxlanBackend) Sync(local *Node, remotes []*Node) error {
+	podCIDR, nodeIP := ipv4Endpoint(local)
+	if podCIDR == nil {
+		return fmt.Errorf("local node %q has no IPv4 pod CIDR with an internal IP", local.Name)
+	}
+	link, err := nettool.EnsureVXLAN(b.vni, b.port, nodeIP, podCIDR)
+	if err != nil {
+		return err
+	}
+
+	var vteps []nettool.VTEP
+	for _, node := range remotes {
+		podCIDR, nodeIP := ipv4Endpoint(node)
+		if podCIDR == nil {
+			log.Printf("node %q has no IPv4 pod CIDR with an internal IP", node.Name)
+			continue
+		}
+		vteps = append(vteps, nettool.VTEP{PodCIDR: podCIDR, NodeIP: nodeIP})
+	}
+	return nettool.SyncVTEPs(link, vteps)
+}
+
+// ipv4Endpoint returns the IPv4 pod CIDR and the internal IP of the node, nils are returned if either is missing
+func ipv4Endpoint(node *Node) (*net.IPNet, net.IP) {
+	for _, cidr := range node.PodCIDRs {
+		if cidr.IP.To4() == nil {
+			continue
+		}
+		if ip := node.InternalIPFor(cidr); ip != nil {
+			return cidr, ip
+		}
+	}
+	return nil, nil
+}
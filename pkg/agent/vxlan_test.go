@@ -0,0 +1,218 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+// newFakeNode creates the netns of the node in its own subnet behind the router, that is the current netns,
+// and the bridge with the gateway IP of the pod subnet.
+func newFakeNode(t *testing.T, i int) (ns.NetNS, error) {
+	nodeNS, err := testns.New(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create node netns: %v", err)
+	}
+	routerName := fmt.Sprintf("node%d", i)
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: routerName, MTU: 1500}, PeerName: "eth0"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return nil, err
+	}
+	peer, err := netlink.LinkByName("eth0")
+	if err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetNsFd(peer, int(nodeNS.Fd())); err != nil {
+		return nil, err
+	}
+	if err := addAddrUp(routerName, fmt.Sprintf("192.168.20%d.1/24", i)); err != nil {
+		return nil, err
+	}
+	err = nodeNS.Do(func(ns.NetNS) error {
+		if err := addAddrUp("eth0", fmt.Sprintf("192.168.20%d.2/24", i)); err != nil {
+			return err
+		}
+		eth0, err := netlink.LinkByName("eth0")
+		if err != nil {
+			return err
+		}
+		if err := netlink.RouteAdd(&netlink.Route{LinkIndex: eth0.Attrs().Index, Gw: net.ParseIP(fmt.Sprintf("192.168.20%d.1", i))}); err != nil {
+			return err
+		}
+		_, err = nettool.CreateOrUpdateBridge("minicni0", fmt.Sprintf("10.244.%d.1/24", i), 1500)
+		return err
+	})
+	return nodeNS, err
+}
+
+func addAddrUp(name, ip string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	addr, err := netlink.ParseAddr(ip)
+	if err != nil {
+		return err
+	}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(link)
+}
+
+// dialTCP connects from the client netns to the server listening on the IP in the server netns
+func dialTCP(server ns.NetNS, serverIP string, client ns.NetNS) error {
+	var l net.Listener
+	err := server.Do(func(ns.NetNS) error {
+		var err error
+		l, err = net.Listen("tcp", net.JoinHostPort(serverIP, "0"))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %v", serverIP, err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	return client.Do(func(ns.NetNS) error {
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), 3*time.Second)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %q: %v", l.Addr(), err)
+		}
+		return conn.Close()
+	})
+}
+
+// vxlanEntries returns the FDB entries and the neighbors on the VXLAN device
+func vxlanEntries() (map[string]string, map[string]string, error) {
+	link, err := netlink.LinkByName(nettool.VXLANDeviceName)
+	if err != nil {
+		return nil, nil, err
+	}
+	fdbs, neighs := map[string]string{}, map[string]string{}
+	for family, entries := range map[int]map[string]string{syscall.AF_BRIDGE: fdbs, netlink.FAMILY_V4: neighs} {
+		list, err := netlink.NeighList(link.Attrs().Index, family)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, n := range list {
+			if n.State&netlink.NUD_PERMANENT != 0 {
+				entries[n.HardwareAddr.String()] = n.IP.String()
+			}
+		}
+	}
+	return fdbs, neighs, nil
+}
+
+func TestVXLANBackendSync(t *testing.T) {
+	var nodes []*Node
+	for i := 1; i <= 3; i++ {
+		nodes = append(nodes, mustNode(t, fmt.Sprintf("node%d", i), fmt.Sprintf("10.244.%d.0/24", i), fmt.Sprintf("192.168.20%d.2", i)))
+	}
+
+	testns.Run(t, func() error {
+		// the nodes are in different subnets so that only the tunnel reaches the remote pods
+		if _, err := sysctl.Sysctl("net.ipv4.ip_forward", "1"); err != nil {
+			return err
+		}
+		var nodeNSs []ns.NetNS
+		for i := range nodes {
+			nodeNS, err := newFakeNode(t, i+1)
+			if err != nil {
+				return err
+			}
+			nodeNSs = append(nodeNSs, nodeNS)
+		}
+
+		backend := NewVXLANBackend(DefaultVXLANVNI, DefaultVXLANPort)
+		for i, nodeNS := range nodeNSs {
+			var remotes []*Node
+			for j, node := range nodes {
+				if j != i {
+					remotes = append(remotes, node)
+				}
+			}
+			err := nodeNS.Do(func(ns.NetNS) error {
+				if err := backend.Sync(nodes[i], remotes); err != nil {
+					return err
+				}
+				// syncing again keeps the device
+				return backend.Sync(nodes[i], remotes)
+			})
+			if err != nil {
+				return fmt.Errorf("node%d: %v", i+1, err)
+			}
+		}
+
+		err := nodeNSs[0].Do(func(ns.NetNS) error {
+			link, err := netlink.LinkByName(nettool.VXLANDeviceName)
+			if err != nil {
+				return err
+			}
+			if link.Attrs().MTU != 1500-nettool.VXLANOverhead {
+				return fmt.Errorf("VXLAN device has MTU %d, want %d", link.Attrs().MTU, 1500-nettool.VXLANOverhead)
+			}
+			fdbs, neighs, err := vxlanEntries()
+			if err != nil {
+				return err
+			}
+			wantFDBs := map[string]string{"0a:58:c0:a8:ca:02": "192.168.202.2", "0a:58:c0:a8:cb:02": "192.168.203.2"}
+			wantNeighs := map[string]string{"0a:58:c0:a8:ca:02": "10.244.2.0", "0a:58:c0:a8:cb:02": "10.244.3.0"}
+			if fmt.Sprint(fdbs) != fmt.Sprint(wantFDBs) {
+				return fmt.Errorf("FDB entries are %v, want %v", fdbs, wantFDBs)
+			}
+			if fmt.Sprint(neighs) != fmt.Sprint(wantNeighs) {
+				return fmt.Errorf("neighbors are %v, want %v", neighs, wantNeighs)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := dialTCP(nodeNSs[1], "10.244.2.1", nodeNSs[0]); err != nil {
+			return fmt.Errorf("node1 to node2: %v", err)
+		}
+		if err := dialTCP(nodeNSs[0], "10.244.1.1", nodeNSs[2]); err != nil {
+			return fmt.Errorf("node3 to node1: %v", err)
+		}
+
+		// node2 leaves the cluster
+		return nodeNSs[0].Do(func(ns.NetNS) error {
+			if err := backend.Sync(nodes[0], nodes[2:]); err != nil {
+				return err
+			}
+			fdbs, neighs, err := vxlanEntries()
+			if err != nil {
+				return err
+			}
+			if len(fdbs) != 1 || fdbs["0a:58:c0:a8:cb:02"] != "192.168.203.2" {
+				return fmt.Errorf("FDB entries are %v after node2 left", fdbs)
+			}
+			if len(neighs) != 1 || neighs["0a:58:c0:a8:cb:02"] != "10.244.3.0" {
+				return fmt.Errorf("neighbors are %v after node2 left", neighs)
+			}
+			routes, err := minicniRoutes()
+			if err != nil {
+				return err
+			}
+			want := map[string]string{"10.244.3.0/24": "10.244.3.0"}
+			if fmt.Sprint(routes) != fmt.Sprint(want) {
+				return fmt.Errorf("routes are %v after node2 left, want %v", routes, want)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,140 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+const (
+	// BackendWireGuard is the backend encrypting the pod traffic to the remote nodes with WireGuard
+	BackendWireGuard = "wireguard"
+	// DefaultWireGuardPort is the UDP port WireGuard listens on
+	DefaultWireGuardPort = 51820
+	// WireGuardPublicKeyAnnotation is the node annotation publishing the public key of the node
+	WireGuardPublicKeyAnnotation = "minicni.io/wireguard-public-key"
+	// wireGuardKeyFile is the file of the private key of the node in the state dir
+	wireGuardKeyFile = "wireguard.key"
+)
+
+// wireGuardBackend peers with every remote node publishing its public key, the nodes must listen
+// on the same port. Only the IPv4 pod subnets are supported.
+type wireGuardBackend struct {
+	client kubernetes.Interface
+	port   int
+	key    wgtypes.Key
+}
+
+// NewWireGuardBackend returns the wireguard backend with the private key in the state dir,
+// the key is generated on the first run and kept across restarts.
+func NewWireGuardBackend(client kubernetes.Interface, stateDir string, port int) (Backend, error) {
+	key, err := loadOrGenerateKey(filepath.Join(stateDir, wireGuardKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	return &wireGuardBackend{client: client, port: port, key: key}, nil
+}
+
+func (b *wireGuardBackend) Name() string {
+	return BackendWireGuard
+}
+
+func (b *wireGuardBackend) Sync(local *Node, remotes []*Node) error {
+	podCIDR, nodeIP := ipv4Endpoint(local)
+	if podCIDR == nil {
+		return fmt.Errorf("local node %q has no IPv4 pod CIDR with an internal IP", local.Name)
+	}
+	if err := b.publishKey(local); err != nil {
+		return err
+	}
+	link, err := nettool.EnsureWireGuard(b.key, b.port, nodeIP, podCIDR)
+	if err != nil {
+		return err
+	}
+
+	var peers []nettool.WireGuardPeer
+	for _, node := range remotes {
+		podCIDR, nodeIP := ipv4Endpoint(node)
+		if podCIDR == nil {
+			log.Printf("node %q has no IPv4 pod CIDR with an internal IP", node.Name)
+			continue
+		}
+		// the node is synced again once it publishes its key
+		encoded, ok := node.Annotations[WireGuardPublicKeyAnnotation]
+		if !ok {
+			log.Printf("node %q has not published its WireGuard public key", node.Name)
+			continue
+		}
+		key, err := wgtypes.ParseKey(encoded)
+		if err != nil {
+			log.Printf("failed to parse WireGuard public key of node %q: %v", node.Name, err)
+			continue
+		}
+		peers = append(peers, nettool.WireGuardPeer{
+			PodCIDR:   podCIDR,
+			Endpoint:  &net.UDPAddr{IP: nodeIP, Port: b.port},
+			PublicKey: key,
+		})
+	}
+	return nettool.SyncWireGuardPeers(link, peers)
+}
+
+// publishKey annotates the local node with the public key unless it's already there
+func (b *wireGuardBackend) publishKey(local *Node) error {
+	publicKey := b.key.PublicKey().String()
+	if local.Annotations[WireGuardPublicKeyAnnotation] == publicKey {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{WireGuardPublicKeyAnnotation: publicKey},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := b.client.CoreV1().Nodes().Patch(context.TODO(), local.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to publish WireGuard public key of node %q: %v", local.Name, err)
+	}
+	return nil
+}
+
+// loadOrGenerateKey reads the private key from the file, a new key is generated and written to it if it doesn't exist
+func loadOrGenerateKey(path string) (wgtypes.Key, error) {
+	content, err := ioutil.ReadFile(path)
+	if err == nil {
+		key, err := wgtypes.ParseKey(strings.TrimSpace(string(content)))
+		if err != nil {
+			return wgtypes.Key{}, fmt.Errorf("failed to parse WireGuard private key %q: %v", path, err)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return wgtypes.Key{}, fmt.Errorf("failed to read WireGuard private key %q: %v", path, err)
+	}
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("failed to generate WireGuard private key: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return wgtypes.Key{}, fmt.Errorf("failed to create state dir %q: %v", filepath.Dir(path), err)
+	}
+	if err := ioutil.WriteFile(path, []byte(key.String()+"\n"), 0600); err != nil {
+		return wgtypes.Key{}, fmt.Errorf("failed to write WireGuard private key %q: %v", path, err)
+	}
+	return key, nil
+}
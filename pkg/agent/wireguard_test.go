@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+func TestLoadOrGenerateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minicni-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state", wireGuardKeyFile)
+
+	key, err := loadOrGenerateKey(path)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("key is not written: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file has mode %v, want 0600", info.Mode().Perm())
+	}
+	again, err := loadOrGenerateKey(path)
+	if err != nil {
+		t.Fatalf("failed to load key: %v", err)
+	}
+	if again != key {
+		t.Errorf("loaded key %v, want the generated %v", again.PublicKey(), key.PublicKey())
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadOrGenerateKey(path); err == nil {
+		t.Errorf("expected error loading broken key")
+	}
+}
+
+func TestWireGuardPublishKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minicni-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := fake.NewSimpleClientset(newNodeObject("node1", "10.244.1.0/24", "192.168.0.1"))
+	backend, err := NewWireGuardBackend(client, dir, DefaultWireGuardPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.(*wireGuardBackend).publishKey(mustNode(t, "node1", "10.244.1.0/24", "192.168.0.1")); err != nil {
+		t.Fatalf("failed to publish key: %v", err)
+	}
+	obj, err := client.CoreV1().Nodes().Get(context.TODO(), "node1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := backend.(*wireGuardBackend).key.PublicKey().String()
+	if got := obj.Annotations[WireGuardPublicKeyAnnotation]; got != want {
+		t.Errorf("node has public key %q, want %q", got, want)
+	}
+}
+
+func TestWireGuardBackendSync(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newNodeObject("node1", "10.244.1.0/24", "192.168.201.2"),
+		newNodeObject("node2", "10.244.2.0/24", "192.168.202.2"),
+	)
+	var backends []Backend
+	for i := 1; i <= 2; i++ {
+		dir, err := ioutil.TempDir("", "minicni-state")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		backend, err := NewWireGuardBackend(client, dir, DefaultWireGuardPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, backend)
+	}
+	// nodes returns the local and remote nodes of the node at the index as stored in the cluster
+	nodes := func(i int) (*Node, []*Node, error) {
+		list, err := client.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		var local *Node
+		var remotes []*Node
+		for j := range list.Items {
+			node, err := nodeFromObject(&list.Items[j])
+			if err != nil {
+				return nil, nil, err
+			}
+			if node.Name == fmt.Sprintf("node%d", i+1) {
+				local = node
+			} else {
+				remotes = append(remotes, node)
+			}
+		}
+		return local, remotes, nil
+	}
+
+	unsupported := false
+	testns.Run(t, func() error {
+		if _, err := sysctl.Sysctl("net.ipv4.ip_forward", "1"); err != nil {
+			return err
+		}
+		var nodeNSs []ns.NetNS
+		for i := range backends {
+			nodeNS, err := newFakeNode(t, i+1)
+			if err != nil {
+				return err
+			}
+			nodeNSs = append(nodeNSs, nodeNS)
+		}
+		err := nodeNSs[0].Do(func(ns.NetNS) error {
+			err := netlink.LinkAdd(&netlink.GenericLink{LinkAttrs: netlink.LinkAttrs{Name: "wgtest"}, LinkType: "wireguard"})
+			if err == unix.EOPNOTSUPP {
+				unsupported = true
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			link, err := netlink.LinkByName("wgtest")
+			if err != nil {
+				return err
+			}
+			return netlink.LinkDel(link)
+		})
+		if err != nil || unsupported {
+			return err
+		}
+
+		// the first round publishes the keys, the second one peers the nodes
+		for round := 0; round < 2; round++ {
+			for i, nodeNS := range nodeNSs {
+				local, remotes, err := nodes(i)
+				if err != nil {
+					return err
+				}
+				err = nodeNS.Do(func(ns.NetNS) error {
+					return backends[i].Sync(local, remotes)
+				})
+				if err != nil {
+					return fmt.Errorf("round %d node%d: %v", round, i+1, err)
+				}
+			}
+		}
+
+		err = nodeNSs[0].Do(func(ns.NetNS) error {
+			link, err := netlink.LinkByName(nettool.WireGuardDeviceName)
+			if err != nil {
+				return err
+			}
+			if link.Attrs().MTU != 1500-nettool.WireGuardOverhead {
+				return fmt.Errorf("WireGuard device has MTU %d, want %d", link.Attrs().MTU, 1500-nettool.WireGuardOverhead)
+			}
+			device, err := nettool.GetWireGuardDevice()
+			if err != nil {
+				return err
+			}
+			if len(device.Peers) != 1 || device.Peers[0].PublicKey != backends[1].(*wireGuardBackend).key.PublicKey() {
+				return fmt.Errorf("unexpected peers %v", device.Peers)
+			}
+			if ips := device.Peers[0].AllowedIPs; len(ips) != 1 || ips[0].String() != "10.244.2.0/24" {
+				return fmt.Errorf("peer has allowed IPs %v, want [10.244.2.0/24]", ips)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := dialTCP(nodeNSs[1], "10.244.2.1", nodeNSs[0]); err != nil {
+			return fmt.Errorf("node1 to node2: %v", err)
+		}
+		return dialTCP(nodeNSs[0], "10.244.1.1", nodeNSs[1])
+	})
+	if unsupported {
+		t.Skip("wireguard is not supported by the kernel")
+	}
+}
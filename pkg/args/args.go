@@ -1,9 +1,11 @@
 package args
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
 const (
@@ -42,8 +44,130 @@ type CNIConfiguration struct {
 	Name       string `json:"name"`
 	Type       string `json:"type"`
 	Bridge     string `json:"bridge"`
-	MTU        int    `json:"mtu"`
-	Subnet     string `json:"subnet"`
+	MTU        MTU    `json:"mtu"`
+	// Encapsulation is how the agent carries the pod traffic to the remote nodes: none, vxlan or
+	// wireguard. Its overhead is taken off the detected MTU.
+	Encapsulation   string   `json:"encapsulation"`
+	Subnet          string   `json:"subnet"`
+	IPMasq          bool     `json:"ipMasq"`
+	ClusterCIDRs    []string `json:"clusterCIDRs"`
+	FirewallBackend string   `json:"firewallBackend"`
+	// Mode is how the pod is attached to the network: bridge, macvlan, ipvlan or ptp
+	Mode string `json:"mode"`
+	// Master is the host interface the sub-interfaces of the pods are created on
+	Master      string `json:"master"`
+	MacvlanMode string `json:"macvlanMode"`
+	IPVlanMode  string `json:"ipvlanMode"`
+	// bridge port options applied to the host veth of each pod
+	HairpinMode   bool  `json:"hairpinMode"`
+	PortIsolation bool  `json:"portIsolation"`
+	Learning      *bool `json:"learning,omitempty"`
+	Flood         *bool `json:"flood,omitempty"`
+	Guard         bool  `json:"guard"`
+	PromiscMode   bool  `json:"promiscMode"`
+	// AnnounceCount is the number of gratuitous ARPs or unsolicited neighbor advertisements
+	// sent for the pod address, 0 turns the announcements off
+	AnnounceCount      *int `json:"announceCount,omitempty"`
+	AnnounceIntervalMs int  `json:"announceIntervalMs"`
+	// ARPProbe probes the candidate IP on the bridge before handing it out, the IPs that answer
+	// are marked as conflicts and skipped for a while, or probed again once the pool is used up
+	ARPProbe          bool `json:"arpProbe"`
+	ARPProbeTimeoutMs int  `json:"arpProbeTimeoutMs"`
+	// NetworkPolicy blocks the traffic of the pods until the agent programs their network policies
+	NetworkPolicy bool `json:"networkPolicy"`
+	// Sysctl is set in the netns of every pod, the pods can override it with annotations
+	Sysctl map[string]string `json:"sysctl,omitempty"`
+	// Routes are added in the netns of every pod besides the default route
+	Routes []Route `json:"routes,omitempty"`
+	// SpoofCheck drops the frames from the pod whose source MAC or IP is not the one of the pod
+	SpoofCheck bool `json:"spoofCheck"`
+	// Isolation drops the traffic between the bridge of the network and the bridges of the other isolated networks
+	Isolation bool `json:"isolation"`
+	// IsolateHost drops the connections from the pods of the isolated network to the host
+	IsolateHost bool `json:"isolateHost"`
+	// DeleteBridge deletes the bridge once the last pod on it is gone
+	DeleteBridge bool `json:"deleteBridge"`
+	// VethPrefix is the prefix of the host veth names followed by the hash of the container ID and the interface name
+	VethPrefix string `json:"vethPrefix"`
+	// HostSettings is what to do with the forwarding and bridge netfilter sysctls of the host: check, enable or nothing if empty
+	HostSettings string `json:"hostSettings"`
+	// Capabilities declares the runtime config the plugin supports
+	Capabilities map[string]bool `json:"capabilities,omitempty"`
+	// RuntimeConfig is filled by the container runtime for the capabilities the plugin declares
+	RuntimeConfig RuntimeConfig `json:"runtimeConfig"`
+}
+
+type RuntimeConfig struct {
+	PortMappings []PortMapping `json:"portMappings,omitempty"`
+	Bandwidth    *Bandwidth    `json:"bandwidth,omitempty"`
+	MAC          string        `json:"mac,omitempty"`
+}
+
+// Route is the extra route of the pod, the pod gateway is used if the gateway is not set
+type Route struct {
+	Dst    string `json:"dst"`
+	GW     string `json:"gw,omitempty"`
+	Metric int    `json:"metric,omitempty"`
+}
+
+// MTUAuto detects the MTU of the pods from the node, it's the same as leaving the MTU unset
+const MTUAuto = "auto"
+
+// MTU is the MTU of the pod interfaces, 0 means it's detected from the node
+type MTU int
+
+// UnmarshalJSON accepts the MTU as a number or MTUAuto
+func (m *MTU) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		if s != MTUAuto {
+			return fmt.Errorf("invalid mtu %q, it must be a number or %q", s, MTUAuto)
+		}
+		*m = 0
+		return nil
+	}
+	var n int
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("invalid mtu %s: %v", data, err)
+	}
+	if n < 0 {
+		return fmt.Errorf("invalid mtu %d", n)
+	}
+	*m = MTU(n)
+	return nil
+}
+
+// PortMapping is the hostPort of the container passed with portMappings capability
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// Bandwidth is the traffic shaping of the container passed with bandwidth capability,
+// the rates are in bits per second and the bursts are in bits.
+type Bandwidth struct {
+	IngressRate  uint64 `json:"ingressRate,omitempty"`
+	IngressBurst uint64 `json:"ingressBurst,omitempty"`
+	EgressRate   uint64 `json:"egressRate,omitempty"`
+	EgressBurst  uint64 `json:"egressBurst,omitempty"`
+}
+
+// ParseCNIArgs parses the CNI_ARGS in the format of "FOO=BAR;ABC=123", the empty pairs are skipped
+func ParseCNIArgs(args string) (map[string]string, error) {
+	cniArgs := map[string]string{}
+	for _, pair := range strings.Split(args, ";") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid CNI_ARGS pair %q", pair)
+		}
+		cniArgs[kv[0]] = kv[1]
+	}
+	return cniArgs, nil
 }
 
 func GetArgsFromEnv() (string, *CmdArgs, error) {
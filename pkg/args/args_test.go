@@ -0,0 +1,61 @@
+package args
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMTUUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		config  string
+		want    MTU
+		wantErr bool
+	}{
+		{config: `{}`, want: 0},
+		{config: `{"mtu": "auto"}`, want: 0},
+		{config: `{"mtu": 9001}`, want: 9001},
+		{config: `{"mtu": "1460"}`, wantErr: true},
+		{config: `{"mtu": -1}`, wantErr: true},
+		{config: `{"mtu": true}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.config, func(t *testing.T) {
+			var conf CNIConfiguration
+			err := json.Unmarshal([]byte(tt.config), &conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if conf.MTU != tt.want {
+				t.Errorf("wanted MTU %d, got %d", tt.want, conf.MTU)
+			}
+		})
+	}
+}
+
+func TestParseCNIArgs(t *testing.T) {
+	tests := []struct {
+		args    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{args: "", want: map[string]string{}},
+		{args: "IgnoreUnknown=1;K8S_POD_NAME=pod0", want: map[string]string{"IgnoreUnknown": "1", "K8S_POD_NAME": "pod0"}},
+		{args: "IP=10.244.1.5;", want: map[string]string{"IP": "10.244.1.5"}},
+		{args: ";;MAC=02:00:00:00:00:01", want: map[string]string{"MAC": "02:00:00:00:00:01"}},
+		{args: "K8S_POD_NAME=", want: map[string]string{"K8S_POD_NAME": ""}},
+		{args: "K8S_POD_NAME", wantErr: true},
+		{args: "=pod0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			got, err := ParseCNIArgs(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCNIArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseCNIArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
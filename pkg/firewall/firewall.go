@@ -0,0 +1,264 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/morvencao/minicni/pkg/args"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// BackendAuto selects nftables when the kernel supports it and falls back to iptables
+	BackendAuto = "auto"
+	// BackendNFTables programs the rules through nftables netlink API
+	BackendNFTables = "nftables"
+	// BackendIPTables programs the rules with the iptables binary
+	BackendIPTables = "iptables"
+)
+
+// Firewall manages all the netfilter rules that minicni installs on the host
+type Firewall interface {
+	// Backend returns the name of the firewall backend
+	Backend() string
+	// SetupIPMasq masquerades the traffic from the subnet of the network
+	// that leaves the node, except for the traffic to the excluded subnets.
+	SetupIPMasq(network string, subnet *net.IPNet, excludes []*net.IPNet) error
+	// TeardownIPMasq removes the masquerade rules of the network
+	TeardownIPMasq(network string, subnet *net.IPNet) error
+	// SetupPortMappings forwards the host ports to the ports of the container IP,
+	// the rules are kept in the chains tagged with the container ID.
+	SetupPortMappings(containerID string, containerIP net.IP, mappings []args.PortMapping) error
+	// TeardownPortMappings removes the port forwarding rules of the container
+	TeardownPortMappings(containerID string) error
+	// BlockPod drops the forwarded traffic from and to the pod IP until SyncPodPolicies covers the pod
+	BlockPod(podIP net.IP) error
+	// SyncPodPolicies replaces the policy rules of the pods, the rules of the pods isolated in
+	// neither direction are removed. The rules of the pods not in the list are left alone.
+	SyncPodPolicies(policies []PodPolicy) error
+	// TeardownPodPolicy removes the policy rules of the pod IP
+	TeardownPodPolicy(podIP net.IP) error
+	// SetupSpoofCheck drops the frames entering the bridge from the host veth of the pod
+	// unless their source MAC and IP, and those of the ARP packets, are the ones of the pod.
+	SetupSpoofCheck(hostVeth string, mac net.HardwareAddr, podIP net.IP) error
+	// TeardownSpoofCheck removes the spoof check of the host veth
+	TeardownSpoofCheck(hostVeth string) error
+	// SyncIsolation replaces the isolation rules with the ones of the networks, the isolation
+	// rules are removed altogether if there are no networks.
+	SyncIsolation(networks []IsolatedNetwork) error
+}
+
+// IsolatedNetwork is the network whose pods can't reach the pods of the other isolated networks through the host
+type IsolatedNetwork struct {
+	Name   string
+	Bridge string
+	Subnet *net.IPNet
+	// IsolateHost drops the connections from the pods of the network to the host itself
+	IsolateHost bool
+}
+
+// PodPolicy is the network policy of the pod keyed by its IP
+type PodPolicy struct {
+	IP net.IP
+	// IngressIsolated drops the traffic to the pod unless it's allowed by the ingress rules
+	IngressIsolated bool
+	Ingress         []PolicyRule
+	// EgressIsolated drops the traffic from the pod unless it's allowed by the egress rules
+	EgressIsolated bool
+	Egress         []PolicyRule
+}
+
+// PolicyRule allows the traffic from or to the peers on the destination ports, the rule
+// without peers matches all the peers and the one without ports matches all the ports.
+type PolicyRule struct {
+	Peers []*net.IPNet
+	Ports []PolicyPort
+}
+
+// PolicyPort is the destination port of the traffic, port 0 matches all the ports of the protocol
+type PolicyPort struct {
+	Protocol string
+	Port     int
+}
+
+// New returns the firewall for the backend, the empty backend means auto detection
+func New(backend string) (Firewall, error) {
+	switch backend {
+	case "", BackendAuto:
+		if nftablesAvailable() {
+			return newNFTablesFirewall(), nil
+		}
+		return newIPTablesFirewall(), nil
+	case BackendNFTables:
+		return newNFTablesFirewall(), nil
+	case BackendIPTables:
+		return newIPTablesFirewall(), nil
+	default:
+		return nil, fmt.Errorf("unknown firewall backend %q", backend)
+	}
+}
+
+func ipMasqComment(network string) string {
+	return fmt.Sprintf("minicni masquerade for network %s", network)
+}
+
+func hostPortComment(containerID string) string {
+	return fmt.Sprintf("minicni hostport for container %s", containerID)
+}
+
+func policyComment(podIP net.IP, ingress bool) string {
+	if ingress {
+		return fmt.Sprintf("minicni ingress policy for pod %s", podIP)
+	}
+	return fmt.Sprintf("minicni egress policy for pod %s", podIP)
+}
+
+// isolationComment tags the jumps to the isolation chains which are shared by all the networks
+const isolationComment = "minicni isolation"
+
+func spoofCheckComment(hostVeth string) string {
+	return fmt.Sprintf("minicni spoof check for port %s", hostVeth)
+}
+
+// hostPort is the validated port mapping for the container IP
+type hostPort struct {
+	protocol      string
+	protoNum      byte
+	hostIP        net.IP
+	hostPort      uint16
+	containerPort uint16
+}
+
+// parsePortMappings validates the port mappings, the mappings with the host IP
+// of a different IP family than the container IP are ignored.
+func parsePortMappings(containerIP net.IP, mappings []args.PortMapping) ([]hostPort, error) {
+	var hostPorts []hostPort
+	for _, pm := range mappings {
+		var hp hostPort
+		var err error
+		hp.protocol, hp.protoNum, err = parseProtocol(pm.Protocol)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported protocol %q for host port %d", pm.Protocol, pm.HostPort)
+		}
+		if pm.HostPort <= 0 || pm.HostPort > 65535 {
+			return nil, fmt.Errorf("invalid host port %d", pm.HostPort)
+		}
+		if pm.ContainerPort <= 0 || pm.ContainerPort > 65535 {
+			return nil, fmt.Errorf("invalid container port %d for host port %d", pm.ContainerPort, pm.HostPort)
+		}
+		hp.hostPort, hp.containerPort = uint16(pm.HostPort), uint16(pm.ContainerPort)
+		if pm.HostIP != "" {
+			hp.hostIP = net.ParseIP(pm.HostIP)
+			if hp.hostIP == nil {
+				return nil, fmt.Errorf("invalid host IP %q for host port %d", pm.HostIP, pm.HostPort)
+			}
+			if hp.hostIP.IsUnspecified() {
+				hp.hostIP = nil
+			} else if (hp.hostIP.To4() == nil) != (containerIP.To4() == nil) {
+				continue
+			}
+		}
+		hostPorts = append(hostPorts, hp)
+	}
+	return hostPorts, nil
+}
+
+// parseProtocol returns the lower case name and the number of the L4 protocol, TCP is the default
+func parseProtocol(protocol string) (string, byte, error) {
+	switch name := strings.ToLower(protocol); name {
+	case "", "tcp":
+		return "tcp", unix.IPPROTO_TCP, nil
+	case "udp":
+		return name, unix.IPPROTO_UDP, nil
+	case "sctp":
+		return name, unix.IPPROTO_SCTP, nil
+	default:
+		return "", 0, fmt.Errorf("unsupported protocol %q", protocol)
+	}
+}
+
+// policyMatch is a single peer and port combination of the policy rules, the nil peer
+// matches all the peers and the empty protocol matches all the ports.
+type policyMatch struct {
+	peer     *net.IPNet
+	protocol string
+	protoNum byte
+	port     uint16
+}
+
+// expandPolicyRules flattens the policy rules of the pod into the matches, the peers
+// of the other IP family are dropped.
+func expandPolicyRules(podIP net.IP, rules []PolicyRule) ([]policyMatch, error) {
+	ipv4 := podIP.To4() != nil
+	var matches []policyMatch
+	for _, rule := range rules {
+		peers := []*net.IPNet{nil}
+		if len(rule.Peers) > 0 {
+			peers = nil
+			for _, peer := range rule.Peers {
+				if isIPv4(peer) == ipv4 {
+					peers = append(peers, peer)
+				}
+			}
+			// the rule allows none of the peers in the family rather than all of them
+			if len(peers) == 0 {
+				continue
+			}
+		}
+		ports := []policyMatch{{}}
+		if len(rule.Ports) > 0 {
+			ports = nil
+			for _, p := range rule.Ports {
+				protocol, protoNum, err := parseProtocol(p.Protocol)
+				if err != nil {
+					return nil, err
+				}
+				if p.Port < 0 || p.Port > 65535 {
+					return nil, fmt.Errorf("invalid policy port %d", p.Port)
+				}
+				ports = append(ports, policyMatch{protocol: protocol, protoNum: protoNum, port: uint16(p.Port)})
+			}
+		}
+		for _, peer := range peers {
+			for _, port := range ports {
+				port.peer = peer
+				matches = append(matches, port)
+			}
+		}
+	}
+	return matches, nil
+}
+
+func multicastNet(subnet *net.IPNet) *net.IPNet {
+	cidr := "224.0.0.0/4"
+	if subnet.IP.To4() == nil {
+		cidr = "ff00::/8"
+	}
+	_, ipnet, _ := net.ParseCIDR(cidr)
+	return ipnet
+}
+
+func isIPv4(ipn *net.IPNet) bool {
+	return ipn.IP.To4() != nil
+}
+
+// hostIPNet returns the single address subnet of the IP
+func hostIPNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+}
+
+// linkLocalIP returns the EUI-64 link-local IPv6 address that the kernel derives from the MAC
+func linkLocalIP(mac net.HardwareAddr) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	ip[0], ip[1] = 0xfe, 0x80
+	ip[8] = mac[0] ^ 0x02
+	ip[9], ip[10] = mac[1], mac[2]
+	ip[11], ip[12] = 0xff, 0xfe
+	copy(ip[13:], mac[3:6])
+	return ip
+}
@@ -0,0 +1,322 @@
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+
+	"github.com/morvencao/minicni/pkg/args"
+	"github.com/morvencao/minicni/pkg/internal/testns"
+)
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", cidr, err)
+	}
+	return ipnet
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		backend string
+		want    string
+		wantErr bool
+	}{
+		{backend: BackendNFTables, want: BackendNFTables},
+		{backend: BackendIPTables, want: BackendIPTables},
+		{backend: "ebtables", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.backend, func(t *testing.T) {
+			fw, err := New(tt.backend)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && fw.Backend() != tt.want {
+				t.Errorf("wanted backend %q, got %q", tt.want, fw.Backend())
+			}
+		})
+	}
+}
+
+func TestNFTablesIPMasq(t *testing.T) {
+	subnet := mustParseCIDR(t, "10.244.1.0/24")
+	excludes := []*net.IPNet{mustParseCIDR(t, "10.244.0.0/16"), mustParseCIDR(t, "fd00::/64")}
+
+	if !nftablesAvailable() {
+		t.Skip("nftables is not available")
+	}
+	testns.Run(t, func() error {
+		fw := newNFTablesFirewall().(*nftablesFirewall)
+		conn := &nftables.Conn{}
+		countRules := func(chain string) int {
+			rules, err := fw.listRules(conn, chain)
+			if err != nil {
+				t.Errorf("failed to list rules of %q: %v", chain, err)
+			}
+			return len(rules)
+		}
+
+		// setting up twice must not duplicate the rules
+		for i := 0; i < 2; i++ {
+			if err := fw.SetupIPMasq("test", subnet, excludes); err != nil {
+				return fmt.Errorf("SetupIPMasq error = %v", err)
+			}
+		}
+		if got := countRules("postrouting"); got != 1 {
+			t.Errorf("wanted 1 rule in postrouting, got %d", got)
+		}
+		// pod subnet, IPv4 cluster subnet and masquerade
+		if got := countRules("masq-test"); got != 3 {
+			t.Errorf("wanted 3 rules in masq-test, got %d", got)
+		}
+
+		if err := fw.SetupIPMasq("other", mustParseCIDR(t, "10.245.0.0/24"), nil); err != nil {
+			return fmt.Errorf("SetupIPMasq error = %v", err)
+		}
+		if err := fw.TeardownIPMasq("test", subnet); err != nil {
+			return fmt.Errorf("TeardownIPMasq error = %v", err)
+		}
+		if got := countRules("postrouting"); got != 1 {
+			t.Errorf("wanted 1 rule in postrouting after teardown, got %d", got)
+		}
+		if exists, _ := fw.chainExists(conn, "masq-test"); exists {
+			t.Errorf("chain masq-test still exists after teardown")
+		}
+		// tearing down twice is not an error
+		if err := fw.TeardownIPMasq("test", subnet); err != nil {
+			return fmt.Errorf("TeardownIPMasq error = %v", err)
+		}
+		return nil
+	})
+}
+
+func TestNFTablesEnsureRule(t *testing.T) {
+	if !nftablesAvailable() {
+		t.Skip("nftables is not available")
+	}
+	jump := &expr.Verdict{Kind: expr.VerdictJump, Chain: "target"}
+	tests := []struct {
+		name    string
+		exprs   []expr.Any
+		changed []expr.Any
+	}{
+		{
+			name:    "destination",
+			exprs:   append(matchIPNet(mustParseCIDR(t, "10.244.1.0/24"), false, expr.CmpOpEq), jump),
+			changed: append(matchIPNet(mustParseCIDR(t, "10.244.2.0/24"), false, expr.CmpOpEq), jump),
+		},
+		{
+			name:    "input interface",
+			exprs:   append(matchIIFName("veth0"), jump),
+			changed: append(matchIIFName("veth1"), jump),
+		},
+		{
+			name:    "jump only",
+			exprs:   []expr.Any{jump},
+			changed: append(matchIPNet(mustParseCIDR(t, "fd00::/64"), true, expr.CmpOpEq), jump),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testns.Run(t, func() error {
+				fw := newNFTablesFirewall().(*nftablesFirewall)
+				ensure := func(exprs []expr.Any) (*nftables.Rule, error) {
+					conn := &nftables.Conn{}
+					chain := fw.ensureBaseChain(conn, "forward", nftables.ChainTypeFilter, nftables.ChainHookForward, nftables.ChainPriorityFilter)
+					fw.ensureChain(conn, "target")
+					// another rule goes after the one kept in place
+					if err := fw.ensureRule(conn, chain, "test", exprs); err != nil {
+						return nil, err
+					}
+					if err := fw.ensureRule(conn, chain, "other", []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}); err != nil {
+						return nil, err
+					}
+					if err := conn.Flush(); err != nil {
+						return nil, err
+					}
+					rules, err := fw.listRules(conn, "forward")
+					if err != nil {
+						return nil, err
+					}
+					if len(rules) != 2 || !bytes.Equal(rules[0].UserData, ruleComment("test")) {
+						return nil, fmt.Errorf("wanted the rule followed by the other one, got %d rules", len(rules))
+					}
+					return rules[0], nil
+				}
+
+				first, err := ensure(tt.exprs)
+				if err != nil {
+					return err
+				}
+				// the same rule is left alone
+				again, err := ensure(tt.exprs)
+				if err != nil {
+					return err
+				}
+				if again.Handle != first.Handle {
+					t.Errorf("unchanged rule is replaced, handle %d, was %d", again.Handle, first.Handle)
+				}
+				// the stale rule is replaced in place
+				replaced, err := ensure(tt.changed)
+				if err != nil {
+					return err
+				}
+				if replaced.Handle == first.Handle || !fw.sameExprs(replaced.Exprs, tt.changed) {
+					t.Errorf("stale rule is not replaced, got %+v", replaced)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestIPTablesIPMasq(t *testing.T) {
+	if _, err := exec.LookPath("iptables"); err != nil {
+		t.Skip("iptables binary is not available")
+	}
+	subnet := mustParseCIDR(t, "10.244.1.0/24")
+	excludes := []*net.IPNet{mustParseCIDR(t, "10.244.0.0/16")}
+
+	testns.Run(t, func() error {
+		fw := newIPTablesFirewall()
+		for i := 0; i < 2; i++ {
+			if err := fw.SetupIPMasq("test", subnet, excludes); err != nil {
+				return fmt.Errorf("SetupIPMasq error = %v", err)
+			}
+		}
+		ipt, err := iptables.New()
+		if err != nil {
+			return err
+		}
+		// the chain policy is listed as the first line
+		rules, err := ipt.List("nat", iptablesChainName("MINICNI-MASQ-", "test"))
+		if err != nil {
+			return err
+		}
+		if len(rules) != 4 {
+			t.Errorf("wanted the chain policy and 3 rules in the masquerade chain, got %v", rules)
+		}
+
+		if err := fw.TeardownIPMasq("test", subnet); err != nil {
+			return fmt.Errorf("TeardownIPMasq error = %v", err)
+		}
+		chains, err := ipt.ListChains("nat")
+		if err != nil {
+			return err
+		}
+		for _, c := range chains {
+			if c == iptablesChainName("MINICNI-MASQ-", "test") {
+				t.Errorf("masquerade chain still exists after teardown")
+			}
+		}
+		return nil
+	})
+}
+
+func TestParsePortMappings(t *testing.T) {
+	tests := []struct {
+		name     string
+		ip       string
+		mappings []args.PortMapping
+		want     int
+		wantErr  bool
+	}{
+		{
+			name: "default protocol and unspecified host IP",
+			ip:   "10.244.1.2",
+			mappings: []args.PortMapping{
+				{HostPort: 8080, ContainerPort: 80},
+				{HostPort: 5353, ContainerPort: 53, Protocol: "UDP", HostIP: "0.0.0.0"},
+				{HostPort: 3868, ContainerPort: 3868, Protocol: "sctp", HostIP: "192.168.1.10"},
+			},
+			want: 3,
+		},
+		{
+			name:     "host IP of other family is ignored",
+			ip:       "10.244.1.2",
+			mappings: []args.PortMapping{{HostPort: 8080, ContainerPort: 80, HostIP: "fd00::1"}},
+			want:     0,
+		},
+		{
+			name:     "unsupported protocol",
+			ip:       "10.244.1.2",
+			mappings: []args.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "icmp"}},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid host port",
+			ip:       "10.244.1.2",
+			mappings: []args.PortMapping{{HostPort: 70000, ContainerPort: 80}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostPorts, err := parsePortMappings(net.ParseIP(tt.ip), tt.mappings)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePortMappings error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(hostPorts) != tt.want {
+				t.Errorf("wanted %d host ports, got %v", tt.want, hostPorts)
+			}
+		})
+	}
+}
+
+func TestNFTablesPortMappings(t *testing.T) {
+	containerIP := net.ParseIP("10.244.1.2")
+	mappings := []args.PortMapping{
+		{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"},
+		{HostPort: 5353, ContainerPort: 53, Protocol: "udp", HostIP: "127.0.0.1"},
+	}
+
+	if !nftablesAvailable() {
+		t.Skip("nftables is not available")
+	}
+	testns.Run(t, func() error {
+		fw := newNFTablesFirewall().(*nftablesFirewall)
+		conn := &nftables.Conn{}
+		countRules := func(chain string) int {
+			rules, err := fw.listRules(conn, chain)
+			if err != nil {
+				t.Errorf("failed to list rules of %q: %v", chain, err)
+			}
+			return len(rules)
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := fw.SetupPortMappings("c1", containerIP, mappings); err != nil {
+				return fmt.Errorf("SetupPortMappings error = %v", err)
+			}
+		}
+		if err := fw.SetupPortMappings("c2", net.ParseIP("10.244.1.3"), mappings[:1]); err != nil {
+			return fmt.Errorf("SetupPortMappings error = %v", err)
+		}
+		for chain, want := range map[string]int{"prerouting": 1, "output": 1, "hostports": 2, "hostport-c1": 2, "hostport-c2": 1, "postrouting": 4} {
+			if got := countRules(chain); got != want {
+				t.Errorf("wanted %d rules in %s, got %d", want, chain, got)
+			}
+		}
+
+		if err := fw.TeardownPortMappings("c1"); err != nil {
+			return fmt.Errorf("TeardownPortMappings error = %v", err)
+		}
+		for chain, want := range map[string]int{"hostports": 1, "hostport-c1": 0, "postrouting": 2} {
+			if got := countRules(chain); got != want {
+				t.Errorf("wanted %d rules in %s after teardown, got %d", want, chain, got)
+			}
+		}
+		if exists, _ := fw.chainExists(conn, "hostport-c1"); exists {
+			t.Errorf("chain hostport-c1 still exists after teardown")
+		}
+		return nil
+	})
+}
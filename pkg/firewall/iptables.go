@@ -0,0 +1,131 @@
+package firewall
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// iptablesFirewall programs the rules with the iptables binary for the hosts without nftables
+type iptablesFirewall struct{}
+
+func newIPTablesFirewall() Firewall {
+	return &iptablesFirewall{}
+}
+
+func (f *iptablesFirewall) Backend() string {
+	return BackendIPTables
+}
+
+// SetupIPMasq installs iptables rules to masquerade traffic coming from
+// the pod subnet and leaving the node, except for the excluded subnets.
+func (f *iptablesFirewall) SetupIPMasq(network string, subnet *net.IPNet, excludes []*net.IPNet) error {
+	ipt, err := newIPTables(isIPv4(subnet))
+	if err != nil {
+		return err
+	}
+	chain := iptablesChainName("MINICNI-MASQ-", network)
+	comment := ipMasqComment(network)
+
+	if err := ensureChain(ipt, "nat", chain); err != nil {
+		return err
+	}
+
+	// packets to the pod subnet and the cluster subnets should not be touched
+	for _, dst := range append([]*net.IPNet{subnet}, excludes...) {
+		if isIPv4(dst) != isIPv4(subnet) {
+			continue
+		}
+		if err := ipt.AppendUnique("nat", chain, "-d", dst.String(), "-j", "ACCEPT", "-m", "comment", "--comment", comment); err != nil {
+			return fmt.Errorf("failed to add accept rule for %q: %v", dst, err)
+		}
+	}
+
+	// don't masquerade multicast, pods should be able to talk to other pods
+	// on the local network via multicast.
+	if err := ipt.AppendUnique("nat", chain, "!", "-d", multicastNet(subnet).String(), "-j", "MASQUERADE", "-m", "comment", "--comment", comment); err != nil {
+		return fmt.Errorf("failed to add masquerade rule: %v", err)
+	}
+
+	// packets from the pod subnet will hit the chain
+	if err := ipt.AppendUnique("nat", "POSTROUTING", "-s", subnet.String(), "-j", chain, "-m", "comment", "--comment", comment); err != nil {
+		return fmt.Errorf("failed to jump to nat chain %q: %v", chain, err)
+	}
+	return nil
+}
+
+// TeardownIPMasq undoes the effects of SetupIPMasq
+func (f *iptablesFirewall) TeardownIPMasq(network string, subnet *net.IPNet) error {
+	ipt, err := newIPTables(isIPv4(subnet))
+	if err != nil {
+		return err
+	}
+	chain := iptablesChainName("MINICNI-MASQ-", network)
+
+	err = ipt.Delete("nat", "POSTROUTING", "-s", subnet.String(), "-j", chain, "-m", "comment", "--comment", ipMasqComment(network))
+	if err != nil && !isNotExist(err) {
+		return fmt.Errorf("failed to delete jump to nat chain %q: %v", chain, err)
+	}
+	return deleteChain(ipt, "nat", chain)
+}
+
+// iptablesChainName returns the chain name with the prefix for the key,
+// iptables chain names are limited to 28 characters.
+func iptablesChainName(prefix, key string) string {
+	h := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s%x", prefix, h[:(28-len(prefix))/2])
+}
+
+// ensureChain creates the chain if doesn't exist
+func ensureChain(ipt *iptables.IPTables, table, chain string) error {
+	chains, err := ipt.ListChains(table)
+	if err != nil {
+		return fmt.Errorf("failed to list %s chains: %v", table, err)
+	}
+	for _, ch := range chains {
+		if ch == chain {
+			return nil
+		}
+	}
+	if err = ipt.NewChain(table, chain); err != nil {
+		return fmt.Errorf("failed to create %s chain %q: %v", table, chain, err)
+	}
+	return nil
+}
+
+// deleteChain flushes and deletes the chain, it's not an error if the chain doesn't exist
+func deleteChain(ipt *iptables.IPTables, table, chain string) error {
+	err := ipt.ClearChain(table, chain)
+	if err != nil && !isNotExist(err) {
+		return fmt.Errorf("failed to flush %s chain %q: %v", table, chain, err)
+	}
+	err = ipt.DeleteChain(table, chain)
+	if err != nil && !isNotExist(err) {
+		return fmt.Errorf("failed to delete %s chain %q: %v", table, chain, err)
+	}
+	return nil
+}
+
+func newIPTables(ipv4 bool) (*iptables.IPTables, error) {
+	proto := iptables.ProtocolIPv4
+	if !ipv4 {
+		proto = iptables.ProtocolIPv6
+	}
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	return ipt, nil
+}
+
+// isNotExist returns true if the error is from iptables indicating
+// that the target does not exist.
+func isNotExist(err error) bool {
+	e, ok := err.(*iptables.Error)
+	if !ok {
+		return false
+	}
+	return e.IsNotExist()
+}
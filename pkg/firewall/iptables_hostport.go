@@ -0,0 +1,135 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/coreos/go-iptables/iptables"
+
+	"github.com/morvencao/minicni/pkg/args"
+)
+
+const (
+	iptablesHostPortsChain     = "MINICNI-HOSTPORTS"
+	iptablesHostPortsMasqChain = "MINICNI-HOSTPORTS-MASQ"
+)
+
+// SetupPortMappings DNATs the traffic to the local host ports to the container, the rules of
+// the container live in its own chains which are jumped to from the hostports chains.
+func (f *iptablesFirewall) SetupPortMappings(containerID string, containerIP net.IP, mappings []args.PortMapping) error {
+	hostPorts, err := parsePortMappings(containerIP, mappings)
+	if err != nil {
+		return err
+	}
+	ipv4 := containerIP.To4() != nil
+	ipt, err := newIPTables(ipv4)
+	if err != nil {
+		return err
+	}
+	dnatChain := iptablesChainName("MINICNI-HP-", containerID)
+	masqChain := iptablesChainName("MINICNI-HPM-", containerID)
+	for _, chain := range []string{iptablesHostPortsChain, iptablesHostPortsMasqChain, dnatChain, masqChain} {
+		if err := ensureChain(ipt, "nat", chain); err != nil {
+			return err
+		}
+	}
+
+	// the traffic to the local addresses, including the localhost access, hits the hostports chain
+	for _, chain := range []string{"PREROUTING", "OUTPUT"} {
+		if err := ipt.AppendUnique("nat", chain, "-m", "addrtype", "--dst-type", "LOCAL",
+			"-m", "comment", "--comment", "minicni hostports", "-j", iptablesHostPortsChain); err != nil {
+			return fmt.Errorf("failed to jump to nat chain %q: %v", iptablesHostPortsChain, err)
+		}
+	}
+	// the masquerade rules go first so that they are not skipped by the accept rules of ipMasq
+	masqJump := []string{"-m", "comment", "--comment", "minicni hostports", "-j", iptablesHostPortsMasqChain}
+	exists, err := ipt.Exists("nat", "POSTROUTING", masqJump...)
+	if err != nil {
+		return fmt.Errorf("failed to check jump to nat chain %q: %v", iptablesHostPortsMasqChain, err)
+	}
+	if !exists {
+		if err := ipt.Insert("nat", "POSTROUTING", 1, masqJump...); err != nil {
+			return fmt.Errorf("failed to jump to nat chain %q: %v", iptablesHostPortsMasqChain, err)
+		}
+	}
+
+	// rebuild the rules of the container so that the setup is idempotent
+	for _, chain := range []string{dnatChain, masqChain} {
+		if err := ipt.ClearChain("nat", chain); err != nil {
+			return fmt.Errorf("failed to flush nat chain %q: %v", chain, err)
+		}
+	}
+	dst := containerIP.String()
+	if !ipv4 {
+		dst = "[" + dst + "]"
+	}
+	for _, hp := range hostPorts {
+		rule := []string{"-p", hp.protocol}
+		if hp.hostIP != nil {
+			rule = append(rule, "-d", hp.hostIP.String())
+		}
+		rule = append(rule, "--dport", strconv.Itoa(int(hp.hostPort)),
+			"-j", "DNAT", "--to-destination", dst+":"+strconv.Itoa(int(hp.containerPort)))
+		if err := ipt.Append("nat", dnatChain, rule...); err != nil {
+			return fmt.Errorf("failed to add DNAT rule for host port %d: %v", hp.hostPort, err)
+		}
+	}
+	// masquerade the hairpin traffic from the container to itself and the localhost access
+	sources := []string{containerIP.String()}
+	if ipv4 {
+		sources = append(sources, "127.0.0.0/8")
+	}
+	for _, src := range sources {
+		if err := ipt.Append("nat", masqChain, "-s", src, "-d", containerIP.String(), "-j", "MASQUERADE"); err != nil {
+			return fmt.Errorf("failed to add masquerade rule for %q: %v", src, err)
+		}
+	}
+
+	if err := ipt.AppendUnique("nat", iptablesHostPortsChain, containerJump(containerID, dnatChain)...); err != nil {
+		return fmt.Errorf("failed to jump to nat chain %q: %v", dnatChain, err)
+	}
+	if err := ipt.AppendUnique("nat", iptablesHostPortsMasqChain, containerJump(containerID, masqChain)...); err != nil {
+		return fmt.Errorf("failed to jump to nat chain %q: %v", masqChain, err)
+	}
+	return nil
+}
+
+// TeardownPortMappings undoes the effects of SetupPortMappings for both IP families
+func (f *iptablesFirewall) TeardownPortMappings(containerID string) error {
+	for _, ipv4 := range []bool{true, false} {
+		ipt, err := newIPTables(ipv4)
+		if err != nil {
+			if ipv4 {
+				return err
+			}
+			// nothing to clean up on the hosts without ip6tables
+			continue
+		}
+		if err := teardownPortMappings(ipt, containerID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func teardownPortMappings(ipt *iptables.IPTables, containerID string) error {
+	dnatChain := iptablesChainName("MINICNI-HP-", containerID)
+	masqChain := iptablesChainName("MINICNI-HPM-", containerID)
+	err := ipt.Delete("nat", iptablesHostPortsChain, containerJump(containerID, dnatChain)...)
+	if err != nil && !isNotExist(err) {
+		return fmt.Errorf("failed to delete jump to nat chain %q: %v", dnatChain, err)
+	}
+	err = ipt.Delete("nat", iptablesHostPortsMasqChain, containerJump(containerID, masqChain)...)
+	if err != nil && !isNotExist(err) {
+		return fmt.Errorf("failed to delete jump to nat chain %q: %v", masqChain, err)
+	}
+	if err := deleteChain(ipt, "nat", dnatChain); err != nil {
+		return err
+	}
+	return deleteChain(ipt, "nat", masqChain)
+}
+
+func containerJump(containerID, chain string) []string {
+	return []string{"-m", "comment", "--comment", hostPortComment(containerID), "-j", chain}
+}
@@ -0,0 +1,92 @@
+package firewall
+
+import (
+	"fmt"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	iptablesIsolationChain      = "MINICNI-ISOLATION"
+	iptablesIsolationInputChain = "MINICNI-ISOLATION-INPUT"
+)
+
+// SyncIsolation rebuilds the isolation chains of both IP families which are jumped to from FORWARD
+// and INPUT, the family without isolated networks is left alone if its binary is not available.
+func (f *iptablesFirewall) SyncIsolation(networks []IsolatedNetwork) error {
+	for _, ipv4 := range []bool{true, false} {
+		var family []IsolatedNetwork
+		for _, n := range networks {
+			if isIPv4(n.Subnet) == ipv4 {
+				family = append(family, n)
+			}
+		}
+		ipt, err := newIPTables(ipv4)
+		if err != nil {
+			if len(family) == 0 {
+				continue
+			}
+			return err
+		}
+		if err := syncIPTablesIsolation(ipt, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncIPTablesIsolation(ipt *iptables.IPTables, networks []IsolatedNetwork) error {
+	for _, c := range []struct{ base, chain string }{
+		{base: "FORWARD", chain: iptablesIsolationChain},
+		{base: "INPUT", chain: iptablesIsolationInputChain},
+	} {
+		jump := []string{"-m", "comment", "--comment", isolationComment, "-j", c.chain}
+		if len(networks) == 0 {
+			err := ipt.Delete("filter", c.base, jump...)
+			if err != nil && !isNotExist(err) {
+				return fmt.Errorf("failed to delete jump to filter chain %q: %v", c.chain, err)
+			}
+			if err := deleteChain(ipt, "filter", c.chain); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ensureChain(ipt, "filter", c.chain); err != nil {
+			return err
+		}
+		if err := ipt.ClearChain("filter", c.chain); err != nil {
+			return fmt.Errorf("failed to flush filter chain %q: %v", c.chain, err)
+		}
+		if err := ipt.AppendUnique("filter", c.base, jump...); err != nil {
+			return fmt.Errorf("failed to jump to filter chain %q: %v", c.chain, err)
+		}
+	}
+	for _, from := range networks {
+		for _, to := range networks {
+			if from.Bridge == to.Bridge {
+				continue
+			}
+			if err := ipt.Append("filter", iptablesIsolationChain, "-i", from.Bridge, "-o", to.Bridge, "-j", "DROP"); err != nil {
+				return fmt.Errorf("failed to isolate bridge %q from %q: %v", from.Bridge, to.Bridge, err)
+			}
+		}
+		if !from.IsolateHost {
+			continue
+		}
+		// the replies to the connections from the host are still allowed
+		rules := [][]string{{"-i", from.Bridge, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"}}
+		if !isIPv4(from.Subnet) {
+			// the pods resolve the gateway with the neighbor discovery
+			for _, icmpType := range []string{"router-solicitation", "router-advertisement", "neighbour-solicitation", "neighbour-advertisement"} {
+				rules = append(rules, []string{"-i", from.Bridge, "-p", "ipv6-icmp", "--icmpv6-type", icmpType, "-j", "RETURN"})
+			}
+		}
+		rules = append(rules, []string{"-i", from.Bridge, "-j", "DROP"})
+		for _, rule := range rules {
+			if err := ipt.Append("filter", iptablesIsolationInputChain, rule...); err != nil {
+				return fmt.Errorf("failed to isolate host from bridge %q: %v", from.Bridge, err)
+			}
+		}
+	}
+	return nil
+}
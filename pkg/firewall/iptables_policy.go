@@ -0,0 +1,173 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const iptablesPolicyChain = "MINICNI-POLICY"
+
+// BlockPod drops the traffic from and to the pod in its policy chains which are jumped to from the policy chain
+func (f *iptablesFirewall) BlockPod(podIP net.IP) error {
+	ipt, err := newIPTables(podIP.To4() != nil)
+	if err != nil {
+		return err
+	}
+	if err := ensurePolicyChain(ipt); err != nil {
+		return err
+	}
+	for _, ingress := range []bool{true, false} {
+		if err := setIPTablesPolicyChain(ipt, podIP, ingress, [][]string{{"-j", "DROP"}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncPodPolicies rebuilds the policy chains of the isolated directions of the pods and deletes the others
+func (f *iptablesFirewall) SyncPodPolicies(policies []PodPolicy) error {
+	for _, policy := range policies {
+		ipt, err := newIPTables(policy.IP.To4() != nil)
+		if err != nil {
+			return err
+		}
+		if err := ensurePolicyChain(ipt); err != nil {
+			return err
+		}
+		for _, dir := range []struct {
+			ingress  bool
+			isolated bool
+			rules    []PolicyRule
+		}{
+			{ingress: true, isolated: policy.IngressIsolated, rules: policy.Ingress},
+			{ingress: false, isolated: policy.EgressIsolated, rules: policy.Egress},
+		} {
+			if !dir.isolated {
+				if err := deleteIPTablesPolicyChain(ipt, policy.IP, dir.ingress); err != nil {
+					return err
+				}
+				continue
+			}
+			matches, err := expandPolicyRules(policy.IP, dir.rules)
+			if err != nil {
+				return fmt.Errorf("invalid policy of pod %q: %v", policy.IP, err)
+			}
+			// the allowed traffic returns rather than being accepted so that the policy of
+			// the peer on the same node still applies, the replies are allowed in both directions
+			rules := [][]string{{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"}}
+			for _, m := range matches {
+				rules = append(rules, append(policyMatchArgs(m, dir.ingress), "-j", "RETURN"))
+			}
+			rules = append(rules, []string{"-j", "DROP"})
+			if err := setIPTablesPolicyChain(ipt, policy.IP, dir.ingress, rules); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// TeardownPodPolicy undoes the effects of BlockPod and SyncPodPolicies
+func (f *iptablesFirewall) TeardownPodPolicy(podIP net.IP) error {
+	ipt, err := newIPTables(podIP.To4() != nil)
+	if err != nil {
+		return err
+	}
+	for _, ingress := range []bool{true, false} {
+		if err := deleteIPTablesPolicyChain(ipt, podIP, ingress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensurePolicyChain creates the policy chain and jumps to it first from the forward chain
+func ensurePolicyChain(ipt *iptables.IPTables) error {
+	if err := ensureChain(ipt, "filter", iptablesPolicyChain); err != nil {
+		return err
+	}
+	jump := []string{"-m", "comment", "--comment", "minicni policy", "-j", iptablesPolicyChain}
+	exists, err := ipt.Exists("filter", "FORWARD", jump...)
+	if err != nil {
+		return fmt.Errorf("failed to check jump to filter chain %q: %v", iptablesPolicyChain, err)
+	}
+	if exists {
+		return nil
+	}
+	if err := ipt.Insert("filter", "FORWARD", 1, jump...); err != nil {
+		return fmt.Errorf("failed to jump to filter chain %q: %v", iptablesPolicyChain, err)
+	}
+	return nil
+}
+
+// setIPTablesPolicyChain rebuilds the policy chain of the pod with the rules and jumps to it from the policy chain
+func setIPTablesPolicyChain(ipt *iptables.IPTables, podIP net.IP, ingress bool, rules [][]string) error {
+	chain := iptablesPolicyChainName(podIP, ingress)
+	if err := ensureChain(ipt, "filter", chain); err != nil {
+		return err
+	}
+	if err := ipt.ClearChain("filter", chain); err != nil {
+		return fmt.Errorf("failed to flush filter chain %q: %v", chain, err)
+	}
+	for _, rule := range rules {
+		if err := ipt.Append("filter", chain, rule...); err != nil {
+			return fmt.Errorf("failed to add policy rule to filter chain %q: %v", chain, err)
+		}
+	}
+	if err := ipt.AppendUnique("filter", iptablesPolicyChain, policyJump(podIP, ingress)...); err != nil {
+		return fmt.Errorf("failed to jump to filter chain %q: %v", chain, err)
+	}
+	return nil
+}
+
+// deleteIPTablesPolicyChain deletes the policy chain of the pod and the jump to it
+func deleteIPTablesPolicyChain(ipt *iptables.IPTables, podIP net.IP, ingress bool) error {
+	chain := iptablesPolicyChainName(podIP, ingress)
+	err := ipt.Delete("filter", iptablesPolicyChain, policyJump(podIP, ingress)...)
+	if err != nil && !isNotExist(err) {
+		return fmt.Errorf("failed to delete jump to filter chain %q: %v", chain, err)
+	}
+	return deleteChain(ipt, "filter", chain)
+}
+
+func iptablesPolicyChainName(podIP net.IP, ingress bool) string {
+	if ingress {
+		return iptablesChainName("MINICNI-PI-", podIP.String())
+	}
+	return iptablesChainName("MINICNI-PE-", podIP.String())
+}
+
+// policyJump returns the rule that sends the traffic to the pod to its ingress chain
+// and the traffic from the pod to its egress chain
+func policyJump(podIP net.IP, ingress bool) []string {
+	match := "-s"
+	if ingress {
+		match = "-d"
+	}
+	return []string{match, podIP.String(), "-m", "comment", "--comment", policyComment(podIP, ingress),
+		"-j", iptablesPolicyChainName(podIP, ingress)}
+}
+
+// policyMatchArgs returns the arguments that match the peer, the source of the ingress traffic
+// or the destination of the egress traffic, and the destination port.
+func policyMatchArgs(m policyMatch, ingress bool) []string {
+	var args []string
+	if m.peer != nil {
+		match := "-d"
+		if ingress {
+			match = "-s"
+		}
+		args = append(args, match, m.peer.String())
+	}
+	if m.protocol == "" {
+		return args
+	}
+	args = append(args, "-p", m.protocol)
+	if m.port == 0 {
+		return args
+	}
+	return append(args, "--dport", strconv.Itoa(int(m.port)))
+}
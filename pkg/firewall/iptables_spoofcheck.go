@@ -0,0 +1,83 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// SetupSpoofCheck filters the frames from the port with ebtables in its own nat chain which is jumped to from
+// PREROUTING, iptables only sees the bridged traffic through br_netfilter and doesn't see the ARP packets.
+func (f *iptablesFirewall) SetupSpoofCheck(hostVeth string, mac net.HardwareAddr, podIP net.IP) error {
+	chain := iptablesChainName("MINICNI-SPOOF-", hostVeth)
+	// the frames of the pod return from the chain and the others hit the drop policy
+	rules := [][]string{{"-s", "!", mac.String(), "-j", "DROP"}}
+	if podIP.To4() != nil {
+		rules = append(rules,
+			[]string{"-p", "IPv4", "--ip-src", podIP.String(), "-j", "RETURN"},
+			[]string{"-p", "ARP", "--arp-mac-src", mac.String(), "--arp-ip-src", podIP.String(), "-j", "RETURN"},
+		)
+	} else {
+		// the link-local address of the pod MAC and the unspecified source are needed by the neighbor discovery
+		for _, src := range []string{podIP.String(), linkLocalIP(mac).String(), "::"} {
+			rules = append(rules, []string{"-p", "IPv6", "--ip6-src", src, "-j", "RETURN"})
+		}
+	}
+
+	// rebuild the chain of the port so that the setup is idempotent
+	if !ebtablesChainExists(chain) {
+		if err := ebtables("-t", "nat", "-N", chain, "-P", "DROP"); err != nil {
+			return fmt.Errorf("failed to create ebtables chain %q: %v", chain, err)
+		}
+	}
+	if err := ebtables("-t", "nat", "-F", chain); err != nil {
+		return fmt.Errorf("failed to flush ebtables chain %q: %v", chain, err)
+	}
+	for _, rule := range rules {
+		if err := ebtables(append([]string{"-t", "nat", "-A", chain}, rule...)...); err != nil {
+			return fmt.Errorf("failed to add spoof check rule of port %q: %v", hostVeth, err)
+		}
+	}
+	jump := []string{"PREROUTING", "-i", hostVeth, "-j", chain}
+	if ebtables(append([]string{"-t", "nat", "-C"}, jump...)...) != nil {
+		if err := ebtables(append([]string{"-t", "nat", "-A"}, jump...)...); err != nil {
+			return fmt.Errorf("failed to jump to ebtables chain %q: %v", chain, err)
+		}
+	}
+	return nil
+}
+
+// TeardownSpoofCheck undoes the effects of SetupSpoofCheck
+func (f *iptablesFirewall) TeardownSpoofCheck(hostVeth string) error {
+	chain := iptablesChainName("MINICNI-SPOOF-", hostVeth)
+	if !ebtablesChainExists(chain) {
+		return nil
+	}
+	jump := []string{"PREROUTING", "-i", hostVeth, "-j", chain}
+	if ebtables(append([]string{"-t", "nat", "-C"}, jump...)...) == nil {
+		if err := ebtables(append([]string{"-t", "nat", "-D"}, jump...)...); err != nil {
+			return fmt.Errorf("failed to delete jump to ebtables chain %q: %v", chain, err)
+		}
+	}
+	if err := ebtables("-t", "nat", "-F", chain); err != nil {
+		return fmt.Errorf("failed to flush ebtables chain %q: %v", chain, err)
+	}
+	if err := ebtables("-t", "nat", "-X", chain); err != nil {
+		return fmt.Errorf("failed to delete ebtables chain %q: %v", chain, err)
+	}
+	return nil
+}
+
+func ebtablesChainExists(chain string) bool {
+	return ebtables("-t", "nat", "-L", chain) == nil
+}
+
+// ebtables runs the ebtables binary with the concurrent flag so that it waits for the lock
+func ebtables(args ...string) error {
+	out, err := exec.Command("ebtables", append([]string{"--concurrent"}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ebtables %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package firewall
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/google/nftables"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+func TestNFTablesIsolation(t *testing.T) {
+	if !nftablesAvailable() {
+		t.Skip("nftables is not available")
+	}
+	testns.Run(t, func() error {
+		if _, err := sysctl.Sysctl("net.ipv4.ip_forward", "1"); err != nil {
+			return err
+		}
+		hostNS, err := ns.GetCurrentNS()
+		if err != nil {
+			return err
+		}
+		defer hostNS.Close()
+		var pods []ns.NetNS
+		for i := 1; i <= 2; i++ {
+			br, err := nettool.CreateOrUpdateBridge(fmt.Sprintf("isotest%d", i), fmt.Sprintf("10.72.%d.1/24", i), 1500)
+			if err != nil {
+				return err
+			}
+			pod, _, err := newBridgePod(t, br, fmt.Sprintf("vethiso%d", i), fmt.Sprintf("10.72.%d.2/24", i), fmt.Sprintf("10.72.%d.1/24", i))
+			if err != nil {
+				return err
+			}
+			pods = append(pods, pod)
+		}
+		networks := []IsolatedNetwork{
+			{Name: "net1", Bridge: "isotest1", Subnet: mustParseCIDR(t, "10.72.1.0/24"), IsolateHost: true},
+			{Name: "net2", Bridge: "isotest2", Subnet: mustParseCIDR(t, "10.72.2.0/24")},
+			// the IPv6 network without pods checks that its rules are accepted
+			{Name: "net6", Bridge: "isotest6", Subnet: mustParseCIDR(t, "fd00:72::/64"), IsolateHost: true},
+		}
+		fw := newNFTablesFirewall().(*nftablesFirewall)
+
+		steps := []struct {
+			name     string
+			networks []IsolatedNetwork
+			// connections from the pod of net1 to the pod of net2, from the pod of net1 to the host,
+			// from the pod of net2 to the host and from the host to the pod of net1
+			want [4]bool
+		}{
+			{name: "no isolation", want: [4]bool{true, true, true, true}},
+			{name: "one isolated network", networks: networks[:1], want: [4]bool{true, false, true, true}},
+			{name: "both isolated", networks: networks, want: [4]bool{false, false, true, true}},
+			{name: "isolation removed", want: [4]bool{true, true, true, true}},
+		}
+		for _, step := range steps {
+			if err := fw.SyncIsolation(step.networks); err != nil {
+				return fmt.Errorf("%s: SyncIsolation error = %v", step.name, err)
+			}
+			for i, c := range []struct {
+				server   ns.NetNS
+				serverIP string
+				client   ns.NetNS
+			}{
+				{server: pods[1], serverIP: "10.72.2.2", client: pods[0]},
+				{server: hostNS, serverIP: "10.72.1.1", client: pods[0]},
+				{server: hostNS, serverIP: "10.72.2.1", client: pods[1]},
+				{server: pods[0], serverIP: "10.72.1.2", client: hostNS},
+			} {
+				got, err := canConnect(c.server, c.serverIP, 8080, c.client, "")
+				if err != nil {
+					return err
+				}
+				if got != step.want[i] {
+					t.Errorf("%s: connection to %s = %v, want %v", step.name, c.serverIP, got, step.want[i])
+				}
+			}
+		}
+		conn := &nftables.Conn{}
+		for _, chain := range []string{nftablesIsolationChain, nftablesIsolationInputChain} {
+			if exists, _ := fw.chainExists(conn, chain); exists {
+				t.Errorf("chain %s still exists without isolated networks", chain)
+			}
+		}
+		return nil
+	})
+}
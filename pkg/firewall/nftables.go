@@ -0,0 +1,312 @@
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// nftablesTableName is the name of the inet table that minicni owns
+	nftablesTableName = "minicni"
+	// nftablesCommentType is the userdata type nft uses to store rule comments
+	nftablesCommentType = 0
+)
+
+// nftablesFirewall programs the rules in the minicni inet table through nftables netlink API
+type nftablesFirewall struct {
+	table *nftables.Table
+}
+
+func newNFTablesFirewall() Firewall {
+	return &nftablesFirewall{
+		table: &nftables.Table{
+			Name:   nftablesTableName,
+			Family: nftables.TableFamilyINet,
+		},
+	}
+}
+
+// nftablesAvailable checks whether the kernel speaks nftables netlink API
+func nftablesAvailable() bool {
+	conn := &nftables.Conn{}
+	_, err := conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	return err == nil
+}
+
+func (f *nftablesFirewall) Backend() string {
+	return BackendNFTables
+}
+
+// SetupIPMasq masquerades the traffic coming from the pod subnet and leaving the node,
+// the rules live in a regular chain of the network which is jumped to from postrouting.
+func (f *nftablesFirewall) SetupIPMasq(network string, subnet *net.IPNet, excludes []*net.IPNet) error {
+	conn := &nftables.Conn{}
+	postrouting := f.ensureBaseChain(conn, "postrouting", nftables.ChainTypeNAT, nftables.ChainHookPostrouting, nftables.ChainPriorityNATSource)
+	chain := f.ensureChain(conn, "masq-"+network)
+	comment := ipMasqComment(network)
+
+	// rebuild the rules of the network chain so that the setup is idempotent
+	conn.FlushChain(chain)
+	// packets to the pod subnet and the cluster subnets should not be touched
+	for _, dst := range append([]*net.IPNet{subnet}, excludes...) {
+		if isIPv4(dst) != isIPv4(subnet) {
+			continue
+		}
+		conn.AddRule(&nftables.Rule{
+			Table:    f.table,
+			Chain:    chain,
+			Exprs:    append(matchIPNet(dst, false, expr.CmpOpEq), &expr.Verdict{Kind: expr.VerdictAccept}),
+			UserData: ruleComment(comment),
+		})
+	}
+	// don't masquerade multicast, pods should be able to talk to other pods
+	// on the local network via multicast.
+	conn.AddRule(&nftables.Rule{
+		Table:    f.table,
+		Chain:    chain,
+		Exprs:    append(matchIPNet(multicastNet(subnet), false, expr.CmpOpNeq), &expr.Masq{}),
+		UserData: ruleComment(comment),
+	})
+
+	// packets from the pod subnet will hit the chain
+	if err := f.ensureRule(conn, postrouting, comment,
+		append(matchIPNet(subnet, true, expr.CmpOpEq), &expr.Verdict{Kind: expr.VerdictJump, Chain: chain.Name})); err != nil {
+		return err
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to set up masquerade for network %q: %v", network, err)
+	}
+	return nil
+}
+
+// TeardownIPMasq undoes the effects of SetupIPMasq
+func (f *nftablesFirewall) TeardownIPMasq(network string, subnet *net.IPNet) error {
+	conn := &nftables.Conn{}
+	if err := f.deleteRules(conn, "postrouting", ipMasqComment(network)); err != nil {
+		return err
+	}
+	if err := f.deleteChain(conn, "masq-"+network); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to tear down masquerade for network %q: %v", network, err)
+	}
+	return nil
+}
+
+// ensureBaseChain queues the creation of the table and the base chain,
+// both creations are no-ops if they already exist.
+func (f *nftablesFirewall) ensureBaseChain(conn *nftables.Conn, name string, chainType nftables.ChainType,
+	hook nftables.ChainHook, priority nftables.ChainPriority) *nftables.Chain {
+	conn.AddTable(f.table)
+	return conn.AddChain(&nftables.Chain{
+		Name:     name,
+		Table:    f.table,
+		Type:     chainType,
+		Hooknum:  hook,
+		Priority: priority,
+	})
+}
+
+// ensureChain queues the creation of the table and the regular chain
+func (f *nftablesFirewall) ensureChain(conn *nftables.Conn, name string) *nftables.Chain {
+	conn.AddTable(f.table)
+	return conn.AddChain(&nftables.Chain{
+		Name:  name,
+		Table: f.table,
+	})
+}
+
+// ensureRule queues the rule unless the same rule with the comment is already in the chain, the stale rules
+// with the comment, e.g. those of an older config, are replaced in place.
+func (f *nftablesFirewall) ensureRule(conn *nftables.Conn, chain *nftables.Chain, comment string, exprs []expr.Any) error {
+	rules, err := f.listRules(conn, chain.Name)
+	if err != nil {
+		return err
+	}
+	var stale []*nftables.Rule
+	found := false
+	for _, r := range rules {
+		if !bytes.Equal(r.UserData, ruleComment(comment)) {
+			continue
+		}
+		if !found && f.sameExprs(r.Exprs, exprs) {
+			found = true
+			continue
+		}
+		stale = append(stale, r)
+	}
+	if !found {
+		rule := &nftables.Rule{
+			Table:    f.table,
+			Chain:    chain,
+			Exprs:    exprs,
+			UserData: ruleComment(comment),
+		}
+		// the rule takes the place of the first stale one
+		if len(stale) > 0 {
+			rule.Position = stale[0].Handle
+		}
+		conn.AddRule(rule)
+	}
+	for _, r := range stale {
+		if err := conn.DelRule(r); err != nil {
+			return fmt.Errorf("failed to delete stale rule from chain %q: %v", chain.Name, err)
+		}
+	}
+	return nil
+}
+
+// sameExprs returns true if the expressions are encoded the same way in the netlink messages
+func (f *nftablesFirewall) sameExprs(a, b []expr.Any) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, err := expr.Marshal(byte(f.table.Family), a[i])
+		if err != nil {
+			return false
+		}
+		y, err := expr.Marshal(byte(f.table.Family), b[i])
+		if err != nil || !bytes.Equal(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteRules queues the deletion of all the rules with the comment in the chain
+func (f *nftablesFirewall) deleteRules(conn *nftables.Conn, chainName, comment string) error {
+	rules, err := f.listRules(conn, chainName)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if !bytes.Equal(r.UserData, ruleComment(comment)) {
+			continue
+		}
+		if err := conn.DelRule(r); err != nil {
+			return fmt.Errorf("failed to delete rule from chain %q: %v", chainName, err)
+		}
+	}
+	return nil
+}
+
+// deleteChain queues the flush and deletion of the chain if it exists
+func (f *nftablesFirewall) deleteChain(conn *nftables.Conn, name string) error {
+	exists, err := f.chainExists(conn, name)
+	if err != nil || !exists {
+		return err
+	}
+	chain := &nftables.Chain{Name: name, Table: f.table}
+	conn.FlushChain(chain)
+	conn.DelChain(chain)
+	return nil
+}
+
+// listRules returns the rules of the chain, there are no rules if the chain doesn't exist
+func (f *nftablesFirewall) listRules(conn *nftables.Conn, chainName string) ([]*nftables.Rule, error) {
+	exists, err := f.chainExists(conn, chainName)
+	if err != nil || !exists {
+		return nil, err
+	}
+	rules, err := conn.GetRules(f.table, &nftables.Chain{Name: chainName, Table: f.table})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rules of chain %q: %v", chainName, err)
+	}
+	return rules, nil
+}
+
+func (f *nftablesFirewall) chainExists(conn *nftables.Conn, name string) (bool, error) {
+	chains, err := conn.ListChainsOfTableFamily(f.table.Family)
+	if err != nil {
+		return false, fmt.Errorf("failed to list nftables chains: %v", err)
+	}
+	for _, c := range chains {
+		if c.Table.Name == f.table.Name && c.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matchFamily returns the expressions that match the packets of the IP family
+func matchFamily(ipv4 bool) []expr.Any {
+	nfproto := byte(unix.NFPROTO_IPV4)
+	if !ipv4 {
+		nfproto = unix.NFPROTO_IPV6
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+	}
+}
+
+// matchIIFName returns the expressions that match the packets received on the interface
+func matchIIFName(name string) []expr.Any {
+	return matchIfName(expr.MetaKeyIIFNAME, name)
+}
+
+// matchOIFName returns the expressions that match the packets sent out of the interface
+func matchOIFName(name string) []expr.Any {
+	return matchIfName(expr.MetaKeyOIFNAME, name)
+}
+
+func matchIfName(key expr.MetaKey, name string) []expr.Any {
+	ifname := make([]byte, unix.IFNAMSIZ)
+	copy(ifname, name)
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname},
+	}
+}
+
+// matchIPNet returns the expressions that compare the source or destination address of
+// the packet with the subnet, the packets of the other IP family never match.
+func matchIPNet(ipn *net.IPNet, source bool, op expr.CmpOp) []expr.Any {
+	ip := ipn.IP.To4()
+	offset := uint32(16)
+	if source {
+		offset = 12
+	}
+	if ip == nil {
+		ip = ipn.IP.To16()
+		offset = 24
+		if source {
+			offset = 8
+		}
+	}
+	mask := net.IP(ipn.Mask)
+	return append(matchFamily(isIPv4(ipn)),
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          uint32(len(ip)),
+		},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            uint32(len(ip)),
+			Mask:           mask,
+			Xor:            make([]byte, len(ip)),
+		},
+		&expr.Cmp{Op: op, Register: 1, Data: ip.Mask(ipn.Mask)},
+	)
+}
+
+// ruleComment encodes the comment in the userdata format of nft so that it shows up in `nft list`
+func ruleComment(comment string) []byte {
+	if len(comment) > 254 {
+		comment = comment[:254]
+	}
+	data := []byte{nftablesCommentType, byte(len(comment) + 1)}
+	data = append(data, comment...)
+	return append(data, 0)
+}
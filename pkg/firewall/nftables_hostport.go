@@ -0,0 +1,144 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+
+	"github.com/morvencao/minicni/pkg/args"
+)
+
+const (
+	nftablesHostPortsChain  = "hostports"
+	nftablesHostPortComment = "minicni hostports"
+)
+
+// SetupPortMappings DNATs the traffic to the local host ports to the container, the rules of
+// the container live in its own chain which is jumped to from the hostports chain.
+func (f *nftablesFirewall) SetupPortMappings(containerID string, containerIP net.IP, mappings []args.PortMapping) error {
+	hostPorts, err := parsePortMappings(containerIP, mappings)
+	if err != nil {
+		return err
+	}
+	conn := &nftables.Conn{}
+	prerouting := f.ensureBaseChain(conn, "prerouting", nftables.ChainTypeNAT, nftables.ChainHookPrerouting, nftables.ChainPriorityNATDest)
+	output := f.ensureBaseChain(conn, "output", nftables.ChainTypeNAT, nftables.ChainHookOutput, nftables.ChainPriorityNATDest)
+	postrouting := f.ensureBaseChain(conn, "postrouting", nftables.ChainTypeNAT, nftables.ChainHookPostrouting, nftables.ChainPriorityNATSource)
+	hostports := f.ensureChain(conn, nftablesHostPortsChain)
+	chain := f.ensureChain(conn, hostPortChainName(containerID))
+	comment := hostPortComment(containerID)
+
+	// the traffic to the local addresses, including the localhost access, hits the hostports chain
+	toHostPorts := []expr.Any{
+		&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+		&expr.Verdict{Kind: expr.VerdictJump, Chain: hostports.Name},
+	}
+	for _, c := range []*nftables.Chain{prerouting, output} {
+		if err := f.ensureRule(conn, c, nftablesHostPortComment, toHostPorts); err != nil {
+			return err
+		}
+	}
+	if err := f.ensureRule(conn, hostports, comment, []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: chain.Name}}); err != nil {
+		return err
+	}
+
+	// rebuild the DNAT rules of the container so that the setup is idempotent
+	conn.FlushChain(chain)
+	for _, hp := range hostPorts {
+		conn.AddRule(&nftables.Rule{
+			Table:    f.table,
+			Chain:    chain,
+			Exprs:    dnatExprs(hp, containerIP),
+			UserData: ruleComment(comment),
+		})
+	}
+
+	// masquerade the hairpin traffic from the container to itself and the localhost access,
+	// the rules go first so that they are not skipped by the accept rules of ipMasq.
+	if err := f.deleteRules(conn, postrouting.Name, comment); err != nil {
+		return err
+	}
+	containerIPNet := hostIPNet(containerIP)
+	sources := []*net.IPNet{containerIPNet}
+	if isIPv4(containerIPNet) {
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		sources = append(sources, loopback)
+	}
+	for _, src := range sources {
+		exprs := append(matchIPNet(src, true, expr.CmpOpEq), matchIPNet(containerIPNet, false, expr.CmpOpEq)...)
+		conn.InsertRule(&nftables.Rule{
+			Table:    f.table,
+			Chain:    postrouting,
+			Exprs:    append(exprs, &expr.Masq{}),
+			UserData: ruleComment(comment),
+		})
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to set up host ports for container %q: %v", containerID, err)
+	}
+	return nil
+}
+
+// TeardownPortMappings undoes the effects of SetupPortMappings
+func (f *nftablesFirewall) TeardownPortMappings(containerID string) error {
+	conn := &nftables.Conn{}
+	comment := hostPortComment(containerID)
+	if err := f.deleteRules(conn, nftablesHostPortsChain, comment); err != nil {
+		return err
+	}
+	if err := f.deleteRules(conn, "postrouting", comment); err != nil {
+		return err
+	}
+	if err := f.deleteChain(conn, hostPortChainName(containerID)); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to tear down host ports for container %q: %v", containerID, err)
+	}
+	return nil
+}
+
+func hostPortChainName(containerID string) string {
+	return "hostport-" + containerID
+}
+
+// dnatExprs returns the expressions that DNAT the host port to the container port
+func dnatExprs(hp hostPort, containerIP net.IP) []expr.Any {
+	var exprs []expr.Any
+	nfproto := uint32(unix.NFPROTO_IPV4)
+	ip := containerIP.To4()
+	if ip == nil {
+		nfproto = unix.NFPROTO_IPV6
+		ip = containerIP.To16()
+	}
+	if hp.hostIP != nil {
+		exprs = matchIPNet(hostIPNet(hp.hostIP), false, expr.CmpOpEq)
+	} else {
+		exprs = matchFamily(nfproto == unix.NFPROTO_IPV4)
+	}
+	return append(exprs,
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{hp.protoNum}},
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2,
+			Len:          2,
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(hp.hostPort)},
+		&expr.Immediate{Register: 1, Data: ip},
+		&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(hp.containerPort)},
+		&expr.NAT{
+			Type:        expr.NATTypeDestNAT,
+			Family:      nfproto,
+			RegAddrMin:  1,
+			RegProtoMin: 2,
+		},
+	)
+}
@@ -0,0 +1,109 @@
+package firewall
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	nftablesInputChain          = "input"
+	nftablesIsolationChain      = "isolation"
+	nftablesIsolationInputChain = "isolation-input"
+
+	// the ICMPv6 types of the neighbor discovery from the router solicitation to the neighbor advertisement
+	icmpv6RouterSolicitation    = 133
+	icmpv6NeighborAdvertisement = 136
+)
+
+// SyncIsolation rebuilds the isolation chains which are jumped to from the forward and input chains,
+// the traffic between every pair of the isolated bridges is dropped.
+func (f *nftablesFirewall) SyncIsolation(networks []IsolatedNetwork) error {
+	conn := &nftables.Conn{}
+	if len(networks) == 0 {
+		for _, c := range []struct{ base, chain string }{
+			{base: nftablesForwardChain, chain: nftablesIsolationChain},
+			{base: nftablesInputChain, chain: nftablesIsolationInputChain},
+		} {
+			if err := f.deleteRules(conn, c.base, isolationComment); err != nil {
+				return err
+			}
+			if err := f.deleteChain(conn, c.chain); err != nil {
+				return err
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return fmt.Errorf("failed to tear down isolation: %v", err)
+		}
+		return nil
+	}
+
+	forward := f.ensureBaseChain(conn, nftablesForwardChain, nftables.ChainTypeFilter, nftables.ChainHookForward, nftables.ChainPriorityFilter)
+	input := f.ensureBaseChain(conn, nftablesInputChain, nftables.ChainTypeFilter, nftables.ChainHookInput, nftables.ChainPriorityFilter)
+	chain := f.ensureChain(conn, nftablesIsolationChain)
+	inputChain := f.ensureChain(conn, nftablesIsolationInputChain)
+	conn.FlushChain(chain)
+	conn.FlushChain(inputChain)
+	for _, from := range networks {
+		for _, to := range networks {
+			if from.Bridge == to.Bridge {
+				continue
+			}
+			conn.AddRule(&nftables.Rule{
+				Table: f.table,
+				Chain: chain,
+				Exprs: append(append(matchIIFName(from.Bridge), matchOIFName(to.Bridge)...),
+					&expr.Verdict{Kind: expr.VerdictDrop}),
+				UserData: ruleComment(isolationComment),
+			})
+		}
+		if !from.IsolateHost {
+			continue
+		}
+		// the replies to the connections from the host are still allowed
+		rules := [][]expr.Any{
+			append(append(matchIIFName(from.Bridge), matchCtState(expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED)...),
+				&expr.Verdict{Kind: expr.VerdictReturn}),
+		}
+		if !isIPv4(from.Subnet) {
+			// the pods resolve the gateway with the neighbor discovery
+			rules = append(rules, append(append(matchIIFName(from.Bridge), matchNDP()...), &expr.Verdict{Kind: expr.VerdictReturn}))
+		}
+		rules = append(rules, append(matchIIFName(from.Bridge), &expr.Verdict{Kind: expr.VerdictDrop}))
+		for _, exprs := range rules {
+			conn.AddRule(&nftables.Rule{
+				Table:    f.table,
+				Chain:    inputChain,
+				Exprs:    exprs,
+				UserData: ruleComment(isolationComment),
+			})
+		}
+	}
+	if err := f.ensureRule(conn, forward, isolationComment, []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: chain.Name}}); err != nil {
+		return err
+	}
+	if err := f.ensureRule(conn, input, isolationComment, []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: inputChain.Name}}); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to sync isolation: %v", err)
+	}
+	return nil
+}
+
+// matchNDP returns the expressions that match the ICMPv6 router and neighbor solicitations and advertisements
+func matchNDP() []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMPV6}},
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       0,
+			Len:          1,
+		},
+		&expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: []byte{icmpv6RouterSolicitation}, ToData: []byte{icmpv6NeighborAdvertisement}},
+	}
+}
@@ -0,0 +1,159 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+const nftablesForwardChain = "forward"
+
+// BlockPod drops the traffic from and to the pod in its policy chains which are jumped to from the forward chain
+func (f *nftablesFirewall) BlockPod(podIP net.IP) error {
+	conn := &nftables.Conn{}
+	forward := f.ensureBaseChain(conn, nftablesForwardChain, nftables.ChainTypeFilter, nftables.ChainHookForward, nftables.ChainPriorityFilter)
+	drop := [][]expr.Any{{&expr.Verdict{Kind: expr.VerdictDrop}}}
+	for _, ingress := range []bool{true, false} {
+		if err := f.setPolicyChain(conn, forward, podIP, ingress, drop); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to block pod %q: %v", podIP, err)
+	}
+	return nil
+}
+
+// SyncPodPolicies rebuilds the policy chains of the isolated directions of the pods and deletes the others
+func (f *nftablesFirewall) SyncPodPolicies(policies []PodPolicy) error {
+	conn := &nftables.Conn{}
+	forward := f.ensureBaseChain(conn, nftablesForwardChain, nftables.ChainTypeFilter, nftables.ChainHookForward, nftables.ChainPriorityFilter)
+	for _, policy := range policies {
+		for _, dir := range []struct {
+			ingress  bool
+			isolated bool
+			rules    []PolicyRule
+		}{
+			{ingress: true, isolated: policy.IngressIsolated, rules: policy.Ingress},
+			{ingress: false, isolated: policy.EgressIsolated, rules: policy.Egress},
+		} {
+			if !dir.isolated {
+				if err := f.deletePolicyChain(conn, policy.IP, dir.ingress); err != nil {
+					return err
+				}
+				continue
+			}
+			matches, err := expandPolicyRules(policy.IP, dir.rules)
+			if err != nil {
+				return fmt.Errorf("invalid policy of pod %q: %v", policy.IP, err)
+			}
+			// the allowed traffic returns rather than being accepted so that the policy of
+			// the peer on the same node still applies, the replies are allowed in both directions
+			rules := [][]expr.Any{append(matchCtState(expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED), &expr.Verdict{Kind: expr.VerdictReturn})}
+			for _, m := range matches {
+				rules = append(rules, append(policyMatchExprs(m, dir.ingress), &expr.Verdict{Kind: expr.VerdictReturn}))
+			}
+			rules = append(rules, []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}})
+			if err := f.setPolicyChain(conn, forward, policy.IP, dir.ingress, rules); err != nil {
+				return err
+			}
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to sync pod policies: %v", err)
+	}
+	return nil
+}
+
+// TeardownPodPolicy undoes the effects of BlockPod and SyncPodPolicies
+func (f *nftablesFirewall) TeardownPodPolicy(podIP net.IP) error {
+	conn := &nftables.Conn{}
+	for _, ingress := range []bool{true, false} {
+		if err := f.deletePolicyChain(conn, podIP, ingress); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to tear down policy of pod %q: %v", podIP, err)
+	}
+	return nil
+}
+
+// setPolicyChain queues the rebuild of the policy chain of the pod and the jump to it from the forward chain
+func (f *nftablesFirewall) setPolicyChain(conn *nftables.Conn, forward *nftables.Chain, podIP net.IP, ingress bool, rules [][]expr.Any) error {
+	comment := policyComment(podIP, ingress)
+	chain := f.ensureChain(conn, policyChainName(podIP, ingress))
+	conn.FlushChain(chain)
+	for _, exprs := range rules {
+		conn.AddRule(&nftables.Rule{
+			Table:    f.table,
+			Chain:    chain,
+			Exprs:    exprs,
+			UserData: ruleComment(comment),
+		})
+	}
+	// the traffic to the pod is checked against its ingress rules and the traffic from it against the egress ones
+	jump := append(matchIPNet(hostIPNet(podIP), !ingress, expr.CmpOpEq), &expr.Verdict{Kind: expr.VerdictJump, Chain: chain.Name})
+	return f.ensureRule(conn, forward, comment, jump)
+}
+
+// deletePolicyChain queues the deletion of the policy chain of the pod and the jump to it
+func (f *nftablesFirewall) deletePolicyChain(conn *nftables.Conn, podIP net.IP, ingress bool) error {
+	if err := f.deleteRules(conn, nftablesForwardChain, policyComment(podIP, ingress)); err != nil {
+		return err
+	}
+	return f.deleteChain(conn, policyChainName(podIP, ingress))
+}
+
+func policyChainName(podIP net.IP, ingress bool) string {
+	if ingress {
+		return "policy-in-" + podIP.String()
+	}
+	return "policy-out-" + podIP.String()
+}
+
+// policyMatchExprs returns the expressions that match the peer, the source of the ingress traffic
+// or the destination of the egress traffic, and the destination port.
+func policyMatchExprs(m policyMatch, ingress bool) []expr.Any {
+	var exprs []expr.Any
+	if m.peer != nil {
+		exprs = matchIPNet(m.peer, ingress, expr.CmpOpEq)
+	}
+	if m.protocol == "" {
+		return exprs
+	}
+	exprs = append(exprs,
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{m.protoNum}},
+	)
+	if m.port == 0 {
+		return exprs
+	}
+	return append(exprs,
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2,
+			Len:          2,
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(m.port)},
+	)
+}
+
+// matchCtState returns the expressions that match the packets in any of the conntrack states
+func matchCtState(states uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(states),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
@@ -0,0 +1,139 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	nftablesSpoofCheckBaseChain = "prerouting"
+	// nftablesBridgeFilterPriority is the filter priority of the bridge family
+	nftablesBridgeFilterPriority nftables.ChainPriority = -200
+)
+
+// bridgeFirewall returns the firewall of the minicni bridge table, the frames between
+// the ports of the bridge only go through the hooks of the bridge family.
+func (f *nftablesFirewall) bridgeFirewall() *nftablesFirewall {
+	return &nftablesFirewall{
+		table: &nftables.Table{
+			Name:   nftablesTableName,
+			Family: nftables.TableFamilyBridge,
+		},
+	}
+}
+
+// SetupSpoofCheck filters the frames from the port in its own chain which is jumped to from the bridge prerouting chain
+func (f *nftablesFirewall) SetupSpoofCheck(hostVeth string, mac net.HardwareAddr, podIP net.IP) error {
+	b := f.bridgeFirewall()
+	conn := &nftables.Conn{}
+	prerouting := b.ensureBaseChain(conn, nftablesSpoofCheckBaseChain, nftables.ChainTypeFilter, nftables.ChainHookPrerouting, nftablesBridgeFilterPriority)
+	chain := b.ensureChain(conn, spoofCheckChainName(hostVeth))
+	comment := spoofCheckComment(hostVeth)
+
+	// the frames of the pod return from the chain and all the others are dropped
+	rules := [][]expr.Any{
+		append(matchPayload(expr.PayloadBaseLLHeader, 6, mac, expr.CmpOpNeq), &expr.Verdict{Kind: expr.VerdictDrop}),
+	}
+	if ip4 := podIP.To4(); ip4 != nil {
+		rules = append(rules,
+			append(append(matchEtherType(unix.ETH_P_IP), matchPayload(expr.PayloadBaseNetworkHeader, 12, ip4, expr.CmpOpEq)...),
+				&expr.Verdict{Kind: expr.VerdictReturn}),
+			// both the ARP requests and replies carry the sender addresses that the neighbors learn
+			append(append(append(matchEtherType(unix.ETH_P_ARP),
+				matchPayload(expr.PayloadBaseNetworkHeader, 8, mac, expr.CmpOpEq)...),
+				matchPayload(expr.PayloadBaseNetworkHeader, 14, ip4, expr.CmpOpEq)...),
+				&expr.Verdict{Kind: expr.VerdictReturn}),
+		)
+	} else {
+		// the link-local address of the pod MAC and the unspecified source are needed by the neighbor discovery
+		for _, src := range []*net.IPNet{hostIPNet(podIP), hostIPNet(linkLocalIP(mac)), hostIPNet(net.IPv6unspecified)} {
+			rules = append(rules, append(append(matchEtherType(unix.ETH_P_IPV6), matchNetworkSource6(src)...),
+				&expr.Verdict{Kind: expr.VerdictReturn}))
+		}
+	}
+	rules = append(rules, []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}})
+
+	// rebuild the rules of the port so that the setup is idempotent
+	conn.FlushChain(chain)
+	for _, exprs := range rules {
+		conn.AddRule(&nftables.Rule{
+			Table:    b.table,
+			Chain:    chain,
+			Exprs:    exprs,
+			UserData: ruleComment(comment),
+		})
+	}
+	jump := append(matchIIFName(hostVeth), &expr.Verdict{Kind: expr.VerdictJump, Chain: chain.Name})
+	if err := b.ensureRule(conn, prerouting, comment, jump); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to set up spoof check of port %q: %v", hostVeth, err)
+	}
+	return nil
+}
+
+// TeardownSpoofCheck undoes the effects of SetupSpoofCheck
+func (f *nftablesFirewall) TeardownSpoofCheck(hostVeth string) error {
+	b := f.bridgeFirewall()
+	conn := &nftables.Conn{}
+	if err := b.deleteRules(conn, nftablesSpoofCheckBaseChain, spoofCheckComment(hostVeth)); err != nil {
+		return err
+	}
+	if err := b.deleteChain(conn, spoofCheckChainName(hostVeth)); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to tear down spoof check of port %q: %v", hostVeth, err)
+	}
+	return nil
+}
+
+func spoofCheckChainName(hostVeth string) string {
+	return "spoofcheck-" + hostVeth
+}
+
+// matchEtherType returns the expressions that match the frames of the ethernet type
+func matchEtherType(etherType uint16) []expr.Any {
+	return matchPayload(expr.PayloadBaseLLHeader, 12, binaryutil.BigEndian.PutUint16(etherType), expr.CmpOpEq)
+}
+
+// matchPayload returns the expressions that compare the bytes at the offset of the header with the data
+func matchPayload(base expr.PayloadBase, offset uint32, data []byte, op expr.CmpOp) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         base,
+			Offset:       offset,
+			Len:          uint32(len(data)),
+		},
+		&expr.Cmp{Op: op, Register: 1, Data: data},
+	}
+}
+
+// matchNetworkSource6 returns the expressions that match the IPv6 packets from the subnet,
+// the network family of the packet is not checked as it's unknown in the bridge family.
+func matchNetworkSource6(ipn *net.IPNet) []expr.Any {
+	ip := ipn.IP.To16()
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       8,
+			Len:          net.IPv6len,
+		},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            net.IPv6len,
+			Mask:           net.IP(ipn.Mask),
+			Xor:            make([]byte, net.IPv6len),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.Mask(ipn.Mask)},
+	}
+}
@@ -0,0 +1,212 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/google/nftables"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+func TestExpandPolicyRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		podIP   string
+		rules   []PolicyRule
+		want    int
+		wantErr bool
+	}{
+		{
+			name:  "no peers and no ports match everything",
+			podIP: "10.244.1.2",
+			rules: []PolicyRule{{}},
+			want:  1,
+		},
+		{
+			name:  "peers times ports",
+			podIP: "10.244.1.2",
+			rules: []PolicyRule{{
+				Peers: []*net.IPNet{mustParseCIDR(t, "10.244.2.0/24"), mustParseCIDR(t, "10.244.3.0/24")},
+				Ports: []PolicyPort{{Port: 80}, {Protocol: "UDP", Port: 53}},
+			}},
+			want: 4,
+		},
+		{
+			name:  "peers of the other family match nothing",
+			podIP: "10.244.1.2",
+			rules: []PolicyRule{{Peers: []*net.IPNet{mustParseCIDR(t, "fd00::/64")}}},
+			want:  0,
+		},
+		{
+			name:    "unsupported protocol",
+			podIP:   "10.244.1.2",
+			rules:   []PolicyRule{{Ports: []PolicyPort{{Protocol: "icmp"}}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matches, err := expandPolicyRules(net.ParseIP(tt.podIP), tt.rules)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandPolicyRules error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(matches) != tt.want {
+				t.Errorf("wanted %d matches, got %v", tt.want, matches)
+			}
+		})
+	}
+}
+
+// newPTPPod creates the pod netns routed through the current netns
+func newPTPPod(t *testing.T, ip string) (ns.NetNS, error) {
+	podNS, err := testns.New(t)
+	if err != nil {
+		return nil, err
+	}
+	ipaddr, _, _ := net.ParseCIDR(ip)
+	mac, err := nettool.MACFromIP(ipaddr)
+	if err != nil {
+		return nil, err
+	}
+	return podNS, nettool.SetupPTP(podNS, "eth0", nettool.HostVethName("veth", ip, "eth0"), ip, mac, 1500, true)
+}
+
+// canConnect returns true if the client netns can open the TCP connection to the port of the server IP,
+// the connection is opened from the client IP unless it's empty.
+func canConnect(server ns.NetNS, serverIP string, port int, client ns.NetNS, clientIP string) (bool, error) {
+	var l net.Listener
+	err := server.Do(func(ns.NetNS) error {
+		var err error
+		l, err = net.Listen("tcp", net.JoinHostPort(serverIP, fmt.Sprint(port)))
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to listen on %q: %v", serverIP, err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	dialer := net.Dialer{Timeout: 500 * time.Millisecond}
+	if clientIP != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(clientIP)}
+	}
+	connected := false
+	err = client.Do(func(ns.NetNS) error {
+		conn, err := dialer.Dial("tcp", l.Addr().String())
+		if err == nil {
+			connected = true
+			return conn.Close()
+		}
+		return nil
+	})
+	return connected, err
+}
+
+func TestNFTablesPodPolicy(t *testing.T) {
+	clientIP, serverIP := net.ParseIP("10.70.0.2"), net.ParseIP("10.70.0.3")
+
+	if !nftablesAvailable() {
+		t.Skip("nftables is not available")
+	}
+	testns.Run(t, func() error {
+		if _, err := sysctl.Sysctl("net.ipv4.ip_forward", "1"); err != nil {
+			return err
+		}
+		client, err := newPTPPod(t, "10.70.0.2/24")
+		if err != nil {
+			return err
+		}
+		server, err := newPTPPod(t, "10.70.0.3/24")
+		if err != nil {
+			return err
+		}
+		fw := newNFTablesFirewall().(*nftablesFirewall)
+		conn := &nftables.Conn{}
+
+		steps := []struct {
+			name   string
+			apply  func() error
+			chains int
+			want   map[int]bool
+		}{
+			{
+				name:   "blocked until the policy is synced",
+				apply:  func() error { return fw.BlockPod(serverIP) },
+				chains: 2,
+				want:   map[int]bool{8080: false},
+			},
+			{
+				name: "ingress allowed from the client on one port",
+				apply: func() error {
+					return fw.SyncPodPolicies([]PodPolicy{{
+						IP:              serverIP,
+						IngressIsolated: true,
+						Ingress: []PolicyRule{{
+							Peers: []*net.IPNet{hostIPNet(clientIP)},
+							Ports: []PolicyPort{{Protocol: "TCP", Port: 8080}},
+						}},
+					}})
+				},
+				chains: 1,
+				want:   map[int]bool{8080: true, 8081: false},
+			},
+			{
+				name:   "egress of the client isolated with no rules",
+				apply:  func() error { return fw.SyncPodPolicies([]PodPolicy{{IP: clientIP, EgressIsolated: true}}) },
+				chains: 2,
+				want:   map[int]bool{8080: false},
+			},
+			{
+				name: "no isolation",
+				apply: func() error {
+					return fw.SyncPodPolicies([]PodPolicy{{IP: clientIP}, {IP: serverIP}})
+				},
+				chains: 0,
+				want:   map[int]bool{8080: true, 8081: true},
+			},
+		}
+		for _, step := range steps {
+			if err := step.apply(); err != nil {
+				return fmt.Errorf("%s: %v", step.name, err)
+			}
+			rules, err := fw.listRules(conn, nftablesForwardChain)
+			if err != nil {
+				return err
+			}
+			if len(rules) != step.chains {
+				t.Errorf("%s: wanted %d jumps in forward, got %d", step.name, step.chains, len(rules))
+			}
+			for port, want := range step.want {
+				got, err := canConnect(server, serverIP.String(), port, client, "")
+				if err != nil {
+					return err
+				}
+				if got != want {
+					t.Errorf("%s: connection to port %d = %v, want %v", step.name, port, got, want)
+				}
+			}
+		}
+
+		if err := fw.BlockPod(serverIP); err != nil {
+			return err
+		}
+		if err := fw.TeardownPodPolicy(serverIP); err != nil {
+			return err
+		}
+		for _, ingress := range []bool{true, false} {
+			if exists, _ := fw.chainExists(conn, policyChainName(serverIP, ingress)); exists {
+				t.Errorf("chain %s still exists after teardown", policyChainName(serverIP, ingress))
+			}
+		}
+		return nil
+	})
+}
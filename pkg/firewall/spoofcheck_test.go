@@ -0,0 +1,142 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+// newBridgePod creates the pod netns attached to the bridge in the current netns
+func newBridgePod(t *testing.T, br *netlink.Bridge, hostVeth, ip, gw string) (ns.NetNS, net.HardwareAddr, error) {
+	podNS, err := testns.New(t)
+	if err != nil {
+		return nil, nil, err
+	}
+	ipaddr, _, _ := net.ParseCIDR(ip)
+	mac, err := nettool.MACFromIP(ipaddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := nettool.SetupVeth(podNS, br, "eth0", hostVeth, ip, gw, mac, 1500, true); err != nil {
+		return nil, nil, err
+	}
+	return podNS, mac, nettool.WaitBridgePortForwarding(hostVeth, 5*time.Second)
+}
+
+func TestLinkLocalIP(t *testing.T) {
+	tests := []struct {
+		mac  string
+		want string
+	}{
+		{mac: "0a:58:0a:47:00:02", want: "fe80::858:aff:fe47:2"},
+		{mac: "02:00:00:00:00:01", want: "fe80::ff:fe00:1"},
+		{mac: "00:16:3e:12:34:56", want: "fe80::216:3eff:fe12:3456"},
+	}
+	for _, tt := range tests {
+		mac, err := net.ParseMAC(tt.mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := linkLocalIP(mac); got.String() != tt.want {
+			t.Errorf("linkLocalIP(%s) = %s, want %s", tt.mac, got, tt.want)
+		}
+	}
+}
+
+func TestNFTablesSpoofCheck(t *testing.T) {
+	if !nftablesAvailable() {
+		t.Skip("nftables is not available")
+	}
+	testns.Run(t, func() error {
+		br, err := nettool.CreateOrUpdateBridge("spooftest0", "10.71.0.1/24", 1500)
+		if err != nil {
+			return err
+		}
+		client, clientMAC, err := newBridgePod(t, br, "vethclient", "10.71.0.2/24", "10.71.0.1/24")
+		if err != nil {
+			return err
+		}
+		server, _, err := newBridgePod(t, br, "vethserver", "10.71.0.3/24", "10.71.0.1/24")
+		if err != nil {
+			return err
+		}
+		// the client takes another address of the subnet as well
+		err = client.Do(func(ns.NetNS) error {
+			link, err := netlink.LinkByName("eth0")
+			if err != nil {
+				return err
+			}
+			addr, _ := netlink.ParseAddr("10.71.0.9/24")
+			return netlink.AddrAdd(link, addr)
+		})
+		if err != nil {
+			return err
+		}
+		fw := newNFTablesFirewall().(*nftablesFirewall)
+		for i := 0; i < 2; i++ {
+			if err := fw.SetupSpoofCheck("vethclient", clientMAC, net.ParseIP("10.71.0.2")); err != nil {
+				return fmt.Errorf("SetupSpoofCheck error = %v", err)
+			}
+		}
+		conn := &nftables.Conn{}
+		if rules, err := fw.bridgeFirewall().listRules(conn, nftablesSpoofCheckBaseChain); err != nil || len(rules) != 1 {
+			t.Errorf("wanted 1 jump in the bridge prerouting chain, got %d (%v)", len(rules), err)
+		}
+
+		for _, tt := range []struct {
+			source string
+			want   bool
+		}{
+			{source: "10.71.0.2", want: true},
+			{source: "10.71.0.9", want: false},
+		} {
+			got, err := canConnect(server, "10.71.0.3", 8080, client, tt.source)
+			if err != nil {
+				return err
+			}
+			if got != tt.want {
+				t.Errorf("connection from %s = %v, want %v", tt.source, got, tt.want)
+			}
+		}
+
+		if err := fw.TeardownSpoofCheck("vethclient"); err != nil {
+			return fmt.Errorf("TeardownSpoofCheck error = %v", err)
+		}
+		if got, err := canConnect(server, "10.71.0.3", 8080, client, "10.71.0.9"); err != nil || !got {
+			t.Errorf("connection from 10.71.0.9 after teardown = %v (%v), want true", got, err)
+		}
+
+		// the client changes its MAC while the spoof check is in place
+		if err := fw.SetupSpoofCheck("vethclient", clientMAC, net.ParseIP("10.71.0.2")); err != nil {
+			return fmt.Errorf("SetupSpoofCheck error = %v", err)
+		}
+		err = client.Do(func(ns.NetNS) error {
+			link, err := netlink.LinkByName("eth0")
+			if err != nil {
+				return err
+			}
+			return netlink.LinkSetHardwareAddr(link, net.HardwareAddr{0x0a, 0x58, 0x0a, 0x47, 0x00, 0x63})
+		})
+		if err != nil {
+			return err
+		}
+		if got, err := canConnect(server, "10.71.0.3", 8080, client, "10.71.0.2"); err != nil || got {
+			t.Errorf("connection with spoofed MAC = %v (%v), want false", got, err)
+		}
+		if err := fw.TeardownSpoofCheck("vethclient"); err != nil {
+			return fmt.Errorf("TeardownSpoofCheck error = %v", err)
+		}
+		if exists, _ := fw.bridgeFirewall().chainExists(conn, spoofCheckChainName("vethclient")); exists {
+			t.Errorf("chain %s still exists after teardown", spoofCheckChainName("vethclient"))
+		}
+		return nil
+	})
+}
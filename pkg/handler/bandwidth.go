@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/morvencao/minicni/pkg/args"
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+const (
+	// IngressBandwidthAnnotation is the pod annotation passed in CNI_ARGS that limits the traffic to the pod
+	IngressBandwidthAnnotation = "kubernetes.io/ingress-bandwidth"
+	// EgressBandwidthAnnotation is the pod annotation passed in CNI_ARGS that limits the traffic from the pod
+	EgressBandwidthAnnotation = "kubernetes.io/egress-bandwidth"
+
+	// defaultBurst is the burst in bits for the rates from annotations, the same as kubelet sets
+	defaultBurst = math.MaxInt32
+)
+
+var quantitySuffixes = map[string]float64{
+	"k":  1e3,
+	"K":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+}
+
+// getBandwidth returns the bandwidth limits of the pod, the bandwidth capability takes precedence
+// over the pod annotations, nil is returned if there are no limits.
+func getBandwidth(cniConfig *args.CNIConfiguration, cniArgs map[string]string) (*args.Bandwidth, error) {
+	bw := &args.Bandwidth{}
+	if cniConfig.RuntimeConfig.Bandwidth != nil {
+		*bw = *cniConfig.RuntimeConfig.Bandwidth
+	}
+	if bw.IngressRate == 0 && cniArgs[IngressBandwidthAnnotation] != "" {
+		rate, err := parseBandwidthQuantity(cniArgs[IngressBandwidthAnnotation])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", IngressBandwidthAnnotation, err)
+		}
+		bw.IngressRate, bw.IngressBurst = rate, defaultBurst
+	}
+	if bw.EgressRate == 0 && cniArgs[EgressBandwidthAnnotation] != "" {
+		rate, err := parseBandwidthQuantity(cniArgs[EgressBandwidthAnnotation])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", EgressBandwidthAnnotation, err)
+		}
+		bw.EgressRate, bw.EgressBurst = rate, defaultBurst
+	}
+
+	if err := validateRateAndBurst(bw.IngressRate, bw.IngressBurst); err != nil {
+		return nil, fmt.Errorf("invalid ingress bandwidth: %v", err)
+	}
+	if err := validateRateAndBurst(bw.EgressRate, bw.EgressBurst); err != nil {
+		return nil, fmt.Errorf("invalid egress bandwidth: %v", err)
+	}
+	if bw.IngressRate == 0 && bw.EgressRate == 0 {
+		return nil, nil
+	}
+	return bw, nil
+}
+
+func validateRateAndBurst(rate, burst uint64) error {
+	switch {
+	case burst == 0 && rate != 0:
+		return fmt.Errorf("if rate is set, burst must also be set")
+	case rate == 0 && burst != 0:
+		return fmt.Errorf("if burst is set, rate must also be set")
+	case burst/8 >= math.MaxUint32:
+		return fmt.Errorf("burst cannot be more than 4GB")
+	}
+	return nil
+}
+
+// parseBandwidthQuantity parses the bits per second in the kubernetes quantity format, such as "10M"
+func parseBandwidthQuantity(quantity string) (uint64, error) {
+	number, multiplier := quantity, 1.0
+	for suffix, m := range quantitySuffixes {
+		if strings.HasSuffix(quantity, suffix) {
+			number, multiplier = strings.TrimSuffix(quantity, suffix), m
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid bandwidth quantity %q", quantity)
+	}
+	return uint64(value * multiplier), nil
+}
+
+// setupBandwidth shapes the traffic of the pod on the host veth
+func setupBandwidth(bw *args.Bandwidth, containerID, ifName, hostVethName string, mtu int) error {
+	if bw.IngressRate > 0 {
+		if err := nettool.SetupIngressBandwidth(hostVethName, bw.IngressRate, bw.IngressBurst); err != nil {
+			return err
+		}
+	}
+	if bw.EgressRate > 0 {
+		ifbName := nettool.IfbDeviceName(containerID, ifName)
+		if err := nettool.SetupEgressBandwidth(hostVethName, ifbName, bw.EgressRate, bw.EgressBurst, mtu); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/morvencao/minicni/pkg/args"
+)
+
+func TestParseBandwidthQuantity(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    uint64
+		wantErr bool
+	}{
+		{input: "1000", want: 1000},
+		{input: "10M", want: 10000000},
+		{input: "1.5k", want: 1500},
+		{input: "1Gi", want: 1 << 30},
+		{input: "-1M", wantErr: true},
+		{input: "10Mbit", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseBandwidthQuantity(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBandwidthQuantity error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("wanted %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGetBandwidth(t *testing.T) {
+	tests := []struct {
+		name          string
+		runtimeConfig *args.Bandwidth
+		cniArgs       map[string]string
+		want          *args.Bandwidth
+		wantErr       bool
+	}{
+		{
+			name: "no limits",
+			want: nil,
+		},
+		{
+			name:          "runtime config",
+			runtimeConfig: &args.Bandwidth{IngressRate: 1000000, IngressBurst: 100000},
+			want:          &args.Bandwidth{IngressRate: 1000000, IngressBurst: 100000},
+		},
+		{
+			name:    "annotations",
+			cniArgs: map[string]string{IngressBandwidthAnnotation: "1M", EgressBandwidthAnnotation: "2M"},
+			want:    &args.Bandwidth{IngressRate: 1000000, IngressBurst: defaultBurst, EgressRate: 2000000, EgressBurst: defaultBurst},
+		},
+		{
+			name:          "runtime config takes precedence over annotations",
+			runtimeConfig: &args.Bandwidth{EgressRate: 3000000, EgressBurst: 100000},
+			cniArgs:       map[string]string{IngressBandwidthAnnotation: "1M", EgressBandwidthAnnotation: "2M"},
+			want:          &args.Bandwidth{IngressRate: 1000000, IngressBurst: defaultBurst, EgressRate: 3000000, EgressBurst: 100000},
+		},
+		{
+			name:          "rate without burst",
+			runtimeConfig: &args.Bandwidth{IngressRate: 1000000},
+			wantErr:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cniConfig := &args.CNIConfiguration{RuntimeConfig: args.RuntimeConfig{Bandwidth: tt.runtimeConfig}}
+			got, err := getBandwidth(cniConfig, tt.cniArgs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getBandwidth error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("wanted %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
@@ -1,17 +1,29 @@
 package handler
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
-	"strings"
+	"time"
 
 	"github.com/morvencao/minicni/pkg/args"
+	"github.com/morvencao/minicni/pkg/firewall"
 	"github.com/morvencao/minicni/pkg/nettool"
 	"github.com/morvencao/minicni/pkg/version"
 
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	defaultAnnounceCount    = 1
+	defaultAnnounceInterval = 100 * time.Millisecond
+	defaultARPProbeTimeout  = 200 * time.Millisecond
+	// bridgePortTimeout is how long to wait for the bridge to forward the frames of the pod
+	bridgePortTimeout = 5 * time.Second
 )
 
 type FileHandler struct {
@@ -29,16 +41,137 @@ func NewFileHandler(filename string) Handler {
 	}
 }
 
+// conflictStore is the file that stores the IPs answering the ARP probes
+func (fh *FileHandler) conflictStore() string {
+	return fh.IPStore + ".conflicts"
+}
+
+// HandleAdd sets up the pod network step by step, the steps done so far are undone if any step fails
 func (fh *FileHandler) HandleAdd(cmdArgs *args.CmdArgs) error {
+	return fh.handleAdd(cmdArgs, nil)
+}
+
+// handleAdd is HandleAdd with failAfter called after each step, the tests pass it to inject failures
+func (fh *FileHandler) handleAdd(cmdArgs *args.CmdArgs, failAfter func(step string) error) (err error) {
 	cniConfig := args.CNIConfiguration{}
 	if err := json.Unmarshal(cmdArgs.StdinData, &cniConfig); err != nil {
 		return err
 	}
+	rb := rollback{failAfter: failAfter}
+	defer func() {
+		if err != nil {
+			err = rb.run(err)
+		}
+	}()
+	cniArgs, err := args.ParseCNIArgs(cmdArgs.Args)
+	if err != nil {
+		return err
+	}
+	mode, err := attachMode(&cniConfig)
+	if err != nil {
+		return err
+	}
+	bw, err := getBandwidth(&cniConfig, cniArgs)
+	if err != nil {
+		return err
+	}
+	sysctls, err := getSysctls(&cniConfig, cniArgs)
+	if err != nil {
+		return err
+	}
+	routes, err := getRoutes(&cniConfig)
+	if err != nil {
+		return err
+	}
+	hostVethName, err := getHostVethName(&cniConfig, mode, cmdArgs.ContainerID, cmdArgs.IfName)
+	if err != nil {
+		return err
+	}
+	hostSettings, err := getHostSettings(&cniConfig)
+	if err != nil {
+		return err
+	}
+	encapOverhead, err := getEncapOverhead(&cniConfig)
+	if err != nil {
+		return err
+	}
+	// the traffic is shaped on the host veth
+	if bw != nil && !hasHostVeth(mode) {
+		return fmt.Errorf("bandwidth limits are not supported in %s mode", mode)
+	}
+	// the frames of the pod are filtered on its bridge port
+	if cniConfig.SpoofCheck && mode != ModeBridge {
+		return fmt.Errorf("spoof check is not supported in %s mode", mode)
+	}
+	// the networks are isolated by their bridges
+	if cniConfig.Isolation && mode != ModeBridge {
+		return fmt.Errorf("isolation is not supported in %s mode", mode)
+	}
+	if cniConfig.IsolateHost && !cniConfig.Isolation {
+		return fmt.Errorf("isolateHost requires isolation")
+	}
 	allIPs, err := nettool.GetAllIPs(cniConfig.Subnet)
 	if err != nil {
 		return err
 	}
 	gwIP := allIPs[0]
+	gwAddr, _, err := net.ParseCIDR(gwIP)
+	if err != nil {
+		return err
+	}
+	ipv4 := gwAddr.To4() != nil
+	// the policies are on the forward hook, which only sees the traffic between the pods of the bridge
+	// through br_netfilter. The bridge sysctls are checked with the other host settings if they are set.
+	if cniConfig.NetworkPolicy && mode == ModeBridge && hostSettings == "" {
+		if err := nettool.EnsureHostSysctls(nettool.BridgeNetfilterSysctls(ipv4), false); err != nil {
+			return fmt.Errorf("network policy can't be enforced between the pods on the bridge: %v", err)
+		}
+	}
+
+	mtu := int(cniConfig.MTU)
+	if mtu == 0 {
+		if mtu, err = detectMTU(&cniConfig, mode); err != nil {
+			return err
+		}
+		// the pod traffic to the remote nodes is routed through the host and encapsulated there
+		if hasHostVeth(mode) {
+			mtu -= encapOverhead
+		}
+	}
+	// the candidate IPs are probed on the link the pods are attached to, there is none in ptp mode
+	brName, probeLink := "", ""
+	if mode == ModeMacvlan || mode == ModeIPVlan {
+		probeLink = cniConfig.Master
+	}
+	var br *netlink.Bridge
+	if mode == ModeBridge {
+		// Create or update bridge
+		brName = bridgeName(&cniConfig)
+		probeLink = brName
+		// the bridge is deleted on failure only if it's created by this ADD
+		_, lookupErr := netlink.LinkByName(brName)
+		br, err = nettool.CreateOrUpdateBridge(brName, gwIP, mtu)
+		if err != nil {
+			return err
+		}
+		if _, ok := lookupErr.(netlink.LinkNotFoundError); ok {
+			rb.add(func() error { return nettool.DeleteLink(brName) })
+		}
+		if cniConfig.PromiscMode {
+			if err := nettool.EnableBridgePromisc(br); err != nil {
+				return err
+			}
+		}
+		if err := rb.checkpoint("bridge"); err != nil {
+			return err
+		}
+	}
+	if hostSettings != "" {
+		// the rp_filter sysctl of the bridge only exists once the bridge is created
+		if err := nettool.EnsureHostSysctls(hostSysctls(mode, brName, ipv4), hostSettings == HostSettingsEnable); err != nil {
+			return err
+		}
+	}
 
 	// open or create the file that stores all the reserved IPs
 	f, err := os.OpenFile(fh.IPStore, os.O_RDWR|os.O_CREATE, 0600)
@@ -52,64 +185,253 @@ func (fh *FileHandler) HandleAdd(cmdArgs *args.CmdArgs) error {
 	if err != nil {
 		return err
 	}
-	reservedIPs := strings.Split(strings.TrimSpace(string(content)), "\n")
+	allocs := parseAllocations(string(content))
+	reservedIPs := allocatedIPs(allocs)
+
+	// the IPs found in use by the unknown hosts are skipped until their conflicts expire
+	now := time.Now()
+	storedConflicts, err := readConflicts(fh.conflictStore())
+	if err != nil {
+		return err
+	}
+	conflicts := activeConflicts(storedConflicts, now)
+	probe := cniConfig.ARPProbe && probeLink != ""
 
 	podIP := ""
 	for _, ip := range allIPs[1:] {
-		reserved := false
-		for _, rip := range reservedIPs {
-			if ip == rip {
-				reserved = true
-				break
+		if containsIP(reservedIPs, ip) || hasConflict(conflicts, ip) {
+			continue
+		}
+		if probe {
+			inUse, err := probeIP(probeLink, ip, &cniConfig)
+			if err != nil {
+				return err
+			}
+			if inUse {
+				conflicts = append(conflicts, conflict{IP: ip, Seen: now})
+				continue
 			}
 		}
-		if !reserved {
-			podIP = ip
-			reservedIPs = append(reservedIPs, podIP)
-			break
+		podIP = ip
+		break
+	}
+	// the pool is used up by the conflicts, the IPs of the pool that no longer answer are handed out again
+	for i := 0; podIP == "" && probe && i < len(conflicts); i++ {
+		if !containsIP(allIPs[1:], conflicts[i].IP) || containsIP(reservedIPs, conflicts[i].IP) {
+			continue
+		}
+		inUse, err := probeIP(probeLink, conflicts[i].IP, &cniConfig)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			conflicts[i].Seen = now
+			continue
+		}
+		podIP = conflicts[i].IP
+		conflicts = append(conflicts[:i], conflicts[i+1:]...)
+	}
+	if !bytes.Equal(formatConflicts(conflicts), formatConflicts(storedConflicts)) {
+		if err := ioutil.WriteFile(fh.conflictStore(), formatConflicts(conflicts), 0600); err != nil {
+			return fmt.Errorf("failed to write conflicting IPs into file: %v", err)
 		}
 	}
 	if podIP == "" {
 		return fmt.Errorf("no IP available")
 	}
+	allocs = append(allocs, allocation{IP: podIP, ContainerID: cmdArgs.ContainerID, IfName: cmdArgs.IfName, HostVeth: hostVethName})
 
-	// Create or update bridge
-	brName := cniConfig.Bridge
-	if brName != "" {
-		// fall back to default bridge name: minicni0
-		brName = "minicni0"
+	// write reserved IPs back into file
+	if err := ioutil.WriteFile(fh.IPStore, formatAllocations(allocs), 0600); err != nil {
+		return fmt.Errorf("failed to write reserved IPs into file: %v", err)
 	}
-	mtu := cniConfig.MTU
-	if mtu == 0 {
-		// fall back to default MTU: 1500
-		mtu = 1500
+	rb.add(func() error {
+		if err := ioutil.WriteFile(fh.IPStore, formatAllocations(allocs[:len(allocs)-1]), 0600); err != nil {
+			return fmt.Errorf("failed to release IP %q: %v", podIP, err)
+		}
+		return nil
+	})
+	if err := rb.checkpoint("ip"); err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(cmdArgs.Netns)
+	if err != nil {
+		return err
+	}
+	// the interface is deleted on failure, so it must not exist before
+	if _, err := nettool.GetLinkTypeInNS(netns, cmdArgs.IfName); err == nil {
+		return fmt.Errorf("interface %q already exists in %q", cmdArgs.IfName, cmdArgs.Netns)
 	}
-	br, err := nettool.CreateOrUpdateBridge(brName, gwIP, mtu)
+	// the first interface of the family in the pod is the primary one, the other interfaces
+	// of the pod route the traffic from their own addresses only
+	podAddr, _, err := net.ParseCIDR(podIP)
 	if err != nil {
 		return err
 	}
+	hasDefaultRoute, err := nettool.HasDefaultRouteInNS(netns, podAddr.To4() != nil)
+	if err != nil {
+		return err
+	}
+	primary := !hasDefaultRoute
 
-	netns, err := ns.GetNS(cmdArgs.Netns)
+	mac, err := podMAC(&cniConfig, cniArgs, podIP)
 	if err != nil {
 		return err
 	}
+	// the pod is not reachable until the agent replaces the block with its network policies
+	if cniConfig.NetworkPolicy {
+		if err := blockPod(&cniConfig, podIP); err != nil {
+			return err
+		}
+		rb.add(func() error { return teardownPodPolicy(&cniConfig, podIP) })
+		if err := rb.checkpoint("block"); err != nil {
+			return err
+		}
+	}
+	// the interface may be half configured if the setup fails, deleting it deletes the host veth as well
+	rb.add(func() error { return nettool.DeleteLinkInNS(netns, cmdArgs.IfName) })
+	if err := setupInterface(&cniConfig, mode, netns, br, cmdArgs.IfName, hostVethName, podIP, gwIP, mac, mtu, primary); err != nil {
+		return err
+	}
+	if !fixedMAC(&cniConfig, mode) {
+		if mac, err = nettool.GetMACInNS(netns, cmdArgs.IfName); err != nil {
+			return err
+		}
+	}
+	if cniConfig.SpoofCheck {
+		rb.add(func() error { return teardownSpoofCheck(&cniConfig, hostVethName) })
+		if err := setupSpoofCheck(&cniConfig, hostVethName, mac, podIP); err != nil {
+			return err
+		}
+		if err := rb.checkpoint("spoofcheck"); err != nil {
+			return err
+		}
+	}
 
-	if err := nettool.SetupVeth(netns, br, cmdArgs.IfName, podIP, gwIP, mtu); err != nil {
+	// the pod routes the traffic via the link-local gateway on the host veth in ptp mode
+	if mode == ModePTP {
+		ip, _, err := net.ParseCIDR(podIP)
+		if err != nil {
+			return err
+		}
+		gwIP = nettool.PTPGateway(ip).String()
+	}
+
+	if err := nettool.SetLoopbackUpInNS(netns); err != nil {
+		return err
+	}
+	if !primary {
+		// the rules are left behind by the interface deletion
+		rb.add(func() error { return deleteSourceRules(netns, podIP) })
+		if err := nettool.AddSourceRoutingInNS(netns, cmdArgs.IfName, podGateway(&cniConfig, mode, gwIP)); err != nil {
+			return err
+		}
+	}
+	// the extra routes without gateway go via the default gateway of the pod
+	if len(routes) > 0 {
+		gw := podGateway(&cniConfig, mode, gwIP)
+		for i := range routes {
+			if routes[i].GW == nil {
+				routes[i].GW = gw
+			}
+		}
+		if err := nettool.AddRoutesInNS(netns, cmdArgs.IfName, routes); err != nil {
+			return err
+		}
+	}
+	if err := rb.checkpoint("routes"); err != nil {
+		return err
+	}
+	if len(sysctls) > 0 {
+		if err := nettool.SetSysctlsInNS(netns, sysctls); err != nil {
+			return err
+		}
+	}
+	if err := rb.checkpoint("sysctls"); err != nil {
 		return err
 	}
 
-	// write reserved IPs back into file
-	if err := ioutil.WriteFile(fh.IPStore, []byte(strings.Join(reservedIPs, "\n")), 0600); err != nil {
-		return fmt.Errorf("failed to write reserved IPs into file: %v", err)
+	// neighbors may have cached the MAC of the previous pod with the same IP
+	if count, interval := announcement(&cniConfig); count > 0 && shouldAnnounce(&cniConfig, mode) {
+		if mode == ModeBridge {
+			if err := nettool.WaitBridgePortForwarding(hostVethName, bridgePortTimeout); err != nil {
+				return err
+			}
+		}
+		if err := nettool.AnnounceAddress(netns, cmdArgs.IfName, podIP, count, interval); err != nil {
+			return err
+		}
+	}
+	if err := rb.checkpoint("announce"); err != nil {
+		return err
+	}
+
+	if cniConfig.IPMasq {
+		// the masquerade rules are shared by the pods of the network
+		rb.add(func() error { return teardownIPMasq(&cniConfig, reservedIPs) })
+		if err := setupIPMasq(&cniConfig); err != nil {
+			return err
+		}
+		if err := rb.checkpoint("ipmasq"); err != nil {
+			return err
+		}
+	}
+
+	if mode == ModeBridge {
+		// the isolation rules of all the networks are rebuilt so that they are reconciled on every ADD
+		rb.add(func() error { return fh.teardownIsolation(&cniConfig, reservedIPs) })
+		if err := fh.syncIsolation(&cniConfig, brName); err != nil {
+			return err
+		}
+		if err := rb.checkpoint("isolation"); err != nil {
+			return err
+		}
+	}
+
+	// the host ports are forwarded to the primary interface of the pod
+	if len(cniConfig.RuntimeConfig.PortMappings) > 0 && primary {
+		// the localhost access to the host ports is routed through the bridge or the host veth
+		localnetLink := brName
+		if mode == ModePTP {
+			localnetLink = hostVethName
+		}
+		rb.add(func() error { return teardownPortMappings(&cniConfig, cmdArgs.ContainerID) })
+		if err := setupPortMappings(&cniConfig, cmdArgs.ContainerID, localnetLink, podIP); err != nil {
+			return err
+		}
+		if err := rb.checkpoint("portmappings"); err != nil {
+			return err
+		}
+	}
+
+	if bw != nil {
+		// the qdiscs of the host veth are deleted with it, but the ifb device is not
+		ifbName := nettool.IfbDeviceName(cmdArgs.ContainerID, cmdArgs.IfName)
+		rb.add(func() error { return nettool.DeleteLink(ifbName) })
+		if err := setupBandwidth(bw, cmdArgs.ContainerID, cmdArgs.IfName, hostVethName, mtu); err != nil {
+			return err
+		}
+		if err := rb.checkpoint("bandwidth"); err != nil {
+			return err
+		}
 	}
 
 	addCmdResult := &AddCmdResult{
 		CniVersion: cniConfig.CniVersion,
+		Interfaces: []*Interface{
+			{
+				Name:    cmdArgs.IfName,
+				Mac:     mac.String(),
+				Sandbox: cmdArgs.Netns,
+			},
+		},
 		IPs: &nettool.AllocatedIP{
 			Version: "IPv4",
 			Address: podIP,
 			Gateway: gwIP,
 		},
+		Routes: resultRoutes(routes),
 	}
 	addCmdResultBytes, err := json.Marshal(addCmdResult)
 	if err != nil {
@@ -122,12 +444,14 @@ func (fh *FileHandler) HandleAdd(cmdArgs *args.CmdArgs) error {
 	return nil
 }
 
+// HandleDel tears down the pod network explicitly rather than relying on the netns destruction,
+// the bridge is deleted with the last pod on it if deleteBridge is set.
 func (fh *FileHandler) HandleDel(cmdArgs *args.CmdArgs) error {
-	netns, err := ns.GetNS(cmdArgs.Netns)
-	if err != nil {
+	cniConfig := args.CNIConfiguration{}
+	if err := json.Unmarshal(cmdArgs.StdinData, &cniConfig); err != nil {
 		return err
 	}
-	ip, err := nettool.GetVethIPInNS(netns, cmdArgs.IfName)
+	mode, err := attachMode(&cniConfig)
 	if err != nil {
 		return err
 	}
@@ -144,25 +468,176 @@ func (fh *FileHandler) HandleDel(cmdArgs *args.CmdArgs) error {
 	if err != nil {
 		return err
 	}
-	reservedIPs := strings.Split(strings.TrimSpace(string(content)), "\n")
+	allocs := parseAllocations(string(content))
+
+	// the record of the interface locates the IP and the host veth without the netns,
+	// the records written by the older versions are looked up by the IP in the netns.
+	// DEL succeeds without the record if the netns or the interface is gone already.
+	var ip, hostVethName string
+	netns, nsErr := ns.GetNS(cmdArgs.Netns)
+	i := findAllocation(allocs, cmdArgs.ContainerID, cmdArgs.IfName)
+	if i >= 0 {
+		ip, hostVethName = allocs[i].IP, allocs[i].HostVeth
+	} else if nsErr == nil {
+		exists, err := nettool.LinkExistsInNS(netns, cmdArgs.IfName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if ip, err = nettool.GetIPInNS(netns, cmdArgs.IfName); err != nil {
+				return err
+			}
+			for j, a := range allocs {
+				if a.IP == ip {
+					i = j
+					break
+				}
+			}
+			if hasHostVeth(mode) {
+				// the host veth of the older versions is only found through its peer
+				hostVethName, _ = nettool.GetHostVethName(netns, cmdArgs.IfName)
+			}
+		}
+	}
+	// the host veth is named after the container, so it's known without the record and the netns
+	if hostVethName == "" {
+		if hostVethName, err = getHostVethName(&cniConfig, mode, cmdArgs.ContainerID, cmdArgs.IfName); err != nil {
+			return err
+		}
+	}
+
+	// the ifb device is not in the netns and it's named after the container, so it's always deleted
+	// whether or not the runtime passes the bandwidth limits to DEL
+	if err := nettool.TeardownBandwidth(hostVethName, nettool.IfbDeviceName(cmdArgs.ContainerID, cmdArgs.IfName)); err != nil {
+		return err
+	}
 
-	for i, rip := range reservedIPs {
-		if rip == ip {
-			reservedIPs = append(reservedIPs[:i], reservedIPs[i+1:]...)
-			break
+	if cniConfig.NetworkPolicy && ip != "" {
+		if err := teardownPodPolicy(&cniConfig, ip); err != nil {
+			return err
+		}
+	}
+	if cniConfig.SpoofCheck && hostVethName != "" {
+		if err := teardownSpoofCheck(&cniConfig, hostVethName); err != nil {
+			return err
 		}
 	}
 
+	// the IP is released after the interface is gone so that it's not handed out while still in use,
+	// deleting the host veth deletes the container interface as well if the netns is gone already
+	if nsErr == nil {
+		if ip != "" {
+			if err := deleteSourceRules(netns, ip); err != nil {
+				return err
+			}
+		}
+		if err := nettool.DeleteLinkInNS(netns, cmdArgs.IfName); err != nil {
+			return err
+		}
+	} else if hostVethName != "" {
+		if err := nettool.DeleteLink(hostVethName); err != nil {
+			return err
+		}
+	}
+
+	if i >= 0 {
+		allocs = append(allocs[:i], allocs[i+1:]...)
+	}
+	reservedIPs := allocatedIPs(allocs)
+
 	// write reserved IPs back into file
-	if err := ioutil.WriteFile(fh.IPStore, []byte(strings.Join(reservedIPs, "\n")), 0600); err != nil {
+	if err := ioutil.WriteFile(fh.IPStore, formatAllocations(allocs), 0600); err != nil {
 		return fmt.Errorf("failed to write reserved IPs into file: %v", err)
 	}
 
+	// the host ports are keyed by container ID so they can be removed without the netns,
+	// they go with the last interface of the container
+	if len(cniConfig.RuntimeConfig.PortMappings) > 0 && !hasContainerAllocation(allocs, cmdArgs.ContainerID) {
+		if err := teardownPortMappings(&cniConfig, cmdArgs.ContainerID); err != nil {
+			return err
+		}
+	}
+
+	// remove the masquerade rules once the last pod of the network is gone
+	if cniConfig.IPMasq {
+		if err := teardownIPMasq(&cniConfig, reservedIPs); err != nil {
+			return err
+		}
+	}
+	if mode == ModeBridge {
+		if err := fh.teardownIsolation(&cniConfig, reservedIPs); err != nil {
+			return err
+		}
+	}
+
+	if mode == ModeBridge && cniConfig.DeleteBridge {
+		_, subnet, err := net.ParseCIDR(cniConfig.Subnet)
+		if err != nil {
+			return err
+		}
+		if countIPsInSubnet(reservedIPs, subnet) == 0 {
+			if err := nettool.DeleteBridgeIfUnused(bridgeName(&cniConfig)); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
 func (fh *FileHandler) HandleCheck(cmdArgs *args.CmdArgs) error {
-	// to br implemented
+	cniConfig := args.CNIConfiguration{}
+	if err := json.Unmarshal(cmdArgs.StdinData, &cniConfig); err != nil {
+		return err
+	}
+	mode, err := attachMode(&cniConfig)
+	if err != nil {
+		return err
+	}
+
+	cniArgs, err := args.ParseCNIArgs(cmdArgs.Args)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(cmdArgs.Netns)
+	if err != nil {
+		return err
+	}
+	// the IP of the interface is taken from its record, the records written by the older
+	// versions are not keyed by the interface so the IP is looked up in the netns
+	var podIP string
+	content, err := ioutil.ReadFile(fh.IPStore)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read reserved IPs from file: %v", err)
+	}
+	allocs := parseAllocations(string(content))
+	if i := findAllocation(allocs, cmdArgs.ContainerID, cmdArgs.IfName); i >= 0 {
+		podIP = allocs[i].IP
+		if err := nettool.CheckIPInNS(netns, cmdArgs.IfName, podIP); err != nil {
+			return err
+		}
+	} else if podIP, err = nettool.GetIPInNS(netns, cmdArgs.IfName); err != nil {
+		return err
+	}
+	if fixedMAC(&cniConfig, mode) {
+		wantMAC, err := podMAC(&cniConfig, cniArgs, podIP)
+		if err != nil {
+			return err
+		}
+		mac, err := nettool.GetMACInNS(netns, cmdArgs.IfName)
+		if err != nil {
+			return err
+		}
+		if mac.String() != wantMAC.String() {
+			return fmt.Errorf("%q has MAC address %q, expected %q", cmdArgs.IfName, mac, wantMAC)
+		}
+	}
+
+	if err := checkInterface(&cniConfig, mode, netns, cmdArgs.IfName, podIP); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -174,3 +649,227 @@ func (fh *FileHandler) HandleVersion(cmdArgs *args.CmdArgs) error {
 	fmt.Print(string(versionInfo))
 	return nil
 }
+
+// bridgeName returns the bridge of the network, falls back to default bridge name: minicni0
+func bridgeName(cniConfig *args.CNIConfiguration) string {
+	if cniConfig.Bridge == "" {
+		return "minicni0"
+	}
+	return cniConfig.Bridge
+}
+
+// bridgePortOptions returns the flags of the host veth on the bridge,
+// learning and flooding are on unless they are turned off explicitly.
+func bridgePortOptions(cniConfig *args.CNIConfiguration) *nettool.BridgePortOptions {
+	return &nettool.BridgePortOptions{
+		Hairpin:  cniConfig.HairpinMode,
+		Isolated: cniConfig.PortIsolation,
+		Learning: cniConfig.Learning == nil || *cniConfig.Learning,
+		Flood:    cniConfig.Flood == nil || *cniConfig.Flood,
+		Guard:    cniConfig.Guard,
+	}
+}
+
+// podMAC returns the MAC address of the pod interface, the mac capability takes precedence over
+// the MAC in CNI_ARGS, otherwise the MAC is derived from the pod IP.
+func podMAC(cniConfig *args.CNIConfiguration, cniArgs map[string]string, podIP string) (net.HardwareAddr, error) {
+	if cniConfig.RuntimeConfig.MAC != "" {
+		return nettool.ParseUnicastMAC(cniConfig.RuntimeConfig.MAC)
+	}
+	if cniArgs["MAC"] != "" {
+		return nettool.ParseUnicastMAC(cniArgs["MAC"])
+	}
+	ip, _, err := net.ParseCIDR(podIP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ip address %q: %v", podIP, err)
+	}
+	return nettool.MACFromIP(ip)
+}
+
+// announcement returns the number of and the interval between the announcements of the pod address
+func announcement(cniConfig *args.CNIConfiguration) (int, time.Duration) {
+	count := defaultAnnounceCount
+	if cniConfig.AnnounceCount != nil {
+		count = *cniConfig.AnnounceCount
+	}
+	interval := defaultAnnounceInterval
+	if cniConfig.AnnounceIntervalMs > 0 {
+		interval = time.Duration(cniConfig.AnnounceIntervalMs) * time.Millisecond
+	}
+	return count, interval
+}
+
+// probeIP returns true if the IP answers the ARP probe on the bridge
+func probeIP(brName, ip string, cniConfig *args.CNIConfiguration) (bool, error) {
+	ipaddr, _, err := net.ParseCIDR(ip)
+	if err != nil {
+		return false, err
+	}
+	// the neighbor discovery is not supported yet
+	if ipaddr.To4() == nil {
+		return false, nil
+	}
+	timeout := defaultARPProbeTimeout
+	if cniConfig.ARPProbeTimeoutMs > 0 {
+		timeout = time.Duration(cniConfig.ARPProbeTimeoutMs) * time.Millisecond
+	}
+	return nettool.ProbeAddress(brName, ipaddr, timeout)
+}
+
+func containsIP(ips []string, ip string) bool {
+	for _, i := range ips {
+		if i == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// readConflicts reads the records of the conflict store, no records are returned if the file doesn't exist
+func readConflicts(filename string) ([]conflict, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read conflicting IPs from file: %v", err)
+	}
+	return parseConflicts(string(content)), nil
+}
+
+// setupIPMasq masquerades the traffic from the pod subnet that leaves the node
+func setupIPMasq(cniConfig *args.CNIConfiguration) error {
+	_, subnet, err := net.ParseCIDR(cniConfig.Subnet)
+	if err != nil {
+		return err
+	}
+	var excludes []*net.IPNet
+	for _, cidr := range cniConfig.ClusterCIDRs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("failed to parse cluster CIDR %q: %v", cidr, err)
+		}
+		excludes = append(excludes, ipnet)
+	}
+	fw, err := firewall.New(cniConfig.FirewallBackend)
+	if err != nil {
+		return err
+	}
+	return fw.SetupIPMasq(cniConfig.Name, subnet, excludes)
+}
+
+// teardownIPMasq removes the masquerade rules of the network if none of the reserved IPs is in the subnet
+func teardownIPMasq(cniConfig *args.CNIConfiguration, reservedIPs []string) error {
+	_, subnet, err := net.ParseCIDR(cniConfig.Subnet)
+	if err != nil {
+		return err
+	}
+	if countIPsInSubnet(reservedIPs, subnet) > 0 {
+		return nil
+	}
+	fw, err := firewall.New(cniConfig.FirewallBackend)
+	if err != nil {
+		return err
+	}
+	return fw.TeardownIPMasq(cniConfig.Name, subnet)
+}
+
+// setupPortMappings forwards the host ports of the runtime config to the pod
+func setupPortMappings(cniConfig *args.CNIConfiguration, containerID, localnetLink, podIP string) error {
+	ip, _, err := net.ParseCIDR(podIP)
+	if err != nil {
+		return err
+	}
+	// the localhost access to the host ports is routed through the link to the pod
+	if ip.To4() != nil && localnetLink != "" {
+		if err := nettool.EnableRouteLocalnet(localnetLink); err != nil {
+			return err
+		}
+	}
+	fw, err := firewall.New(cniConfig.FirewallBackend)
+	if err != nil {
+		return err
+	}
+	return fw.SetupPortMappings(containerID, ip, cniConfig.RuntimeConfig.PortMappings)
+}
+
+// blockPod drops the traffic from and to the pod until its network policies are programmed
+func blockPod(cniConfig *args.CNIConfiguration, podIP string) error {
+	ip, _, err := net.ParseCIDR(podIP)
+	if err != nil {
+		return err
+	}
+	fw, err := firewall.New(cniConfig.FirewallBackend)
+	if err != nil {
+		return err
+	}
+	return fw.BlockPod(ip)
+}
+
+// teardownPodPolicy removes the block or the network policies of the pod
+func teardownPodPolicy(cniConfig *args.CNIConfiguration, podIP string) error {
+	ip, _, err := net.ParseCIDR(podIP)
+	if err != nil {
+		return err
+	}
+	fw, err := firewall.New(cniConfig.FirewallBackend)
+	if err != nil {
+		return err
+	}
+	return fw.TeardownPodPolicy(ip)
+}
+
+// setupSpoofCheck only lets the frames with the MAC and the IP of the pod in from its host veth
+func setupSpoofCheck(cniConfig *args.CNIConfiguration, hostVethName string, mac net.HardwareAddr, podIP string) error {
+	ip, _, err := net.ParseCIDR(podIP)
+	if err != nil {
+		return err
+	}
+	fw, err := firewall.New(cniConfig.FirewallBackend)
+	if err != nil {
+		return err
+	}
+	return fw.SetupSpoofCheck(hostVethName, mac, ip)
+}
+
+// teardownSpoofCheck removes the spoof check of the host veth
+func teardownSpoofCheck(cniConfig *args.CNIConfiguration, hostVethName string) error {
+	fw, err := firewall.New(cniConfig.FirewallBackend)
+	if err != nil {
+		return err
+	}
+	return fw.TeardownSpoofCheck(hostVethName)
+}
+
+// deleteSourceRules deletes the rules of the pod IP of an interface which is not the primary one
+func deleteSourceRules(netns ns.NetNS, podIP string) error {
+	ip, _, err := net.ParseCIDR(podIP)
+	if err != nil {
+		return err
+	}
+	return nettool.DeleteSourceRulesInNS(netns, ip)
+}
+
+// teardownPortMappings removes the host ports of the container
+func teardownPortMappings(cniConfig *args.CNIConfiguration, containerID string) error {
+	fw, err := firewall.New(cniConfig.FirewallBackend)
+	if err != nil {
+		return err
+	}
+	return fw.TeardownPortMappings(containerID)
+}
+
+// countIPsInSubnet counts the reserved IPs that belong to the subnet
+func countIPsInSubnet(reservedIPs []string, subnet *net.IPNet) int {
+	count := 0
+	for _, rip := range reservedIPs {
+		ip, _, err := net.ParseCIDR(rip)
+		if err != nil {
+			continue
+		}
+		if subnet.Contains(ip) {
+			count++
+		}
+	}
+	return count
+}
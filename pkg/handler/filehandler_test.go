@@ -0,0 +1,662 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+
+	"github.com/morvencao/minicni/pkg/args"
+	"github.com/morvencao/minicni/pkg/internal/testns"
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+// newTestHandler returns the file handler keeping its stores in the temp dir of the test
+func newTestHandler(t *testing.T) *FileHandler {
+	return NewFileHandler(filepath.Join(t.TempDir(), "reserved_ips")).(*FileHandler)
+}
+
+// podArgs returns the CNI args of the pod interface in the netns with the config
+func podArgs(conf *args.CNIConfiguration, netns, containerID, ifName string) (*args.CmdArgs, error) {
+	stdinData, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &args.CmdArgs{ContainerID: containerID, Netns: netns, IfName: ifName, StdinData: stdinData}, nil
+}
+
+// newPod creates the netns of the pod and returns the CNI args of its interface
+func newPod(t *testing.T, conf *args.CNIConfiguration, containerID, ifName string) (*args.CmdArgs, error) {
+	podNS, err := testns.New(t)
+	if err != nil {
+		return nil, err
+	}
+	return podArgs(conf, podNS.Path(), containerID, ifName)
+}
+
+// runAdd creates the pod and adds its interface with the handler
+func runAdd(t *testing.T, fh *FileHandler, conf *args.CNIConfiguration, containerID, ifName string) (*args.CmdArgs, error) {
+	cmdArgs, err := newPod(t, conf, containerID, ifName)
+	if err != nil {
+		return nil, err
+	}
+	if err := fh.HandleAdd(cmdArgs); err != nil {
+		return nil, fmt.Errorf("HandleAdd %s error = %v", ifName, err)
+	}
+	return cmdArgs, nil
+}
+
+// inPod runs the function in the netns of the pod
+func inPod(cmdArgs *args.CmdArgs, f func() error) error {
+	podNS, err := ns.GetNS(cmdArgs.Netns)
+	if err != nil {
+		return err
+	}
+	defer podNS.Close()
+	return podNS.Do(func(ns.NetNS) error { return f() })
+}
+
+func TestPodMAC(t *testing.T) {
+	tests := []struct {
+		name       string
+		runtimeMAC string
+		cniArgs    map[string]string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name: "derived from pod IP",
+			want: "0a:58:0a:f4:01:05",
+		},
+		{
+			name:    "from CNI_ARGS",
+			cniArgs: map[string]string{"MAC": "02:00:00:00:00:01"},
+			want:    "02:00:00:00:00:01",
+		},
+		{
+			name:       "runtime config takes precedence",
+			runtimeMAC: "02:00:00:00:00:02",
+			cniArgs:    map[string]string{"MAC": "02:00:00:00:00:01"},
+			want:       "02:00:00:00:00:02",
+		},
+		{
+			name:    "multicast MAC",
+			cniArgs: map[string]string{"MAC": "01:00:5e:00:00:01"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cniConfig := &args.CNIConfiguration{RuntimeConfig: args.RuntimeConfig{MAC: tt.runtimeMAC}}
+			got, err := podMAC(cniConfig, tt.cniArgs, "10.244.1.5/24")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("podMAC() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("podMAC() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleAddBridgeName(t *testing.T) {
+	tests := []struct {
+		name   string
+		bridge string
+		want   string
+	}{
+		{
+			name: "default bridge",
+			want: "minicni0",
+		},
+		{
+			name:   "configured bridge",
+			bridge: "minicnitest0",
+			want:   "minicnitest0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &args.CNIConfiguration{
+				CniVersion: "0.4.0",
+				Name:       "minicni",
+				Type:       "minicni",
+				Bridge:     tt.bridge,
+				Subnet:     "10.244.9.0/24",
+				VethPrefix: "mcni",
+			}
+
+			testns.Run(t, func() error {
+				if _, err := runAdd(t, newTestHandler(t), conf, "pod0", "eth0"); err != nil {
+					return err
+				}
+				// the host veth is attached to the configured bridge, and no other bridge is created
+				hostVeth, err := netlink.LinkByName(nettool.HostVethName("mcni", "pod0", "eth0"))
+				if err != nil {
+					return err
+				}
+				br, err := netlink.LinkByIndex(hostVeth.Attrs().MasterIndex)
+				if err != nil {
+					return fmt.Errorf("host veth is not attached to a bridge: %v", err)
+				}
+				if br.Attrs().Name != tt.want {
+					t.Errorf("wanted host veth on bridge %q, got %q", tt.want, br.Attrs().Name)
+				}
+				names, err := linkNames()
+				if err != nil {
+					return err
+				}
+				if len(names) != 2 {
+					t.Errorf("wanted the bridge and the host veth on host, got %v", names)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestHandleAddHostSettings(t *testing.T) {
+	tests := []struct {
+		name         string
+		hostSettings string
+		wantErr      string
+	}{
+		{
+			name:         "check",
+			hostSettings: HostSettingsCheck,
+			wantErr:      "sysctl net.ipv4.ip_forward is 0",
+		},
+		{
+			name:         "enable",
+			hostSettings: HostSettingsEnable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &args.CNIConfiguration{
+				CniVersion:   "0.4.0",
+				Name:         "minicni",
+				Type:         "minicni",
+				Bridge:       "minicnitest0",
+				Subnet:       "10.244.9.0/24",
+				HostSettings: tt.hostSettings,
+			}
+
+			testns.Run(t, func() error {
+				// the forwarding is off and the reverse path filter is strict
+				for key, value := range map[string]string{"net/ipv4/ip_forward": "0", "net/ipv4/conf/all/rp_filter": "1"} {
+					if _, err := sysctl.Sysctl(key, value); err != nil {
+						return err
+					}
+				}
+				_, err := runAdd(t, newTestHandler(t), conf, "pod0", "eth0")
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Errorf("wanted error with %q, got %v", tt.wantErr, err)
+					}
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				// the sysctls of the IPv4 pods are set
+				for key, want := range map[string]string{"net/ipv4/ip_forward": "1", "net/ipv4/conf/minicnitest0/rp_filter": "2"} {
+					if got, err := sysctl.Sysctl(key); err != nil || got != want {
+						t.Errorf("wanted sysctl %s %s, got %q (%v)", key, want, got, err)
+					}
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestHandleAddNetworkPolicyBridgeNetfilter(t *testing.T) {
+	conf := &args.CNIConfiguration{
+		CniVersion:      "0.4.0",
+		Name:            "minicni",
+		Type:            "minicni",
+		Bridge:          "minicnitest0",
+		Subnet:          "10.244.9.0/24",
+		FirewallBackend: "nftables",
+		NetworkPolicy:   true,
+	}
+
+	unsupported := false
+	testns.Run(t, func() error {
+		// the traffic between the pods on the bridge skips the policies
+		if _, err := sysctl.Sysctl("net/bridge/bridge-nf-call-iptables", "0"); err != nil {
+			unsupported = true
+			return nil
+		}
+		fh := newTestHandler(t)
+		if _, err := runAdd(t, fh, conf, "pod0", "eth0"); err == nil || !strings.Contains(err.Error(), "net.bridge.bridge-nf-call-iptables is 0") {
+			t.Errorf("wanted ADD to fail without bridge netfilter, got %v", err)
+		}
+		if names, err := linkNames(); err != nil || len(names) > 0 {
+			t.Errorf("links left on host %v (%v)", names, err)
+		}
+
+		if _, err := sysctl.Sysctl("net/bridge/bridge-nf-call-iptables", "1"); err != nil {
+			return err
+		}
+		_, err := runAdd(t, fh, conf, "pod0", "eth0")
+		return err
+	})
+	if unsupported {
+		t.Skip("br_netfilter module is not loaded")
+	}
+}
+
+func TestHandleAddClearsConflicts(t *testing.T) {
+	// the subnet has a single IP for the pods
+	conf := &args.CNIConfiguration{
+		CniVersion:        "0.4.0",
+		Name:              "minicni",
+		Type:              "minicni",
+		Bridge:            "minicnitest0",
+		Subnet:            "10.244.9.0/30",
+		ARPProbe:          true,
+		ARPProbeTimeoutMs: 500,
+	}
+
+	testns.Run(t, func() error {
+		br, err := nettool.CreateOrUpdateBridge("minicnitest0", "10.244.9.1/30", 1500)
+		if err != nil {
+			return err
+		}
+		// a host unknown to minicni holds the IP on the bridge
+		strangerNS, err := testns.New(t)
+		if err != nil {
+			return err
+		}
+		if err := nettool.SetupVeth(strangerNS, br, "eth0", "stranger", "10.244.9.2/30", "", nil, 1500, false); err != nil {
+			return err
+		}
+		if err := nettool.WaitBridgePortForwarding("stranger", bridgePortTimeout); err != nil {
+			return err
+		}
+		fh := newTestHandler(t)
+		cmdArgs, err := newPod(t, conf, "pod0", "eth0")
+		if err != nil {
+			return err
+		}
+		if err := fh.HandleAdd(cmdArgs); err == nil || !strings.Contains(err.Error(), "no IP available") {
+			return fmt.Errorf("wanted no IP available while the IP answers, got %v", err)
+		}
+		if conflicts, err := readConflicts(fh.conflictStore()); err != nil || len(conflicts) != 1 {
+			t.Errorf("wanted the IP marked as conflict, got %+v (%v)", conflicts, err)
+		}
+
+		// the conflict is probed again and cleared once the host is gone
+		if err := nettool.DeleteLink("stranger"); err != nil {
+			return err
+		}
+		if err := fh.HandleAdd(cmdArgs); err != nil {
+			return fmt.Errorf("HandleAdd error = %v", err)
+		}
+		content, _ := ioutil.ReadFile(fh.IPStore)
+		if got := strings.Fields(string(content)); len(got) == 0 || got[0] != "10.244.9.2/30" {
+			t.Errorf("wanted 10.244.9.2/30 handed out, got %q", content)
+		}
+		if conflicts, err := readConflicts(fh.conflictStore()); err != nil || len(conflicts) > 0 {
+			t.Errorf("conflicts left %+v (%v)", conflicts, err)
+		}
+		return nil
+	})
+}
+
+func TestHandleAddEncapMTU(t *testing.T) {
+	tests := []struct {
+		name  string
+		encap string
+		want  int
+	}{
+		{
+			name: "no encapsulation",
+			want: 9001,
+		},
+		{
+			name:  "vxlan",
+			encap: EncapVXLAN,
+			want:  9001 - nettool.VXLANOverhead,
+		},
+		{
+			name:  "wireguard",
+			encap: EncapWireGuard,
+			want:  9001 - nettool.WireGuardOverhead,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &args.CNIConfiguration{
+				CniVersion:    "0.4.0",
+				Name:          "minicni",
+				Type:          "minicni",
+				Bridge:        "minicnitest0",
+				Subnet:        "10.244.9.0/24",
+				Encapsulation: tt.encap,
+			}
+
+			testns.Run(t, func() error {
+				// the uplink carries the default route, the agent hasn't created its device yet
+				uplink := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "uplink0", MTU: 9001}, PeerName: "uplink0p"}
+				if err := netlink.LinkAdd(uplink); err != nil {
+					return err
+				}
+				if err := netlink.LinkSetUp(uplink); err != nil {
+					return err
+				}
+				if err := netlink.AddrAdd(uplink, &netlink.Addr{IPNet: &net.IPNet{IP: net.IPv4(192, 168, 0, 2), Mask: net.CIDRMask(24, 32)}}); err != nil {
+					return err
+				}
+				if err := nettool.AddDefaultRoute(net.IPv4(192, 168, 0, 1), uplink); err != nil {
+					return err
+				}
+				cmdArgs, err := runAdd(t, newTestHandler(t), conf, "pod0", "eth0")
+				if err != nil {
+					return err
+				}
+				if br, err := netlink.LinkByName("minicnitest0"); err != nil || br.Attrs().MTU != tt.want {
+					t.Errorf("wanted bridge MTU %d, got %v (%v)", tt.want, br, err)
+				}
+				return inPod(cmdArgs, func() error {
+					eth0, err := netlink.LinkByName("eth0")
+					if err != nil {
+						return err
+					}
+					if eth0.Attrs().MTU != tt.want {
+						t.Errorf("wanted pod MTU %d, got %d", tt.want, eth0.Attrs().MTU)
+					}
+					return nil
+				})
+			})
+		})
+	}
+}
+
+func TestIPMasq(t *testing.T) {
+	conf := &args.CNIConfiguration{
+		Name:            "minicni",
+		Subnet:          "10.244.9.0/24",
+		ClusterCIDRs:    []string{"10.244.0.0/16"},
+		FirewallBackend: "nftables",
+	}
+
+	testns.Run(t, func() error {
+		for i := 0; i < 2; i++ {
+			if err := setupIPMasq(conf); err != nil {
+				return fmt.Errorf("setupIPMasq error = %v", err)
+			}
+		}
+		// the jump, the pod subnet and cluster CIDR exclusions and the masquerade
+		if count, err := countNFTablesRules(); err != nil || count != 4 {
+			t.Errorf("wanted 4 masquerade rules, got %d (%v)", count, err)
+		}
+		// the rules are kept while there are pods in the subnet
+		if err := teardownIPMasq(conf, []string{"10.244.9.3/24", "10.244.8.2/24"}); err != nil {
+			return fmt.Errorf("teardownIPMasq error = %v", err)
+		}
+		if count, err := countNFTablesRules(); err != nil || count != 4 {
+			t.Errorf("masquerade rules are removed with pods left in the subnet, got %d (%v)", count, err)
+		}
+		if err := teardownIPMasq(conf, []string{"10.244.8.2/24"}); err != nil {
+			return fmt.Errorf("teardownIPMasq error = %v", err)
+		}
+		if count, err := countNFTablesRules(); err != nil || count > 0 {
+			t.Errorf("%d masquerade rules left (%v)", count, err)
+		}
+		return nil
+	})
+}
+
+func TestHandleDel(t *testing.T) {
+	conf := &args.CNIConfiguration{
+		CniVersion:      "0.4.0",
+		Name:            "minicni",
+		Type:            "minicni",
+		Bridge:          "minicnitest0",
+		Subnet:          "10.244.9.0/24",
+		IPMasq:          true,
+		FirewallBackend: "nftables",
+		NetworkPolicy:   true,
+		SpoofCheck:      true,
+		Isolation:       true,
+		DeleteBridge:    true,
+		RuntimeConfig: args.RuntimeConfig{
+			PortMappings: []args.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+			Bandwidth:    &args.Bandwidth{EgressRate: 1000000, EgressBurst: 100000},
+		},
+	}
+
+	testns.Run(t, func() error {
+		fh := newTestHandler(t)
+		var pods []*args.CmdArgs
+		for i := 0; i < 2; i++ {
+			cmdArgs, err := runAdd(t, fh, conf, fmt.Sprintf("pod%d", i), "eth0")
+			if err != nil {
+				return err
+			}
+			pods = append(pods, cmdArgs)
+		}
+
+		for i, cmdArgs := range pods {
+			// DEL doesn't look at CNI_ARGS nor the bandwidth limits, and it succeeds again once
+			// the pod network is gone
+			delConf := *conf
+			delConf.RuntimeConfig.Bandwidth = nil
+			delArgs, err := podArgs(&delConf, cmdArgs.Netns, cmdArgs.ContainerID, cmdArgs.IfName)
+			if err != nil {
+				return err
+			}
+			delArgs.Args = "K8S_POD_NAME"
+			for j := 0; j < 2; j++ {
+				if err := fh.HandleDel(delArgs); err != nil {
+					return fmt.Errorf("HandleDel #%d of pod%d error = %v", j, i, err)
+				}
+			}
+			err = inPod(cmdArgs, func() error {
+				names, err := linkNames()
+				if err != nil || len(names) > 0 {
+					t.Errorf("links left in pod%d %v (%v)", i, names, err)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if i == 0 {
+				if _, err := netlink.LinkByName("minicnitest0"); err != nil {
+					t.Errorf("bridge is deleted with pods left on it: %v", err)
+				}
+			}
+		}
+		// the bridge, the host veths and the ifb devices are all gone with the last pod
+		if names, err := linkNames(); err != nil || len(names) > 0 {
+			t.Errorf("links left on host %v (%v)", names, err)
+		}
+		if count, err := countNFTablesRules(); err != nil || count > 0 {
+			t.Errorf("%d nftables rules left (%v)", count, err)
+		}
+		content, _ := ioutil.ReadFile(fh.IPStore)
+		if ips := strings.TrimSpace(string(content)); ips != "" {
+			t.Errorf("IPs left reserved %q", ips)
+		}
+		if networks, err := readIsolatedNetworks(fh.isolationStore()); err != nil || len(networks) > 0 {
+			t.Errorf("isolated networks left %v (%v)", networks, err)
+		}
+		return nil
+	})
+}
+
+func TestHandleDelWithoutNetns(t *testing.T) {
+	tests := []struct {
+		name  string
+		netns func(t *testing.T) string
+	}{
+		{
+			name:  "missing netns",
+			netns: func(t *testing.T) string { return filepath.Join(t.TempDir(), "missing") },
+		},
+		{
+			name:  "empty netns",
+			netns: func(*testing.T) string { return "" },
+		},
+	}
+	conf := &args.CNIConfiguration{
+		CniVersion: "0.4.0",
+		Name:       "minicni",
+		Type:       "minicni",
+		Mode:       ModePTP,
+		Subnet:     "10.244.9.0/24",
+		VethPrefix: "mcni",
+		RuntimeConfig: args.RuntimeConfig{
+			PortMappings: []args.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testns.Run(t, func() error {
+				fh := newTestHandler(t)
+				cmdArgs, err := runAdd(t, fh, conf, "pod0", "eth0")
+				if err != nil {
+					return err
+				}
+				hostVethName := nettool.HostVethName("mcni", "pod0", "eth0")
+				if _, err := netlink.LinkByName(hostVethName); err != nil {
+					return fmt.Errorf("host veth is not named after the container: %v", err)
+				}
+				content, _ := ioutil.ReadFile(fh.IPStore)
+				if got, want := strings.TrimSpace(string(content)), "10.244.9.2/24 pod0 eth0 "+hostVethName; got != want {
+					t.Errorf("wanted allocation record %q, got %q", want, got)
+				}
+
+				// the netns can't be found by the runtime any more while the host veth is still there,
+				// DEL succeeds again without the record
+				cmdArgs.Netns = tt.netns(t)
+				for i := 0; i < 2; i++ {
+					if err := fh.HandleDel(cmdArgs); err != nil {
+						return fmt.Errorf("HandleDel #%d error = %v", i, err)
+					}
+				}
+				if names, err := linkNames(); err != nil || len(names) > 0 {
+					t.Errorf("links left on host %v (%v)", names, err)
+				}
+				if count, err := countNFTablesRules(); err != nil || count > 0 {
+					t.Errorf("%d nftables rules left (%v)", count, err)
+				}
+				content, _ = ioutil.ReadFile(fh.IPStore)
+				if ips := strings.TrimSpace(string(content)); ips != "" {
+					t.Errorf("IPs left reserved %q", ips)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestHandleAddMultipleInterfaces(t *testing.T) {
+	var confs []*args.CNIConfiguration
+	for i, subnet := range []string{"10.244.9.0/24", "10.244.10.0/24"} {
+		conf := &args.CNIConfiguration{
+			CniVersion:      "0.4.0",
+			Name:            fmt.Sprintf("minicni%d", i),
+			Type:            "minicni",
+			Bridge:          fmt.Sprintf("minicnitest%d", i),
+			Subnet:          subnet,
+			FirewallBackend: "nftables",
+			DeleteBridge:    true,
+			RuntimeConfig: args.RuntimeConfig{
+				PortMappings: []args.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+			},
+		}
+		confs = append(confs, conf)
+	}
+
+	testns.Run(t, func() error {
+		fh := newTestHandler(t)
+		primary, err := runAdd(t, fh, confs[0], "pod0", "eth0")
+		if err != nil {
+			return err
+		}
+		secondary, err := podArgs(confs[1], primary.Netns, "pod0", "net1")
+		if err != nil {
+			return err
+		}
+		if err := fh.HandleAdd(secondary); err != nil {
+			return fmt.Errorf("HandleAdd net1 error = %v", err)
+		}
+		for _, cmdArgs := range []*args.CmdArgs{primary, secondary} {
+			if err := fh.HandleCheck(cmdArgs); err != nil {
+				t.Errorf("HandleCheck %s error = %v", cmdArgs.IfName, err)
+			}
+		}
+
+		countRules := func() (int, error) {
+			var count int
+			err := inPod(secondary, func() error {
+				rules, err := netlink.RuleList(netlink.FAMILY_V4)
+				if err != nil {
+					return err
+				}
+				for _, rule := range rules {
+					if rule.Src != nil && rule.Src.IP.Equal(net.ParseIP("10.244.10.2")) {
+						count++
+					}
+				}
+				return nil
+			})
+			return count, err
+		}
+		err = inPod(primary, func() error {
+			routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+			if err != nil {
+				return err
+			}
+			var gateways []string
+			for _, route := range routes {
+				if route.Dst == nil {
+					gateways = append(gateways, route.Gw.String())
+				}
+			}
+			if len(gateways) != 1 || gateways[0] != "10.244.9.1" {
+				t.Errorf("wanted a single default route via 10.244.9.1, got %v", gateways)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if count, err := countRules(); err != nil || count != 1 {
+			t.Errorf("wanted a source rule for the secondary interface, got %d (%v)", count, err)
+		}
+
+		// the port mappings belong to the container and stay until its last interface is gone
+		if err := fh.HandleDel(secondary); err != nil {
+			return fmt.Errorf("HandleDel net1 error = %v", err)
+		}
+		if count, err := countRules(); err != nil || count > 0 {
+			t.Errorf("%d source rules left (%v)", count, err)
+		}
+		if count, err := countNFTablesRules(); err != nil || count == 0 {
+			t.Errorf("port mappings are removed with the secondary interface (%v)", err)
+		}
+		if err := fh.HandleDel(primary); err != nil {
+			return fmt.Errorf("HandleDel eth0 error = %v", err)
+		}
+		if names, err := linkNames(); err != nil || len(names) > 0 {
+			t.Errorf("links left on host %v (%v)", names, err)
+		}
+		if count, err := countNFTablesRules(); err != nil || count > 0 {
+			t.Errorf("%d nftables rules left (%v)", count, err)
+		}
+		return nil
+	})
+}
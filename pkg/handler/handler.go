@@ -14,5 +14,20 @@ type Handler interface {
 
 type AddCmdResult struct {
 	CniVersion string               `json:"cniVersion"`
+	Interfaces []*Interface         `json:"interfaces,omitempty"`
 	IPs        *nettool.AllocatedIP `json:"ips"`
+	Routes     []*Route             `json:"routes,omitempty"`
+}
+
+// Interface is the interface created in the container netns
+type Interface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac"`
+	Sandbox string `json:"sandbox"`
+}
+
+// Route is the extra route added in the container netns
+type Route struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
 }
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/morvencao/minicni/pkg/args"
+	"github.com/morvencao/minicni/pkg/firewall"
+)
+
+// isolateHostField marks the isolated network whose pods can't connect to the host in the isolation store
+const isolateHostField = "host"
+
+// isolationStore is the file that stores the isolated networks of the node
+func (fh *FileHandler) isolationStore() string {
+	return fh.IPStore + ".isolation"
+}
+
+// syncIsolation records the network in the isolation store if it's isolated, or removes it otherwise,
+// and rebuilds the isolation rules of all the networks in the store.
+func (fh *FileHandler) syncIsolation(cniConfig *args.CNIConfiguration, brName string) error {
+	networks, err := readIsolatedNetworks(fh.isolationStore())
+	if err != nil {
+		return err
+	}
+	i := findIsolatedNetwork(networks, cniConfig.Name)
+	switch {
+	case cniConfig.Isolation:
+		_, subnet, err := net.ParseCIDR(cniConfig.Subnet)
+		if err != nil {
+			return err
+		}
+		n := firewall.IsolatedNetwork{Name: cniConfig.Name, Bridge: brName, Subnet: subnet, IsolateHost: cniConfig.IsolateHost}
+		if i >= 0 {
+			networks[i] = n
+		} else {
+			networks = append(networks, n)
+		}
+	case i >= 0:
+		networks = append(networks[:i], networks[i+1:]...)
+	default:
+		return nil
+	}
+	return fh.writeIsolation(cniConfig, networks)
+}
+
+// teardownIsolation removes the network from the isolation store if none of the reserved IPs is in the subnet
+func (fh *FileHandler) teardownIsolation(cniConfig *args.CNIConfiguration, reservedIPs []string) error {
+	_, subnet, err := net.ParseCIDR(cniConfig.Subnet)
+	if err != nil {
+		return err
+	}
+	if countIPsInSubnet(reservedIPs, subnet) > 0 {
+		return nil
+	}
+	networks, err := readIsolatedNetworks(fh.isolationStore())
+	if err != nil {
+		return err
+	}
+	i := findIsolatedNetwork(networks, cniConfig.Name)
+	if i < 0 {
+		return nil
+	}
+	return fh.writeIsolation(cniConfig, append(networks[:i], networks[i+1:]...))
+}
+
+// writeIsolation writes the isolated networks into the isolation store and syncs the firewall with them
+func (fh *FileHandler) writeIsolation(cniConfig *args.CNIConfiguration, networks []firewall.IsolatedNetwork) error {
+	if err := ioutil.WriteFile(fh.isolationStore(), formatIsolatedNetworks(networks), 0600); err != nil {
+		return fmt.Errorf("failed to write isolated networks into file: %v", err)
+	}
+	fw, err := firewall.New(cniConfig.FirewallBackend)
+	if err != nil {
+		return err
+	}
+	return fw.SyncIsolation(networks)
+}
+
+// readIsolatedNetworks reads the isolation store, one network per line with its name, bridge,
+// subnet and whether the host is isolated, the malformed lines are skipped.
+func readIsolatedNetworks(filename string) ([]firewall.IsolatedNetwork, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read isolated networks from file: %v", err)
+	}
+	var networks []firewall.IsolatedNetwork
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(fields[2])
+		if err != nil {
+			continue
+		}
+		networks = append(networks, firewall.IsolatedNetwork{
+			Name:        fields[0],
+			Bridge:      fields[1],
+			Subnet:      subnet,
+			IsolateHost: len(fields) > 3 && fields[3] == isolateHostField,
+		})
+	}
+	return networks, nil
+}
+
+// formatIsolatedNetworks returns the content of the isolation store with the networks
+func formatIsolatedNetworks(networks []firewall.IsolatedNetwork) []byte {
+	lines := make([]string, 0, len(networks))
+	for _, n := range networks {
+		line := fmt.Sprintf("%s %s %s", n.Name, n.Bridge, n.Subnet)
+		if n.IsolateHost {
+			line += " " + isolateHostField
+		}
+		lines = append(lines, line)
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// findIsolatedNetwork returns the index of the network with the name, -1 if there is none
+func findIsolatedNetwork(networks []firewall.IsolatedNetwork, name string) int {
+	for i, n := range networks {
+		if n.Name == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/morvencao/minicni/pkg/firewall"
+)
+
+func TestIsolatedNetworks(t *testing.T) {
+	_, subnet1, _ := net.ParseCIDR("10.244.1.0/24")
+	_, subnet2, _ := net.ParseCIDR("fd00:1::/64")
+	networks := []firewall.IsolatedNetwork{
+		{Name: "net1", Bridge: "br1", Subnet: subnet1, IsolateHost: true},
+		{Name: "net2", Bridge: "br2", Subnet: subnet2},
+	}
+	content := formatIsolatedNetworks(networks)
+	if got := string(content); got != "net1 br1 10.244.1.0/24 host\nnet2 br2 fd00:1::/64" {
+		t.Errorf("formatIsolatedNetworks = %q", got)
+	}
+
+	filename := filepath.Join(t.TempDir(), "isolation")
+	if got, err := readIsolatedNetworks(filename); err != nil || len(got) > 0 {
+		t.Errorf("readIsolatedNetworks of missing file = %v, %v", got, err)
+	}
+	if err := ioutil.WriteFile(filename, append(content, []byte("\nbroken br3 10.0.0.0\n")...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readIsolatedNetworks(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(formatIsolatedNetworks(got)) != string(content) {
+		t.Errorf("networks are not kept through format and read: %+v", got)
+	}
+	if i := findIsolatedNetwork(got, "net2"); i != 1 {
+		t.Errorf("findIsolatedNetwork(net2) = %d, want 1", i)
+	}
+	if i := findIsolatedNetwork(got, "broken"); i != -1 {
+		t.Errorf("findIsolatedNetwork(broken) = %d, want -1", i)
+	}
+}
@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	"github.com/morvencao/minicni/pkg/args"
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+const (
+	// ModeBridge attaches the pod to the bridge with a veth pair, it's the default mode
+	ModeBridge = "bridge"
+	// ModeMacvlan puts a macvlan sub-interface of the master into the pod
+	ModeMacvlan = "macvlan"
+	// ModeIPVlan puts an ipvlan sub-interface of the master into the pod
+	ModeIPVlan = "ipvlan"
+	// ModePTP routes the traffic of the pod through a veth pair without a bridge
+	ModePTP = "ptp"
+
+	// EncapNone routes the pod traffic to the remote nodes as is, e.g. with the host-gw backend of the agent
+	EncapNone = "none"
+	// EncapVXLAN tunnels the pod traffic to the remote nodes with the vxlan backend of the agent
+	EncapVXLAN = "vxlan"
+	// EncapWireGuard encrypts the pod traffic to the remote nodes with the wireguard backend of the agent
+	EncapWireGuard = "wireguard"
+
+	// defaultVethPrefix is the prefix of the host veth names if the config doesn't set one
+	defaultVethPrefix = "veth"
+)
+
+var vethPrefixPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,7}$`)
+
+// attachMode returns how the pod is attached to the network and validates the options of the mode
+func attachMode(cniConfig *args.CNIConfiguration) (string, error) {
+	switch cniConfig.Mode {
+	case "", ModeBridge:
+		return ModeBridge, nil
+	case ModePTP:
+		return ModePTP, nil
+	case ModeMacvlan:
+		if cniConfig.Master == "" {
+			return "", fmt.Errorf("master is required in %s mode", cniConfig.Mode)
+		}
+		if _, err := nettool.ParseMacvlanMode(cniConfig.MacvlanMode); err != nil {
+			return "", err
+		}
+		return cniConfig.Mode, nil
+	case ModeIPVlan:
+		if cniConfig.Master == "" {
+			return "", fmt.Errorf("master is required in %s mode", cniConfig.Mode)
+		}
+		if _, err := nettool.ParseIPVlanMode(cniConfig.IPVlanMode); err != nil {
+			return "", err
+		}
+		return cniConfig.Mode, nil
+	default:
+		return "", fmt.Errorf("unknown mode: %q", cniConfig.Mode)
+	}
+}
+
+// setupInterface creates the interface of the pod in the mode, the host veth is named
+// hostVethName if the mode has one. Only the primary interface gets the default route.
+func setupInterface(cniConfig *args.CNIConfiguration, mode string, netns ns.NetNS, br *netlink.Bridge, ifName, hostVethName, podIP, gwIP string, mac net.HardwareAddr, mtu int, primary bool) error {
+	switch mode {
+	case ModeBridge:
+		if err := nettool.SetupVeth(netns, br, ifName, hostVethName, podIP, gwIP, mac, mtu, primary); err != nil {
+			return err
+		}
+		return nettool.SetBridgePortOptions(hostVethName, bridgePortOptions(cniConfig))
+	case ModeMacvlan:
+		macvlanMode, err := nettool.ParseMacvlanMode(cniConfig.MacvlanMode)
+		if err != nil {
+			return err
+		}
+		return nettool.SetupMacvlan(netns, cniConfig.Master, ifName, podIP, gwIP, macvlanMode, mac, mtu, primary)
+	case ModeIPVlan:
+		ipvlanMode, err := nettool.ParseIPVlanMode(cniConfig.IPVlanMode)
+		if err != nil {
+			return err
+		}
+		return nettool.SetupIPVlan(netns, cniConfig.Master, ifName, podIP, gwIP, ipvlanMode, mtu, primary)
+	case ModePTP:
+		return nettool.SetupPTP(netns, ifName, hostVethName, podIP, mac, mtu, primary)
+	default:
+		return fmt.Errorf("unknown mode: %q", mode)
+	}
+}
+
+// detectMTU returns the MTU of the link the pod traffic leaves the node through, the master in
+// macvlan and ipvlan modes or the link of the default route otherwise.
+func detectMTU(cniConfig *args.CNIConfiguration, mode string) (int, error) {
+	if mode == ModeMacvlan || mode == ModeIPVlan {
+		return nettool.LinkMTU(cniConfig.Master)
+	}
+	_, subnet, err := net.ParseCIDR(cniConfig.Subnet)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse subnet %q: %v", cniConfig.Subnet, err)
+	}
+	return nettool.DefaultRouteMTU(subnet.IP.To4() != nil)
+}
+
+// getEncapOverhead returns the size of the headers the encapsulation adds to the pod traffic to the
+// remote nodes. It's known from the config, the device of the agent may not be created yet.
+func getEncapOverhead(cniConfig *args.CNIConfiguration) (int, error) {
+	switch cniConfig.Encapsulation {
+	case "", EncapNone:
+		return 0, nil
+	case EncapVXLAN:
+		return nettool.VXLANOverhead, nil
+	case EncapWireGuard:
+		return nettool.WireGuardOverhead, nil
+	default:
+		return 0, fmt.Errorf("unknown encapsulation: %q", cniConfig.Encapsulation)
+	}
+}
+
+// getHostVethName returns the name of the host veth of the container interface, it's empty if the mode has none
+func getHostVethName(cniConfig *args.CNIConfiguration, mode, containerID, ifName string) (string, error) {
+	if !hasHostVeth(mode) {
+		return "", nil
+	}
+	prefix := cniConfig.VethPrefix
+	if prefix == "" {
+		prefix = defaultVethPrefix
+	}
+	// at least 8 hex digits of the hash are kept to tell the containers apart
+	if !vethPrefixPattern.MatchString(prefix) {
+		return "", fmt.Errorf("invalid veth prefix %q, it must be 1 to 7 letters, digits, '-' or '_'", prefix)
+	}
+	return nettool.HostVethName(prefix, containerID, ifName), nil
+}
+
+// checkInterface checks the interface of the pod is set up in the mode
+func checkInterface(cniConfig *args.CNIConfiguration, mode string, netns ns.NetNS, ifName, podIP string) error {
+	switch mode {
+	case ModeBridge:
+		brName := bridgeName(cniConfig)
+		hostVethName, err := nettool.GetHostVethName(netns, ifName)
+		if err != nil {
+			return err
+		}
+		if err := nettool.CheckBridgePort(hostVethName, brName, bridgePortOptions(cniConfig)); err != nil {
+			return err
+		}
+		if cniConfig.PromiscMode {
+			return nettool.CheckBridgePromisc(brName)
+		}
+		return nil
+	case ModePTP:
+		hostVethName, err := nettool.GetHostVethName(netns, ifName)
+		if err != nil {
+			return err
+		}
+		return nettool.CheckPTPRoute(hostVethName, podIP)
+	default:
+		linkType, err := nettool.GetLinkTypeInNS(netns, ifName)
+		if err != nil {
+			return err
+		}
+		if linkType != mode {
+			return fmt.Errorf("link %q is of %s type, expected %s", ifName, linkType, mode)
+		}
+		return nil
+	}
+}
+
+// fixedMAC returns false if the MAC of the pod interface is taken from the master
+func fixedMAC(cniConfig *args.CNIConfiguration, mode string) bool {
+	switch mode {
+	case ModeMacvlan:
+		return cniConfig.MacvlanMode != "passthru"
+	case ModeIPVlan:
+		return false
+	default:
+		return true
+	}
+}
+
+// shouldAnnounce returns false if the pod interface doesn't do ARP or neighbor discovery,
+// or there are no neighbors except the host which has a new link to the pod.
+func shouldAnnounce(cniConfig *args.CNIConfiguration, mode string) bool {
+	switch mode {
+	case ModeIPVlan:
+		return cniConfig.IPVlanMode == "" || cniConfig.IPVlanMode == "l2"
+	case ModePTP:
+		return false
+	default:
+		return true
+	}
+}
+
+// hasHostVeth returns true if the pod is attached with a veth pair in the mode
+func hasHostVeth(mode string) bool {
+	return mode == ModeBridge || mode == ModePTP
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/morvencao/minicni/pkg/args"
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+func TestAttachMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  args.CNIConfiguration
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "default bridge mode",
+			want: ModeBridge,
+		},
+		{
+			name:   "macvlan mode",
+			config: args.CNIConfiguration{Mode: "macvlan", Master: "eth0", MacvlanMode: "vepa"},
+			want:   ModeMacvlan,
+		},
+		{
+			name:    "macvlan mode without master",
+			config:  args.CNIConfiguration{Mode: "macvlan"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown macvlan mode",
+			config:  args.CNIConfiguration{Mode: "macvlan", Master: "eth0", MacvlanMode: "source"},
+			wantErr: true,
+		},
+		{
+			name:   "ipvlan l3 mode",
+			config: args.CNIConfiguration{Mode: "ipvlan", Master: "eth0", IPVlanMode: "l3"},
+			want:   ModeIPVlan,
+		},
+		{
+			name:    "unknown ipvlan mode",
+			config:  args.CNIConfiguration{Mode: "ipvlan", Master: "eth0", IPVlanMode: "l4"},
+			wantErr: true,
+		},
+		{
+			name:   "ptp mode",
+			config: args.CNIConfiguration{Mode: "ptp"},
+			want:   ModePTP,
+		},
+		{
+			name:    "unknown mode",
+			config:  args.CNIConfiguration{Mode: "overlay"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := attachMode(&tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("attachMode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("attachMode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetHostVethName(t *testing.T) {
+	tests := []struct {
+		name    string
+		prefix  string
+		mode    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "default prefix",
+			mode: ModeBridge,
+			want: "veth",
+		},
+		{
+			name:   "custom prefix",
+			prefix: "mcni",
+			mode:   ModePTP,
+			want:   "mcni",
+		},
+		{
+			name: "no host veth",
+			mode: ModeMacvlan,
+		},
+		{
+			name:    "prefix too long",
+			prefix:  "minicni-",
+			mode:    ModeBridge,
+			wantErr: true,
+		},
+		{
+			name:    "invalid prefix",
+			prefix:  "veth/",
+			mode:    ModeBridge,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getHostVethName(&args.CNIConfiguration{VethPrefix: tt.prefix}, tt.mode, "c1", "eth0")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getHostVethName error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.want == "" {
+				if got != "" {
+					t.Errorf("wanted no host veth, got %q", got)
+				}
+				return
+			}
+			if len(got) != 15 || !strings.HasPrefix(got, tt.want) {
+				t.Errorf("wanted 15 characters with prefix %q, got %q", tt.want, got)
+			}
+			if again, _ := getHostVethName(&args.CNIConfiguration{VethPrefix: tt.prefix}, tt.mode, "c1", "eth0"); again != got {
+				t.Errorf("host veth name is not deterministic: %q and %q", got, again)
+			}
+			if other, _ := getHostVethName(&args.CNIConfiguration{VethPrefix: tt.prefix}, tt.mode, "c2", "eth0"); other == got {
+				t.Errorf("host veth names of different containers are the same %q", got)
+			}
+			if other, _ := getHostVethName(&args.CNIConfiguration{VethPrefix: tt.prefix}, tt.mode, "c1e", "th0"); other == got {
+				t.Errorf("host veth names of the containers with the same concatenated ID and interface are the same %q", got)
+			}
+		})
+	}
+}
+
+func TestGetEncapOverhead(t *testing.T) {
+	tests := []struct {
+		encap   string
+		want    int
+		wantErr bool
+	}{
+		{encap: "", want: 0},
+		{encap: EncapNone, want: 0},
+		{encap: EncapVXLAN, want: nettool.VXLANOverhead},
+		{encap: EncapWireGuard, want: nettool.WireGuardOverhead},
+		{encap: "geneve", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.encap, func(t *testing.T) {
+			got, err := getEncapOverhead(&args.CNIConfiguration{Encapsulation: tt.encap})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getEncapOverhead error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getEncapOverhead = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
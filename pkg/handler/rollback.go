@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// rollback keeps the undo actions of the steps of ADD done so far
+type rollback struct {
+	undos []func() error
+	// failAfter is called after each step if it's set, the tests set it to inject failures
+	failAfter func(step string) error
+}
+
+// add registers the undo action of the step about to be done or just done
+func (r *rollback) add(undo func() error) {
+	r.undos = append(r.undos, undo)
+}
+
+// checkpoint marks the step as done, it returns the failure injected by the tests if any
+func (r *rollback) checkpoint(step string) error {
+	if r.failAfter == nil {
+		return nil
+	}
+	return r.failAfter(step)
+}
+
+// run undoes the steps in the reverse order, the cause of the rollback is returned
+// together with the errors of the undo actions if any of them fails.
+func (r *rollback) run(cause error) error {
+	var errs []string
+	for i := len(r.undos) - 1; i >= 0; i-- {
+		if err := r.undos[i](); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	r.undos = nil
+	if len(errs) > 0 {
+		return fmt.Errorf("%v, rollback failed: %s", cause, strings.Join(errs, "; "))
+	}
+	return cause
+}
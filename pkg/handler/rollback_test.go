@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+
+	"github.com/morvencao/minicni/pkg/args"
+	"github.com/morvencao/minicni/pkg/internal/testns"
+)
+
+// linkNames returns the names of the links in the current netns but the loopback
+func linkNames() ([]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, l := range links {
+		if l.Attrs().Name != "lo" {
+			names = append(names, l.Attrs().Name)
+		}
+	}
+	return names, nil
+}
+
+// countNFTablesRules counts the rules in the chains of the minicni tables, the jumps to the host ports
+// chain shared by the containers are not counted as they are kept after the last container is gone.
+func countNFTablesRules() (int, error) {
+	conn := &nftables.Conn{}
+	chains, err := conn.ListChains()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, chain := range chains {
+		if chain.Table.Name != "minicni" {
+			continue
+		}
+		if chain.Table.Family == nftables.TableFamilyINet && (chain.Name == "prerouting" || chain.Name == "output") {
+			continue
+		}
+		rules, err := conn.GetRules(chain.Table, chain)
+		if err != nil {
+			return 0, err
+		}
+		count += len(rules)
+	}
+	return count, nil
+}
+
+func TestHandleAddRollback(t *testing.T) {
+	steps := []string{"bridge", "ip", "block", "spoofcheck", "routes", "sysctls", "announce", "ipmasq", "isolation", "portmappings", "bandwidth"}
+	conf := &args.CNIConfiguration{
+		CniVersion:      "0.4.0",
+		Name:            "minicni",
+		Type:            "minicni",
+		Bridge:          "minicnitest0",
+		Subnet:          "10.244.9.0/24",
+		IPMasq:          true,
+		FirewallBackend: "nftables",
+		NetworkPolicy:   true,
+		SpoofCheck:      true,
+		Isolation:       true,
+		IsolateHost:     true,
+		Sysctl:          map[string]string{"net.core.somaxconn": "1024"},
+		Routes:          []args.Route{{Dst: "172.16.0.0/16"}},
+		RuntimeConfig: args.RuntimeConfig{
+			PortMappings: []args.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+			Bandwidth:    &args.Bandwidth{IngressRate: 1000000, IngressBurst: 100000, EgressRate: 1000000, EgressBurst: 100000},
+		},
+	}
+	testns.Run(t, func() error {
+		for _, failStep := range steps {
+			fh := newTestHandler(t)
+			cmdArgs, err := newPod(t, conf, "rollback", "eth0")
+			if err != nil {
+				return err
+			}
+
+			var done []string
+			err = fh.handleAdd(cmdArgs, func(step string) error {
+				done = append(done, step)
+				if step == failStep {
+					return fmt.Errorf("injected failure")
+				}
+				return nil
+			})
+			if err == nil || err.Error() != "injected failure" {
+				t.Errorf("failing after %s: HandleAdd error = %v, want the injected failure only", failStep, err)
+			}
+			if want := steps[:len(done)]; !reflect.DeepEqual(done, want) || done[len(done)-1] != failStep {
+				t.Errorf("failing after %s: done steps %v", failStep, done)
+			}
+
+			if names, err := linkNames(); err != nil || len(names) > 0 {
+				t.Errorf("failing after %s: links left on host %v (%v)", failStep, names, err)
+			}
+			err = inPod(cmdArgs, func() error {
+				names, err := linkNames()
+				if err != nil || len(names) > 0 {
+					t.Errorf("failing after %s: links left in pod %v (%v)", failStep, names, err)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if count, err := countNFTablesRules(); err != nil || count > 0 {
+				t.Errorf("failing after %s: %d nftables rules left (%v)", failStep, count, err)
+			}
+			content, _ := ioutil.ReadFile(fh.IPStore)
+			if ips := strings.TrimSpace(string(content)); ips != "" {
+				t.Errorf("failing after %s: IPs left reserved %q", failStep, ips)
+			}
+		}
+
+		// nothing is undone if all the steps succeed
+		fh := newTestHandler(t)
+		if _, err := runAdd(t, fh, conf, "rollback", "eth0"); err != nil {
+			return err
+		}
+		if names, err := linkNames(); err != nil || len(names) != 3 {
+			t.Errorf("wanted the bridge, the host veth and the ifb device on host, got %v (%v)", names, err)
+		}
+		content, _ := ioutil.ReadFile(fh.IPStore)
+		if ips := strings.TrimSpace(string(content)); !strings.HasPrefix(ips, "10.244.9.2/24 rollback eth0 ") || strings.Contains(ips, "\n") {
+			t.Errorf("wanted 10.244.9.2/24 reserved, got %q", ips)
+		}
+		return nil
+	})
+}
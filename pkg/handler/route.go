@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/morvencao/minicni/pkg/args"
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+// getRoutes returns the extra routes of the pod in the config, the routes must be of the same
+// family as the subnet, the gateway is left nil if it's not set.
+func getRoutes(cniConfig *args.CNIConfiguration) ([]nettool.PodRoute, error) {
+	if len(cniConfig.Routes) == 0 {
+		return nil, nil
+	}
+	_, subnet, err := net.ParseCIDR(cniConfig.Subnet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse subnet %q: %v", cniConfig.Subnet, err)
+	}
+	ipv4 := subnet.IP.To4() != nil
+	var routes []nettool.PodRoute
+	for _, r := range cniConfig.Routes {
+		_, dst, err := net.ParseCIDR(r.Dst)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination of route %q: %v", r.Dst, err)
+		}
+		if (dst.IP.To4() != nil) != ipv4 {
+			return nil, fmt.Errorf("route to %q is not of the family of subnet %q", r.Dst, cniConfig.Subnet)
+		}
+		var gw net.IP
+		if r.GW != "" {
+			if gw = net.ParseIP(r.GW); gw == nil {
+				return nil, fmt.Errorf("invalid gateway %q of route to %q", r.GW, r.Dst)
+			}
+			if (gw.To4() != nil) != ipv4 {
+				return nil, fmt.Errorf("gateway %q of route to %q is not of the family of subnet %q", r.GW, r.Dst, cniConfig.Subnet)
+			}
+		}
+		if r.Metric < 0 {
+			return nil, fmt.Errorf("invalid metric %d of route to %q", r.Metric, r.Dst)
+		}
+		routes = append(routes, nettool.PodRoute{Dst: dst, GW: gw, Metric: r.Metric})
+	}
+	return routes, nil
+}
+
+// podGateway returns the IP of the default gateway of the pod, nil if the default route
+// goes out of the pod interface directly.
+func podGateway(cniConfig *args.CNIConfiguration, mode, gwIP string) net.IP {
+	if mode == ModeIPVlan && cniConfig.IPVlanMode != "" && cniConfig.IPVlanMode != "l2" {
+		return nil
+	}
+	if ip, _, err := net.ParseCIDR(gwIP); err == nil {
+		return ip
+	}
+	return net.ParseIP(gwIP)
+}
+
+// resultRoutes returns the routes reported in the ADD result
+func resultRoutes(routes []nettool.PodRoute) []*Route {
+	var result []*Route
+	for _, r := range routes {
+		route := &Route{Dst: r.Dst.String()}
+		if r.GW != nil {
+			route.GW = r.GW.String()
+		}
+		result = append(result, route)
+	}
+	return result
+}
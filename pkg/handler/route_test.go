@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/morvencao/minicni/pkg/args"
+)
+
+func TestGetRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		routes  []args.Route
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "no routes",
+			want: "[]",
+		},
+		{
+			name: "routes with and without gateway",
+			routes: []args.Route{
+				{Dst: "172.16.0.0/16", GW: "10.244.1.254", Metric: 100},
+				{Dst: "192.168.100.1/24"},
+			},
+			want: "[{172.16.0.0/16 10.244.1.254 100} {192.168.100.0/24 <nil> 0}]",
+		},
+		{
+			name:    "invalid destination",
+			routes:  []args.Route{{Dst: "172.16.0.0"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid gateway",
+			routes:  []args.Route{{Dst: "172.16.0.0/16", GW: "10.244.1"}},
+			wantErr: true,
+		},
+		{
+			name:    "destination of other family",
+			routes:  []args.Route{{Dst: "fd00::/64"}},
+			wantErr: true,
+		},
+		{
+			name:    "gateway of other family",
+			routes:  []args.Route{{Dst: "172.16.0.0/16", GW: "fd00::1"}},
+			wantErr: true,
+		},
+		{
+			name:    "negative metric",
+			routes:  []args.Route{{Dst: "172.16.0.0/16", Metric: -1}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getRoutes(&args.CNIConfiguration{Subnet: "10.244.1.0/24", Routes: tt.routes})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getRoutes error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && fmt.Sprint(got) != tt.want {
+				t.Errorf("wanted %s, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// conflictTTL is how long the IP that answered the ARP probe is skipped before it's probed again
+const conflictTTL = 10 * time.Minute
+
+// allocation is the record of the IP store for the IP reserved for the interface of the container,
+// the records written by the older versions have the IP only.
+type allocation struct {
+	IP          string
+	ContainerID string
+	IfName      string
+	// HostVeth is the name of the host veth of the interface, it's empty if the mode has none
+	HostVeth string
+}
+
+// parseAllocations parses the records of the IP store, one per line with the fields separated by spaces
+func parseAllocations(content string) []allocation {
+	var allocs []allocation
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		fields = append(fields, "", "", "")
+		allocs = append(allocs, allocation{IP: fields[0], ContainerID: fields[1], IfName: fields[2], HostVeth: fields[3]})
+	}
+	return allocs
+}
+
+// formatAllocations returns the content of the IP store with the records
+func formatAllocations(allocs []allocation) []byte {
+	lines := make([]string, 0, len(allocs))
+	for _, a := range allocs {
+		lines = append(lines, strings.TrimSpace(strings.Join([]string{a.IP, a.ContainerID, a.IfName, a.HostVeth}, " ")))
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// allocatedIPs returns the IPs of the records
+func allocatedIPs(allocs []allocation) []string {
+	ips := make([]string, 0, len(allocs))
+	for _, a := range allocs {
+		ips = append(ips, a.IP)
+	}
+	return ips
+}
+
+// findAllocation returns the index of the record of the interface of the container, -1 if there is none
+func findAllocation(allocs []allocation, containerID, ifName string) int {
+	for i, a := range allocs {
+		if a.ContainerID == containerID && a.IfName == ifName {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasContainerAllocation returns true if any interface of the container has a record
+func hasContainerAllocation(allocs []allocation, containerID string) bool {
+	for _, a := range allocs {
+		if a.ContainerID == containerID {
+			return true
+		}
+	}
+	return false
+}
+
+// conflict is the record of the conflict store for the IP that answered the ARP probe when it was last seen
+type conflict struct {
+	IP   string
+	Seen time.Time
+}
+
+// parseConflicts parses the records of the conflict store, one per line with the IP and the unix time
+// it was last seen. The records written by the older versions have the IP only and count as expired.
+func parseConflicts(content string) []conflict {
+	var conflicts []conflict
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		c := conflict{IP: fields[0]}
+		if len(fields) > 1 {
+			if seen, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				c.Seen = time.Unix(seen, 0)
+			}
+		}
+		conflicts = append(conflicts, c)
+	}
+	return conflicts
+}
+
+// formatConflicts returns the content of the conflict store with the records
+func formatConflicts(conflicts []conflict) []byte {
+	lines := make([]string, 0, len(conflicts))
+	for _, c := range conflicts {
+		lines = append(lines, fmt.Sprintf("%s %d", c.IP, c.Seen.Unix()))
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// activeConflicts returns the conflicts seen within the TTL before now
+func activeConflicts(conflicts []conflict, now time.Time) []conflict {
+	var active []conflict
+	for _, c := range conflicts {
+		if now.Sub(c.Seen) < conflictTTL {
+			active = append(active, c)
+		}
+	}
+	return active
+}
+
+// hasConflict returns true if the IP has a conflict record
+func hasConflict(conflicts []conflict, ip string) bool {
+	for _, c := range conflicts {
+		if c.IP == ip {
+			return true
+		}
+	}
+	return false
+}
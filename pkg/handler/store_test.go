@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAllocations(t *testing.T) {
+	content := "10.244.1.2/24\n\n10.244.1.3/24 c1 eth0 veth1234567890a\n10.244.1.4/24 c2 net1\n"
+	want := []allocation{
+		{IP: "10.244.1.2/24"},
+		{IP: "10.244.1.3/24", ContainerID: "c1", IfName: "eth0", HostVeth: "veth1234567890a"},
+		{IP: "10.244.1.4/24", ContainerID: "c2", IfName: "net1"},
+	}
+	allocs := parseAllocations(content)
+	if !reflect.DeepEqual(allocs, want) {
+		t.Fatalf("parseAllocations = %+v, want %+v", allocs, want)
+	}
+	if got := string(formatAllocations(allocs)); got != "10.244.1.2/24\n10.244.1.3/24 c1 eth0 veth1234567890a\n10.244.1.4/24 c2 net1" {
+		t.Errorf("formatAllocations = %q", got)
+	}
+	if got := parseAllocations(string(formatAllocations(allocs))); !reflect.DeepEqual(got, want) {
+		t.Errorf("records are not kept through format and parse: %+v", got)
+	}
+	if got := allocatedIPs(allocs); !reflect.DeepEqual(got, []string{"10.244.1.2/24", "10.244.1.3/24", "10.244.1.4/24"}) {
+		t.Errorf("allocatedIPs = %v", got)
+	}
+	for _, tt := range []struct {
+		containerID, ifName string
+		want                int
+	}{
+		{"c1", "eth0", 1},
+		{"c2", "net1", 2},
+		{"c2", "eth0", -1},
+	} {
+		if got := findAllocation(allocs, tt.containerID, tt.ifName); got != tt.want {
+			t.Errorf("findAllocation(%s, %s) = %d, want %d", tt.containerID, tt.ifName, got, tt.want)
+		}
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	content := "10.244.1.2/24\n10.244.1.3/24 1699999900\n\n10.244.1.4/24 1699990000\n"
+	conflicts := parseConflicts(content)
+	want := []conflict{
+		{IP: "10.244.1.2/24"},
+		{IP: "10.244.1.3/24", Seen: time.Unix(1699999900, 0)},
+		{IP: "10.244.1.4/24", Seen: time.Unix(1699990000, 0)},
+	}
+	if !reflect.DeepEqual(conflicts, want) {
+		t.Fatalf("parseConflicts = %+v, want %+v", conflicts, want)
+	}
+	// the records without time and the ones seen before the TTL are expired
+	active := activeConflicts(conflicts, now)
+	if !reflect.DeepEqual(active, want[1:2]) {
+		t.Errorf("activeConflicts = %+v, want %+v", active, want[1:2])
+	}
+	if !hasConflict(active, "10.244.1.3/24") || hasConflict(active, "10.244.1.4/24") {
+		t.Errorf("hasConflict doesn't match the active conflicts %+v", active)
+	}
+	if got := parseConflicts(string(formatConflicts(active))); !reflect.DeepEqual(got, active) {
+		t.Errorf("records are not kept through format and parse: %+v", got)
+	}
+}
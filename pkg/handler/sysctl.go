@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/morvencao/minicni/pkg/args"
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+const (
+	// HostSettingsCheck fails the ADD if the host sysctls the pod network relies on are not set
+	HostSettingsCheck = "check"
+	// HostSettingsEnable sets the host sysctls the pod network relies on
+	HostSettingsEnable = "enable"
+)
+
+// SysctlAnnotation is the pod annotation passed in CNI_ARGS that sets the sysctls in the pod netns,
+// in the format of "net.core.somaxconn=1024,net.ipv4.tcp_fin_timeout=15"
+const SysctlAnnotation = "minicni.io/sysctls"
+
+// safeSysctls are the network sysctls that are namespaced, setting them in the pod netns doesn't affect the host
+var safeSysctls = map[string]bool{
+	"net.core.somaxconn":                  true,
+	"net.ipv4.ip_default_ttl":             true,
+	"net.ipv4.ip_local_port_range":        true,
+	"net.ipv4.ip_no_pmtu_disc":            true,
+	"net.ipv4.ip_unprivileged_port_start": true,
+	"net.ipv4.ping_group_range":           true,
+	"net.ipv4.tcp_congestion_control":     true,
+	"net.ipv4.tcp_fastopen":               true,
+	"net.ipv4.tcp_fin_timeout":            true,
+	"net.ipv4.tcp_keepalive_intvl":        true,
+	"net.ipv4.tcp_keepalive_probes":       true,
+	"net.ipv4.tcp_keepalive_time":         true,
+	"net.ipv4.tcp_max_syn_backlog":        true,
+	"net.ipv4.tcp_max_tw_buckets":         true,
+	"net.ipv4.tcp_mtu_probing":            true,
+	"net.ipv4.tcp_notsent_lowat":          true,
+	"net.ipv4.tcp_retries1":               true,
+	"net.ipv4.tcp_retries2":               true,
+	"net.ipv4.tcp_rmem":                   true,
+	"net.ipv4.tcp_sack":                   true,
+	"net.ipv4.tcp_slow_start_after_idle":  true,
+	"net.ipv4.tcp_syn_retries":            true,
+	"net.ipv4.tcp_synack_retries":         true,
+	"net.ipv4.tcp_syncookies":             true,
+	"net.ipv4.tcp_timestamps":             true,
+	"net.ipv4.tcp_tw_reuse":               true,
+	"net.ipv4.tcp_window_scaling":         true,
+	"net.ipv4.tcp_wmem":                   true,
+}
+
+// interfaceSysctl matches the sysctls of the interfaces in the pod netns, the interface name
+// is restricted so that the key can't escape the directory of the interface
+var interfaceSysctl = regexp.MustCompile(`^net\.ipv[46]\.conf\.[a-zA-Z0-9_@-]{1,15}\.[a-z0-9_]+$`)
+
+// getSysctls returns the sysctls of the pod, the pod annotation takes precedence over the config,
+// the sysctls which are not known to be namespaced are rejected.
+func getSysctls(cniConfig *args.CNIConfiguration, cniArgs map[string]string) (map[string]string, error) {
+	sysctls := map[string]string{}
+	for key, value := range cniConfig.Sysctl {
+		sysctls[key] = value
+	}
+	if cniArgs[SysctlAnnotation] != "" {
+		for _, pair := range strings.Split(cniArgs[SysctlAnnotation], ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid %s: %q is not in the format of key=value", SysctlAnnotation, pair)
+			}
+			sysctls[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	for key, value := range sysctls {
+		if !safeSysctls[key] && !interfaceSysctl.MatchString(key) {
+			return nil, fmt.Errorf("sysctl %q is not allowed", key)
+		}
+		if value == "" || strings.ContainsAny(value, "\n") {
+			return nil, fmt.Errorf("invalid value %q of sysctl %q", value, key)
+		}
+	}
+	return sysctls, nil
+}
+
+// getHostSettings validates what to do with the host sysctls, it's empty if they are left alone
+func getHostSettings(cniConfig *args.CNIConfiguration) (string, error) {
+	switch cniConfig.HostSettings {
+	case "", HostSettingsCheck, HostSettingsEnable:
+		return cniConfig.HostSettings, nil
+	default:
+		return "", fmt.Errorf("unknown hostSettings: %q", cniConfig.HostSettings)
+	}
+}
+
+// hostSysctls returns the host sysctls the pods of the mode rely on, the pod traffic is forwarded by
+// the host in bridge and ptp modes and filtered on the bridge in bridge mode.
+func hostSysctls(mode, bridge string, ipv4 bool) []nettool.HostSysctl {
+	var sysctls []nettool.HostSysctl
+	if mode == ModeBridge || mode == ModePTP {
+		sysctls = append(sysctls, nettool.ForwardingSysctls(ipv4)...)
+	}
+	if mode == ModeBridge {
+		sysctls = append(sysctls, nettool.BridgeSysctls(bridge, ipv4)...)
+	}
+	return sysctls
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/morvencao/minicni/pkg/args"
+	"github.com/morvencao/minicni/pkg/nettool"
+)
+
+func TestGetSysctls(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]string
+		cniArgs map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "no sysctls",
+			want: map[string]string{},
+		},
+		{
+			name:   "config",
+			config: map[string]string{"net.core.somaxconn": "1024", "net.ipv4.conf.eth0.rp_filter": "2"},
+			want:   map[string]string{"net.core.somaxconn": "1024", "net.ipv4.conf.eth0.rp_filter": "2"},
+		},
+		{
+			name:    "annotation takes precedence over config",
+			config:  map[string]string{"net.core.somaxconn": "1024", "net.ipv4.tcp_fin_timeout": "30"},
+			cniArgs: map[string]string{SysctlAnnotation: "net.core.somaxconn=4096, net.ipv4.ip_local_port_range=1024 65535"},
+			want:    map[string]string{"net.core.somaxconn": "4096", "net.ipv4.tcp_fin_timeout": "30", "net.ipv4.ip_local_port_range": "1024 65535"},
+		},
+		{
+			name:    "invalid annotation",
+			cniArgs: map[string]string{SysctlAnnotation: "net.core.somaxconn"},
+			wantErr: true,
+		},
+		{
+			name:    "global sysctl",
+			config:  map[string]string{"net.ipv4.tcp_mem": "1 2 3"},
+			wantErr: true,
+		},
+		{
+			name:    "non network sysctl",
+			cniArgs: map[string]string{SysctlAnnotation: "kernel.shm_rmid_forced=1"},
+			wantErr: true,
+		},
+		{
+			name:    "escaping interface sysctl",
+			config:  map[string]string{"net.ipv4.conf.//.rp_filter": "1"},
+			wantErr: true,
+		},
+		{
+			name:    "empty value",
+			config:  map[string]string{"net.core.somaxconn": ""},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getSysctls(&args.CNIConfiguration{Sysctl: tt.config}, tt.cniArgs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getSysctls error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("wanted %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHostSysctls(t *testing.T) {
+	keys := func(sysctls []nettool.HostSysctl) []string {
+		var keys []string
+		for _, s := range sysctls {
+			keys = append(keys, s.Key)
+		}
+		return keys
+	}
+	tests := []struct {
+		mode string
+		ipv4 bool
+		want []string
+	}{
+		{mode: ModeBridge, ipv4: true, want: []string{"net.ipv4.ip_forward", "net.bridge.bridge-nf-call-iptables", "net.ipv4.conf.cni0.rp_filter"}},
+		{mode: ModeBridge, ipv4: false, want: []string{"net.ipv6.conf.all.forwarding", "net.bridge.bridge-nf-call-ip6tables"}},
+		{mode: ModePTP, ipv4: true, want: []string{"net.ipv4.ip_forward"}},
+		{mode: ModeMacvlan, ipv4: true},
+	}
+	for _, tt := range tests {
+		if got := keys(hostSysctls(tt.mode, "cni0", tt.ipv4)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("hostSysctls(%s, ipv4=%v) = %v, want %v", tt.mode, tt.ipv4, got, tt.want)
+		}
+	}
+	if _, err := getHostSettings(&args.CNIConfiguration{HostSettings: "fix"}); err == nil {
+		t.Errorf("unknown hostSettings is accepted")
+	}
+}
@@ -0,0 +1,40 @@
+// Package testns provides the network namespace fixtures shared by the tests of minicni
+package testns
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+)
+
+// Run runs the test function in a throwaway network namespace, the test is skipped without root privileges
+func Run(t *testing.T, f func() error) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("test requires root privileges")
+	}
+	testNS, err := New(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testNS.Do(func(ns.NetNS) error { return f() }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// New creates the network namespace which is closed and unmounted at the end of the test
+func New(t *testing.T) (ns.NetNS, error) {
+	t.Helper()
+	netns, err := testutils.NewNS()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create test netns: %v", err)
+	}
+	t.Cleanup(func() {
+		netns.Close()
+		_ = testutils.UnmountNS(netns)
+	})
+	return netns, nil
+}
@@ -0,0 +1,131 @@
+package nettool
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ethernetBroadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	// ipv6AllNodes is ff02::1 and ipv6AllNodesMAC is the ethernet multicast address it maps to
+	ipv6AllNodes    = net.ParseIP("ff02::1")
+	ipv6AllNodesMAC = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+)
+
+// AnnounceAddress sends gratuitous ARPs for IPv4 or unsolicited neighbor advertisements for IPv6
+// from the interface in container netns, so the neighbors drop the MAC cached for the reused IP.
+func AnnounceAddress(netns ns.NetNS, ifName, ip string, count int, interval time.Duration) error {
+	ipaddr, _, err := net.ParseCIDR(ip)
+	if err != nil {
+		return fmt.Errorf("failed to parse ip address %q: %v", ip, err)
+	}
+	err = netns.Do(func(_ ns.NetNS) error {
+		ifi, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup interface %q in %q: %v", ifName, netns.Path(), err)
+		}
+		var frame []byte
+		if ip4 := ipaddr.To4(); ip4 != nil {
+			frame = arpFrame(ifi.HardwareAddr, ip4, ip4)
+		} else {
+			frame = unsolicitedNAFrame(ifi.HardwareAddr, ipaddr)
+		}
+		return sendFrames(ifi, frame, count, interval)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to announce address %q on %q: %v", ip, ifName, err)
+	}
+	return nil
+}
+
+// sendFrames sends the ethernet frame out of the interface count times
+func sendFrames(ifi *net.Interface, frame []byte, count int, interval time.Duration) error {
+	// protocol 0 makes the socket send only, no frames are queued to it
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	defer unix.Close(fd)
+
+	addr := &unix.SockaddrLinklayer{Ifindex: ifi.Index}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		if err := unix.Sendto(fd, frame, 0, addr); err != nil {
+			return fmt.Errorf("failed to send frame: %v", err)
+		}
+	}
+	return nil
+}
+
+// arpFrame builds the broadcast ARP request from the sender for the target, the sender
+// is the target in the gratuitous ARP and unspecified in the ARP probe.
+func arpFrame(mac net.HardwareAddr, sender, target net.IP) []byte {
+	b := make([]byte, 14+28)
+	copy(b[0:6], ethernetBroadcast)
+	copy(b[6:12], mac)
+	binary.BigEndian.PutUint16(b[12:14], unix.ETH_P_ARP)
+
+	arp := b[14:]
+	binary.BigEndian.PutUint16(arp[0:2], 1) // ethernet
+	binary.BigEndian.PutUint16(arp[2:4], unix.ETH_P_IP)
+	arp[4], arp[5] = 6, 4
+	binary.BigEndian.PutUint16(arp[6:8], 1) // request
+	copy(arp[8:14], mac)
+	copy(arp[14:18], sender.To4())
+	copy(arp[24:28], target.To4())
+	return b
+}
+
+// unsolicitedNAFrame builds the neighbor advertisement of the IP to all nodes with the override flag
+func unsolicitedNAFrame(mac net.HardwareAddr, ip net.IP) []byte {
+	b := make([]byte, 14+40+32)
+	copy(b[0:6], ipv6AllNodesMAC)
+	copy(b[6:12], mac)
+	binary.BigEndian.PutUint16(b[12:14], unix.ETH_P_IPV6)
+
+	ip6 := b[14:54]
+	ip6[0] = 6 << 4
+	binary.BigEndian.PutUint16(ip6[4:6], 32)
+	ip6[6] = unix.IPPROTO_ICMPV6
+	// neighbor discovery messages must have the hop limit 255
+	ip6[7] = 255
+	copy(ip6[8:24], ip.To16())
+	copy(ip6[24:40], ipv6AllNodes)
+
+	na := b[54:]
+	na[0] = 136  // neighbor advertisement
+	na[4] = 0x20 // override
+	copy(na[8:24], ip.To16())
+	na[24], na[25] = 2, 1 // target link-layer address option of 8 bytes
+	copy(na[26:32], mac)
+	binary.BigEndian.PutUint16(na[2:4], icmpv6Checksum(ip6[8:24], ip6[24:40], na))
+	return b
+}
+
+// icmpv6Checksum computes the checksum of the ICMPv6 message with the IPv6 pseudo header
+func icmpv6Checksum(src, dst, msg []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(src)
+	add(dst)
+	sum += uint32(len(msg)) + unix.IPPROTO_ICMPV6
+	add(msg)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
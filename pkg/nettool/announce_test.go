@@ -0,0 +1,125 @@
+package nettool
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+)
+
+// newPodNS creates the container netns with its veth attached to the bridge
+func newPodNS(t *testing.T, br *netlink.Bridge, ip, gwip string) (ns.NetNS, error) {
+	podNS, err := testns.New(t)
+	if err != nil {
+		return nil, err
+	}
+	ipaddr, _, err := net.ParseCIDR(ip)
+	if err != nil {
+		return nil, err
+	}
+	mac, err := MACFromIP(ipaddr)
+	if err != nil {
+		return nil, err
+	}
+	hostVethName := HostVethName("veth", ip, "eth0")
+	if err := SetupVeth(podNS, br, "eth0", hostVethName, ip, gwip, mac, 1500, true); err != nil {
+		return nil, err
+	}
+	return podNS, WaitBridgePortForwarding(hostVethName, 5*time.Second)
+}
+
+func TestAnnounceAddress(t *testing.T) {
+	tests := []struct {
+		name   string
+		gwIP   string
+		pod1IP string
+		pod2IP string
+		family int
+	}{
+		{
+			name:   "gratuitous ARP",
+			gwIP:   "10.10.0.1/24",
+			pod1IP: "10.10.0.2/24",
+			pod2IP: "10.10.0.3/24",
+			family: netlink.FAMILY_V4,
+		},
+		{
+			name:   "unsolicited neighbor advertisement",
+			gwIP:   "fd00:10::1/64",
+			pod1IP: "fd00:10::2/64",
+			pod2IP: "fd00:10::3/64",
+			family: netlink.FAMILY_V6,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testns.Run(t, func() error {
+				br, err := CreateOrUpdateBridge("testbr0", tt.gwIP, 1500)
+				if err != nil {
+					return err
+				}
+				pod1NS, err := newPodNS(t, br, tt.pod1IP, tt.gwIP)
+				if err != nil {
+					return err
+				}
+				pod2NS, err := newPodNS(t, br, tt.pod2IP, tt.gwIP)
+				if err != nil {
+					return err
+				}
+
+				pod2IP, _, _ := net.ParseCIDR(tt.pod2IP)
+				pod2MAC, _ := MACFromIP(pod2IP)
+				staleMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+
+				// pod1 has cached the MAC of the previous owner of pod2 IP
+				err = pod1NS.Do(func(ns.NetNS) error {
+					link, err := netlink.LinkByName("eth0")
+					if err != nil {
+						return err
+					}
+					return netlink.NeighAdd(&netlink.Neigh{
+						LinkIndex:    link.Attrs().Index,
+						Family:       tt.family,
+						State:        netlink.NUD_STALE,
+						IP:           pod2IP,
+						HardwareAddr: staleMAC,
+					})
+				})
+				if err != nil {
+					return fmt.Errorf("failed to add stale neighbor: %v", err)
+				}
+
+				if err := AnnounceAddress(pod2NS, "eth0", tt.pod2IP, 2, 10*time.Millisecond); err != nil {
+					return err
+				}
+
+				return pod1NS.Do(func(ns.NetNS) error {
+					link, err := netlink.LinkByName("eth0")
+					if err != nil {
+						return err
+					}
+					var neighs []netlink.Neigh
+					for i := 0; i < 50; i++ {
+						neighs, err = netlink.NeighList(link.Attrs().Index, tt.family)
+						if err != nil {
+							return err
+						}
+						for _, n := range neighs {
+							if n.IP.Equal(pod2IP) && n.HardwareAddr.String() == pod2MAC.String() {
+								return nil
+							}
+						}
+						time.Sleep(20 * time.Millisecond)
+					}
+					return fmt.Errorf("neighbor %s was not updated to %s: %v", pod2IP, pod2MAC, neighs)
+				})
+			})
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package nettool
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const latencyInMillis = 25
+
+// IfbDeviceName returns the name of the ifb device that shapes the traffic from the container interface
+func IfbDeviceName(containerID, ifName string) string {
+	h := sha256.Sum256([]byte(containerID + "\x00" + ifName))
+	return fmt.Sprintf("mcbw%x", h[:5])
+}
+
+// SetupIngressBandwidth limits the traffic to the container with a tbf qdisc on the host veth
+func SetupIngressBandwidth(hostVethName string, rateInBits, burstInBits uint64) error {
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup hostveth %q: %v", hostVethName, err)
+	}
+	if err := createTBF(rateInBits, burstInBits, hostVeth.Attrs().Index); err != nil {
+		return fmt.Errorf("failed to limit ingress bandwidth on %q: %v", hostVethName, err)
+	}
+	return nil
+}
+
+// SetupEgressBandwidth limits the traffic from the container, the traffic coming in the host veth
+// is redirected to an ifb device whose egress is shaped by a tbf qdisc.
+func SetupEgressBandwidth(hostVethName, ifbName string, rateInBits, burstInBits uint64, mtu int) error {
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup hostveth %q: %v", hostVethName, err)
+	}
+	// the ifb device left by a DEL that never ran is named after the same container
+	if err := DeleteLink(ifbName); err != nil {
+		return err
+	}
+	ifb := &netlink.Ifb{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:  ifbName,
+			Flags: net.FlagUp,
+			MTU:   mtu,
+		},
+	}
+	if err := netlink.LinkAdd(ifb); err != nil {
+		return fmt.Errorf("failed to create ifb device %q: %v", ifbName, err)
+	}
+	ifbLink, err := netlink.LinkByName(ifbName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup ifb device %q: %v", ifbName, err)
+	}
+
+	// add ingress qdisc on host veth
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: hostVeth.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err := netlink.QdiscAdd(ingress); err != nil {
+		return fmt.Errorf("failed to add ingress qdisc on %q: %v", hostVethName, err)
+	}
+
+	// redirect all the traffic coming in the host veth to the ifb device
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: hostVeth.Attrs().Index,
+			Parent:    ingress.QdiscAttrs.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId:    netlink.MakeHandle(1, 1),
+		RedirIndex: ifbLink.Attrs().Index,
+		Actions: []netlink.Action{
+			&netlink.MirredAction{
+				MirredAction: netlink.TCA_EGRESS_REDIR,
+				Ifindex:      ifbLink.Attrs().Index,
+			},
+		},
+	}
+	if err := netlink.FilterAdd(filter); err != nil {
+		return fmt.Errorf("failed to redirect traffic from %q to %q: %v", hostVethName, ifbName, err)
+	}
+
+	if err := createTBF(rateInBits, burstInBits, ifbLink.Attrs().Index); err != nil {
+		return fmt.Errorf("failed to limit egress bandwidth on %q: %v", ifbName, err)
+	}
+	return nil
+}
+
+// TeardownBandwidth removes the qdiscs from the host veth and deletes the ifb device,
+// the host veth may be gone together with the container netns already.
+func TeardownBandwidth(hostVethName, ifbName string) error {
+	if hostVethName != "" {
+		hostVeth, err := netlink.LinkByName(hostVethName)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); !ok {
+				return fmt.Errorf("failed to lookup hostveth %q: %v", hostVethName, err)
+			}
+		} else {
+			qdiscs, err := netlink.QdiscList(hostVeth)
+			if err != nil {
+				return fmt.Errorf("failed to list qdiscs of %q: %v", hostVethName, err)
+			}
+			for _, q := range qdiscs {
+				switch q.(type) {
+				case *netlink.Tbf, *netlink.Ingress:
+					if err := netlink.QdiscDel(q); err != nil {
+						return fmt.Errorf("failed to delete qdisc %v of %q: %v", q, hostVethName, err)
+					}
+				}
+			}
+		}
+	}
+
+	ifb, err := netlink.LinkByName(ifbName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to lookup ifb device %q: %v", ifbName, err)
+	}
+	if err := netlink.LinkDel(ifb); err != nil {
+		return fmt.Errorf("failed to delete ifb device %q: %v", ifbName, err)
+	}
+	return nil
+}
+
+// createTBF adds the root tbf qdisc with the rate and the burst to the link
+func createTBF(rateInBits, burstInBits uint64, linkIndex int) error {
+	if rateInBits == 0 {
+		return fmt.Errorf("invalid rate: %d", rateInBits)
+	}
+	if burstInBits == 0 {
+		return fmt.Errorf("invalid burst: %d", burstInBits)
+	}
+	rateInBytes := rateInBits / 8
+	burstInBytes := burstInBits / 8
+	bufferInBytes := buffer(rateInBytes, uint32(burstInBytes))
+	latency := latencyInUsec(latencyInMillis)
+	limitInBytes := limit(rateInBytes, latency, uint32(burstInBytes))
+
+	qdisc := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Limit:  limitInBytes,
+		Rate:   rateInBytes,
+		Buffer: bufferInBytes,
+	}
+	return netlink.QdiscAdd(qdisc)
+}
+
+func time2Tick(time uint32) uint32 {
+	return uint32(float64(time) * float64(netlink.TickInUsec()))
+}
+
+func buffer(rate uint64, burst uint32) uint32 {
+	return time2Tick(uint32(float64(burst) * float64(netlink.TIME_UNITS_PER_SEC) / float64(rate)))
+}
+
+func limit(rate uint64, latency float64, buffer uint32) uint32 {
+	return uint32(float64(rate)*latency/float64(netlink.TIME_UNITS_PER_SEC)) + buffer
+}
+
+func latencyInUsec(latencyInMillis float64) float64 {
+	return float64(netlink.TIME_UNITS_PER_SEC) * (latencyInMillis / 1000.0)
+}
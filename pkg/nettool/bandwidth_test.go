@@ -0,0 +1,111 @@
+package nettool
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+)
+
+// qdiscsOf returns the tbf and the ingress qdiscs of the link
+func qdiscsOf(name string) (tbf *netlink.Tbf, ingress *netlink.Ingress, err error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, q := range qdiscs {
+		switch q := q.(type) {
+		case *netlink.Tbf:
+			tbf = q
+		case *netlink.Ingress:
+			ingress = q
+		}
+	}
+	return tbf, ingress, nil
+}
+
+func TestBandwidth(t *testing.T) {
+	testns.Run(t, func() error {
+		hostVeth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "mcbwveth", MTU: 1500}, PeerName: "mcbwpeer"}
+		if err := netlink.LinkAdd(hostVeth); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(hostVeth); err != nil {
+			return err
+		}
+		ifbName := IfbDeviceName("pod0", "eth0")
+		if other := IfbDeviceName("pod0e", "th0"); other == ifbName {
+			t.Errorf("ifb device names of different container interfaces are the same %q", ifbName)
+		}
+		// the ifb device of an earlier sandbox of the container is left behind
+		if err := netlink.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: ifbName}}); err != nil {
+			return err
+		}
+
+		if err := SetupIngressBandwidth("mcbwveth", 0, 8000); err == nil {
+			t.Errorf("SetupIngressBandwidth accepted a zero rate")
+		}
+		if err := SetupIngressBandwidth("mcbwveth", 8000000, 800000); err != nil {
+			return fmt.Errorf("SetupIngressBandwidth error = %v", err)
+		}
+		if err := SetupEgressBandwidth("mcbwveth", ifbName, 16000000, 1600000, 1500); err != nil {
+			return fmt.Errorf("SetupEgressBandwidth error = %v", err)
+		}
+
+		// the traffic to the pod is shaped on the host veth, the traffic from it on the ifb device
+		tbf, ingress, err := qdiscsOf("mcbwveth")
+		if err != nil {
+			return err
+		}
+		if tbf == nil || tbf.Rate != 1000000 {
+			t.Errorf("wanted tbf qdisc of 1000000 bytes/s on the host veth, got %+v", tbf)
+		}
+		if ingress == nil {
+			t.Errorf("no ingress qdisc on the host veth")
+		}
+		link, err := netlink.LinkByName("mcbwveth")
+		if err != nil {
+			return err
+		}
+		filters, err := netlink.FilterList(link, netlink.MakeHandle(0xffff, 0))
+		if err != nil {
+			return err
+		}
+		ifb, err := netlink.LinkByName(ifbName)
+		if err != nil {
+			return fmt.Errorf("ifb device is not created: %v", err)
+		}
+		if len(filters) != 1 {
+			t.Errorf("wanted 1 filter on the host veth, got %+v", filters)
+		} else if u32, ok := filters[0].(*netlink.U32); !ok || u32.RedirIndex != ifb.Attrs().Index {
+			t.Errorf("wanted the traffic of the host veth redirected to the ifb device, got %+v", filters)
+		}
+		if tbf, _, err := qdiscsOf(ifbName); err != nil || tbf == nil || tbf.Rate != 2000000 {
+			t.Errorf("wanted tbf qdisc of 2000000 bytes/s on the ifb device, got %+v (%v)", tbf, err)
+		}
+
+		// tearing down twice is not an error
+		for i := 0; i < 2; i++ {
+			if err := TeardownBandwidth("mcbwveth", ifbName); err != nil {
+				return fmt.Errorf("TeardownBandwidth error = %v", err)
+			}
+		}
+		if tbf, ingress, err := qdiscsOf("mcbwveth"); err != nil || tbf != nil || ingress != nil {
+			t.Errorf("qdiscs left on the host veth: tbf %+v ingress %+v (%v)", tbf, ingress, err)
+		}
+		if _, err := netlink.LinkByName(ifbName); err == nil {
+			t.Errorf("ifb device still exists after teardown")
+		}
+		// the host veth is gone with the container netns
+		if err := TeardownBandwidth("missing", ifbName); err != nil {
+			t.Errorf("TeardownBandwidth without host veth error = %v", err)
+		}
+		return nil
+	})
+}
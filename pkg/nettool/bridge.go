@@ -0,0 +1,202 @@
+package nettool
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// brStateForwarding is the STP state of the bridge port that forwards the frames
+const brStateForwarding = 3
+
+// BridgePortOptions are the flags of the port attached to the bridge
+type BridgePortOptions struct {
+	// Hairpin allows the frames to be sent back out the port they came in
+	Hairpin bool
+	// Isolated ports can only talk to the non-isolated ports of the bridge
+	Isolated bool
+	// Learning learns the source addresses of the frames into the forwarding database
+	Learning bool
+	// Flood floods the unicast frames with unknown destination to the port
+	Flood bool
+	// Guard drops the STP BPDU frames coming in the port
+	Guard bool
+}
+
+// SetBridgePortOptions sets all the flags of the bridge port in a single request,
+// port isolation is not supported by the setters of netlink library.
+func SetBridgePortOptions(linkName string, opts *BridgePortOptions) error {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup bridge port %q: %v", linkName, err)
+	}
+	req := nl.NewNetlinkRequest(unix.RTM_SETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_BRIDGE)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	protinfo := nl.NewRtAttr(unix.IFLA_PROTINFO|unix.NLA_F_NESTED, nil)
+	protinfo.AddRtAttr(unix.IFLA_BRPORT_MODE, boolAttr(opts.Hairpin))
+	protinfo.AddRtAttr(unix.IFLA_BRPORT_ISOLATED, boolAttr(opts.Isolated))
+	protinfo.AddRtAttr(unix.IFLA_BRPORT_LEARNING, boolAttr(opts.Learning))
+	protinfo.AddRtAttr(unix.IFLA_BRPORT_UNICAST_FLOOD, boolAttr(opts.Flood))
+	protinfo.AddRtAttr(unix.IFLA_BRPORT_GUARD, boolAttr(opts.Guard))
+	req.AddData(protinfo)
+
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to set bridge port options for %q: %v", linkName, err)
+	}
+	return nil
+}
+
+// GetBridgePortOptions returns the flags of the bridge port
+func GetBridgePortOptions(link netlink.Link) (*BridgePortOptions, error) {
+	infos, err := bridgePortInfo(link)
+	if err != nil {
+		return nil, err
+	}
+	opts := &BridgePortOptions{}
+	for _, i := range infos {
+		switch i.Attr.Type {
+		case unix.IFLA_BRPORT_MODE:
+			opts.Hairpin = i.Value[0] == 1
+		case unix.IFLA_BRPORT_ISOLATED:
+			opts.Isolated = i.Value[0] == 1
+		case unix.IFLA_BRPORT_LEARNING:
+			opts.Learning = i.Value[0] == 1
+		case unix.IFLA_BRPORT_UNICAST_FLOOD:
+			opts.Flood = i.Value[0] == 1
+		case unix.IFLA_BRPORT_GUARD:
+			opts.Guard = i.Value[0] == 1
+		}
+	}
+	return opts, nil
+}
+
+// WaitBridgePortForwarding waits for the bridge port to forward the frames, the kernel
+// enables the port a while after the carrier of the link is on.
+func WaitBridgePortForwarding(linkName string, timeout time.Duration) error {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup bridge port %q: %v", linkName, err)
+	}
+	for deadline := time.Now().Add(timeout); ; time.Sleep(10 * time.Millisecond) {
+		infos, err := bridgePortInfo(link)
+		if err != nil {
+			return err
+		}
+		for _, i := range infos {
+			if i.Attr.Type == unix.IFLA_BRPORT_STATE && i.Value[0] == brStateForwarding {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("bridge port %q is not forwarding after %v", linkName, timeout)
+		}
+	}
+}
+
+// bridgePortInfo returns the protinfo attributes of the link attached to a bridge
+func bridgePortInfo(link netlink.Link) ([]syscall.NetlinkRouteAttr, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_DUMP)
+	req.AddData(nl.NewIfInfomsg(unix.AF_BRIDGE))
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump bridge ports: %v", err)
+	}
+	for _, m := range msgs {
+		info := nl.DeserializeIfInfomsg(m)
+		if int(info.Index) != link.Attrs().Index {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[info.Len():])
+		if err != nil {
+			return nil, err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type == unix.IFLA_PROTINFO|unix.NLA_F_NESTED {
+				return nl.ParseRouteAttr(attr.Value)
+			}
+		}
+	}
+	return nil, fmt.Errorf("link %q is not attached to a bridge", link.Attrs().Name)
+}
+
+// CheckBridgePort checks the link is attached to the bridge with the expected flags
+func CheckBridgePort(linkName, brName string, opts *BridgePortOptions) error {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup bridge port %q: %v", linkName, err)
+	}
+	br, err := netlink.LinkByName(brName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup bridge %q: %v", brName, err)
+	}
+	if link.Attrs().MasterIndex != br.Attrs().Index {
+		return fmt.Errorf("link %q is not attached to bridge %q", linkName, brName)
+	}
+	current, err := GetBridgePortOptions(link)
+	if err != nil {
+		return err
+	}
+	if *current != *opts {
+		return fmt.Errorf("bridge port %q options are %+v, expected %+v", linkName, *current, *opts)
+	}
+	return nil
+}
+
+// EnableBridgePromisc turns on the promiscuous mode of the bridge
+func EnableBridgePromisc(br *netlink.Bridge) error {
+	if err := netlink.SetPromiscOn(br); err != nil {
+		return fmt.Errorf("failed to set bridge %q promiscuous mode on: %v", br.Name, err)
+	}
+	return nil
+}
+
+// CheckBridgePromisc checks the promiscuous mode of the bridge is on
+func CheckBridgePromisc(brName string) error {
+	br, err := netlink.LinkByName(brName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup bridge %q: %v", brName, err)
+	}
+	if br.Attrs().Promisc == 0 {
+		return fmt.Errorf("bridge %q promiscuous mode is off", brName)
+	}
+	return nil
+}
+
+func boolAttr(val bool) []byte {
+	var v uint8
+	if val {
+		v = 1
+	}
+	return nl.Uint8Attr(v)
+}
+
+// DeleteBridgeIfUnused deletes the bridge if there are no ports on it, it's not an error if the bridge doesn't exist
+func DeleteBridgeIfUnused(name string) error {
+	br, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to lookup bridge %q: %v", name, err)
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, l := range links {
+		if l.Attrs().MasterIndex == br.Attrs().Index {
+			return nil
+		}
+	}
+	if err := netlink.LinkDel(br); err != nil {
+		return fmt.Errorf("failed to delete bridge %q: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package nettool
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+)
+
+func TestBridgePortOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts BridgePortOptions
+	}{
+		{
+			name: "kernel defaults",
+			opts: BridgePortOptions{Learning: true, Flood: true},
+		},
+		{
+			name: "all flags on",
+			opts: BridgePortOptions{Hairpin: true, Isolated: true, Learning: true, Flood: true, Guard: true},
+		},
+		{
+			name: "all flags off",
+			opts: BridgePortOptions{},
+		},
+	}
+
+	testns.Run(t, func() error {
+		br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "testbr0"}}
+		if err := netlink.LinkAdd(br); err != nil {
+			return fmt.Errorf("failed to create bridge: %v", err)
+		}
+		port := &netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: "testport0", MasterIndex: br.Attrs().Index},
+			PeerName:  "testpeer0",
+		}
+		if err := netlink.LinkAdd(port); err != nil {
+			return fmt.Errorf("failed to create bridge port: %v", err)
+		}
+
+		for _, tt := range tests {
+			opts := tt.opts
+			if err := SetBridgePortOptions("testport0", &opts); err != nil {
+				t.Errorf("%s: SetBridgePortOptions() error = %v", tt.name, err)
+				continue
+			}
+			if err := CheckBridgePort("testport0", "testbr0", &opts); err != nil {
+				t.Errorf("%s: CheckBridgePort() error = %v", tt.name, err)
+			}
+		}
+
+		mismatch := BridgePortOptions{Hairpin: true}
+		if err := CheckBridgePort("testport0", "testbr0", &mismatch); err == nil {
+			t.Errorf("CheckBridgePort() expected error for mismatched options")
+		}
+
+		if err := CheckBridgePromisc("testbr0"); err == nil {
+			t.Errorf("CheckBridgePromisc() expected error before promiscuous mode is on")
+		}
+		if err := EnableBridgePromisc(br); err != nil {
+			return err
+		}
+		return CheckBridgePromisc("testbr0")
+	})
+}
@@ -0,0 +1,66 @@
+package nettool
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// ParseIPVlanMode returns the ipvlan mode of the name, the l2 mode is the default
+func ParseIPVlanMode(mode string) (netlink.IPVlanMode, error) {
+	switch mode {
+	case "", "l2":
+		return netlink.IPVLAN_MODE_L2, nil
+	case "l3":
+		return netlink.IPVLAN_MODE_L3, nil
+	case "l3s":
+		return netlink.IPVLAN_MODE_L3S, nil
+	default:
+		return 0, fmt.Errorf("unknown ipvlan mode: %q", mode)
+	}
+}
+
+// SetupIPVlan creates the ipvlan sub-interface of the master in container netns, the sub-interface
+// shares the MAC of the master. There is no ARP in l3 and l3s modes, so the default route goes out
+// of the interface without a gateway. The default route is only added if defaultRoute is true.
+func SetupIPVlan(netns ns.NetNS, master, ifName, ip, gwip string, mode netlink.IPVlanMode, mtu int, defaultRoute bool) error {
+	m, err := netlink.LinkByName(master)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q: %v", master, err)
+	}
+	// the link is created with a temporary name which may collide with the host links otherwise
+	tmpName, err := generateRandomLinkName("ipv")
+	if err != nil {
+		return err
+	}
+	ipvlan := &netlink.IPVlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        tmpName,
+			MTU:         mtu,
+			ParentIndex: m.Attrs().Index,
+			Namespace:   netlink.NsFd(int(netns.Fd())),
+		},
+		Mode: mode,
+	}
+	if err := netlink.LinkAdd(ipvlan); err != nil {
+		return fmt.Errorf("failed to create ipvlan on %q: %v", master, err)
+	}
+
+	if mode != netlink.IPVLAN_MODE_L2 {
+		gwip = ""
+	}
+	err = netns.Do(func(_ ns.NetNS) error {
+		link, err := renameLink(tmpName, ifName)
+		if err != nil {
+			// the rollback deletes the link by ifName, so it would leak under the temporary name
+			_ = DeleteLink(tmpName)
+			return err
+		}
+		return configureInterface(link, ip, gwip, nil, defaultRoute)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set ipvlan %q: %v", ifName, err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package nettool
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+)
+
+func TestParseIPVlanMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		want    netlink.IPVlanMode
+		wantErr bool
+	}{
+		{mode: "", want: netlink.IPVLAN_MODE_L2},
+		{mode: "l3", want: netlink.IPVLAN_MODE_L3},
+		{mode: "l3s", want: netlink.IPVLAN_MODE_L3S},
+		{mode: "l4", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseIPVlanMode(tt.mode)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseIPVlanMode(%q) error = %v, wantErr %v", tt.mode, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseIPVlanMode(%q) = %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestSetupIPVlanL3(t *testing.T) {
+	unsupported := false
+	testns.Run(t, func() error {
+		if err := newMaster("master0"); err != nil {
+			return err
+		}
+		m, err := netlink.LinkByName("master0")
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkAdd(&netlink.IPVlan{LinkAttrs: netlink.LinkAttrs{Name: "ipvtest", ParentIndex: m.Attrs().Index}}); err != nil {
+			if err == unix.EOPNOTSUPP {
+				unsupported = true
+				return nil
+			}
+			return err
+		}
+
+		var podNSs []ns.NetNS
+		for _, ip := range []string{"10.40.0.2/24", "10.40.0.3/24"} {
+			podNS, err := testns.New(t)
+			if err != nil {
+				return err
+			}
+			if err := SetupIPVlan(podNS, "master0", "eth0", ip, "10.40.0.1/24", netlink.IPVLAN_MODE_L3, 1500, true); err != nil {
+				return err
+			}
+			got, err := GetIPInNS(podNS, "eth0")
+			if err != nil {
+				return err
+			}
+			if got != ip {
+				return fmt.Errorf("ipvlan has IP %q, want %q", got, ip)
+			}
+			// the default route has no gateway in l3 mode
+			err = podNS.Do(func(ns.NetNS) error {
+				routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+				if err != nil {
+					return err
+				}
+				for _, r := range routes {
+					if r.Dst == nil || r.Dst.String() == "0.0.0.0/0" {
+						if r.Gw != nil || r.Scope != netlink.SCOPE_LINK {
+							return fmt.Errorf("unexpected default route %v", r)
+						}
+						return nil
+					}
+				}
+				return fmt.Errorf("no default route in %v", routes)
+			})
+			if err != nil {
+				return err
+			}
+			podNSs = append(podNSs, podNS)
+		}
+
+		// the sub-interface is not left under its temporary name if it can't be renamed
+		if err := SetupIPVlan(podNSs[0], "master0", "eth0", "10.40.0.4/24", "10.40.0.1/24", netlink.IPVLAN_MODE_L3, 1500, true); err == nil {
+			t.Errorf("SetupIPVlan succeeded with eth0 in the netns already")
+		}
+		err = podNSs[0].Do(func(ns.NetNS) error {
+			links, err := netlink.LinkList()
+			if err != nil {
+				return err
+			}
+			if len(links) != 2 {
+				t.Errorf("wanted lo and eth0 in the netns, got %d links", len(links))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return checkTCP(podNSs[0], "10.40.0.2", podNSs[1])
+	})
+	if unsupported {
+		t.Skip("ipvlan is not supported by the kernel")
+	}
+}
@@ -2,6 +2,7 @@ package nettool
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
 	"net"
 	"os"
@@ -10,6 +11,9 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
+// maxLinkNameLen is the max length of the link names, IFNAMSIZ minus the terminating null
+const maxLinkNameLen = 15
+
 // CreateOrUpdateBridge creates or updates bridge and sets its as the gateway of container network
 func CreateOrUpdateBridge(name, ip string, mtu int) (*netlink.Bridge, error) {
 	br := &netlink.Bridge{
@@ -48,10 +52,22 @@ func CreateOrUpdateBridge(name, ip string, mtu int) (*netlink.Bridge, error) {
 	if !ok {
 		return nil, fmt.Errorf("link %s already exists but is not a bridge type", name)
 	}
-	addrs, err := netlink.AddrList(currentBr, netlink.FAMILY_ALL)
+	if currentBr.MTU != mtu {
+		if err := netlink.LinkSetMTU(currentBr, mtu); err != nil {
+			return nil, fmt.Errorf("failed to set MTU %d for bridge %q: %v", mtu, name, err)
+		}
+	}
+	all, err := netlink.AddrList(currentBr, netlink.FAMILY_ALL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list address for bridge %q: %v", name, err)
 	}
+	// the link-local IPv6 address is added by the kernel once the bridge is up with ports
+	var addrs []netlink.Addr
+	for _, a := range all {
+		if !a.IP.IsLinkLocalUnicast() {
+			addrs = append(addrs, a)
+		}
+	}
 	switch {
 	case len(addrs) > 1:
 		return nil, fmt.Errorf("unexpected addresses for bridge %q: %v", name, addrs)
@@ -71,32 +87,16 @@ func CreateOrUpdateBridge(name, ip string, mtu int) (*netlink.Bridge, error) {
 }
 
 // SetupVeth sets up a pair of virtual ethernet devices in container netns
-// and then move the host-side veth into the hostNS namespace.
-func SetupVeth(netns ns.NetNS, br *netlink.Bridge, ifName, ip, gwip string, mtu int) error {
+// and then move the host-side veth named hostVethName into the hostNS namespace.
+// The default route is only added if defaultRoute is true.
+func SetupVeth(netns ns.NetNS, br *netlink.Bridge, ifName, hostVethName, ip, gwip string, mac net.HardwareAddr, mtu int, defaultRoute bool) error {
 	err := netns.Do(func(hostNS ns.NetNS) error {
-		hostVethName, veth, err := makeVethPair(ifName, mtu)
+		veth, err := makeVethPair(ifName, hostVethName, mtu)
 		if err != nil {
 			return err
 		}
-		ipaddr, ipnet, err := net.ParseCIDR(ip)
-		if err != nil {
-			return fmt.Errorf("failed to parse ip address %q: %v", ip, err)
-		}
-		ipnet.IP = ipaddr
-		if err = netlink.AddrAdd(veth, &netlink.Addr{IPNet: ipnet}); err != nil {
-			return fmt.Errorf("failed to set address: %q for veth %q: %v", ipnet, ifName, err)
-		}
-		if err = netlink.LinkSetUp(veth); err != nil {
-			return fmt.Errorf("failed to set veth %q up: %v", ifName, err)
-		}
-
-		// add bridge IP as the default route for container
-		gwNetIP, _, err := net.ParseCIDR(gwip)
-		if err != nil {
-			return fmt.Errorf("failed to parse gateway IP %q: %v", gwip, err)
-		}
-		if err = AddDefaultRoute(gwNetIP, veth); err != nil {
-			return fmt.Errorf("failed to add default route for %q: %v", ifName, err)
+		if err = configureInterface(veth, ip, gwip, mac, defaultRoute); err != nil {
+			return err
 		}
 
 		hostVeth, err := netlink.LinkByName(hostVethName)
@@ -129,16 +129,66 @@ func SetupVeth(netns ns.NetNS, br *netlink.Bridge, ifName, ip, gwip string, mtu
 	if err != nil {
 		return fmt.Errorf("failed to set veth %q: %v", ifName, err)
 	}
-
 	return nil
 }
 
-// makeVethPair create veth pair and peer name with random string with "veth" prefix
-func makeVethPair(name string, mtu int) (string, *netlink.Veth, error) {
-	peerName, err := generateRandomVethName()
+// configureInterface sets the MAC and the address of the link in container netns, sets it up and
+// adds the default route via the gateway if defaultRoute is true, the MAC is left to the kernel if
+// it's not specified and the default route goes out of the link directly if there is no gateway.
+func configureInterface(link netlink.Link, ip, gwip string, mac net.HardwareAddr, defaultRoute bool) error {
+	ifName := link.Attrs().Name
+	if mac != nil {
+		if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+			return fmt.Errorf("failed to set MAC address %q for %q: %v", mac, ifName, err)
+		}
+	}
+	ipaddr, ipnet, err := net.ParseCIDR(ip)
+	if err != nil {
+		return fmt.Errorf("failed to parse ip address %q: %v", ip, err)
+	}
+	ipnet.IP = ipaddr
+	if err = netlink.AddrAdd(link, &netlink.Addr{IPNet: ipnet}); err != nil {
+		return fmt.Errorf("failed to set address: %q for %q: %v", ipnet, ifName, err)
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", ifName, err)
+	}
+
+	if !defaultRoute {
+		return nil
+	}
+	if gwip == "" {
+		if err = AddDefaultDeviceRoute(ipaddr.To4() != nil, link); err != nil {
+			return fmt.Errorf("failed to add default route for %q: %v", ifName, err)
+		}
+		return nil
+	}
+
+	// add the gateway as the default route for container
+	gwNetIP, _, err := net.ParseCIDR(gwip)
 	if err != nil {
-		return "", nil, err
+		return fmt.Errorf("failed to parse gateway IP %q: %v", gwip, err)
+	}
+	if err = AddDefaultRoute(gwNetIP, link); err != nil {
+		return fmt.Errorf("failed to add default route for %q: %v", ifName, err)
 	}
+	return nil
+}
+
+// HostVethName returns the name of the host veth of the container interface, it's the prefix followed
+// by the hash of the container ID and the interface name so that the host veth can be found without the netns.
+// The fields are separated by a NUL byte so that "c1"+"eth0" and "c1e"+"th0" don't collide.
+func HostVethName(prefix, containerID, ifName string) string {
+	h := sha256.Sum256([]byte(containerID + "\x00" + ifName))
+	name := fmt.Sprintf("%s%x", prefix, h[:])
+	if len(name) > maxLinkNameLen {
+		name = name[:maxLinkNameLen]
+	}
+	return name
+}
+
+// makeVethPair create veth pair with the peer name
+func makeVethPair(name, peerName string, mtu int) (*netlink.Veth, error) {
 	veth := &netlink.Veth{
 		LinkAttrs: netlink.LinkAttrs{
 			Name: name,
@@ -148,50 +198,58 @@ func makeVethPair(name string, mtu int) (string, *netlink.Veth, error) {
 		PeerName: peerName,
 	}
 
-	err = netlink.LinkAdd(veth)
+	err := netlink.LinkAdd(veth)
 	switch {
 	case err == nil:
-		return peerName, veth, nil
+		return veth, nil
 	case os.IsExist(err):
-		return "", nil, fmt.Errorf("failed to create veth because veth name %q already exists", name)
+		return nil, fmt.Errorf("failed to create veth because veth name %q already exists", name)
 	default:
-		return "", nil, fmt.Errorf("failed to create veth %q with error: %v", name, err)
+		return nil, fmt.Errorf("failed to create veth %q with error: %v", name, err)
 	}
 }
 
-// generateRandomVethName generate random string start with "veth"
-func generateRandomVethName() (string, error) {
+// generateRandomLinkName generate random string start with the prefix, such as "veth"
+func generateRandomLinkName(prefix string) (string, error) {
 	rd := make([]byte, 4)
 	if _, err := rand.Read(rd); err != nil {
-		return "", fmt.Errorf("failed to gererate random veth name: %v", err)
+		return "", fmt.Errorf("failed to gererate random %s name: %v", prefix, err)
 	}
 
-	return fmt.Sprintf("veth%x", rd), nil
+	return fmt.Sprintf("%s%x", prefix, rd), nil
 }
 
-// GetVethIPInNS return the IP address for the ifName in container Namespace
-func GetVethIPInNS(netns ns.NetNS, ifName string) (string, error) {
+// GetIPInNS return the IP address for the ifName in container Namespace
+func GetIPInNS(netns ns.NetNS, ifName string) (string, error) {
 	ip := ""
 	err := netns.Do(func(_ ns.NetNS) error {
 		l, err := netlink.LinkByName(ifName)
 		if err != nil {
-			return fmt.Errorf("failed to lookup veth %q in %q: %v", ifName, netns.Path(), err)
+			return fmt.Errorf("failed to lookup link %q in %q: %v", ifName, netns.Path(), err)
 		}
-		veth, ok := l.(*netlink.Veth)
-		if !ok {
-			return fmt.Errorf("link %s already exists but is not a veth type", ifName)
+		switch l.(type) {
+		case *netlink.Veth, *netlink.Macvlan, *netlink.IPVlan:
+		default:
+			return fmt.Errorf("link %s already exists but is of unsupported %s type", ifName, l.Type())
 		}
-		addrs, err := netlink.AddrList(veth, netlink.FAMILY_ALL)
+		addrs, err := netlink.AddrList(l, netlink.FAMILY_ALL)
 		if err != nil {
-			return fmt.Errorf("failed to list address for veth %q: %v", ifName, err)
+			return fmt.Errorf("failed to list address for %q: %v", ifName, err)
+		}
+		// the link-local IPv6 address is added by the kernel
+		var global []netlink.Addr
+		for _, addr := range addrs {
+			if !addr.IP.IsLinkLocalUnicast() {
+				global = append(global, addr)
+			}
 		}
 		switch {
-		case len(addrs) > 1:
-			return fmt.Errorf("unexpected addresses for veth %q: %v", ifName, addrs)
-		case len(addrs) == 1:
-			ip = addrs[0].IPNet.String()
+		case len(global) > 1:
+			return fmt.Errorf("unexpected addresses for %q: %v", ifName, global)
+		case len(global) == 1:
+			ip = global[0].IPNet.String()
 		default:
-			return fmt.Errorf("no address set for veth %q", ifName)
+			return fmt.Errorf("no address set for %q", ifName)
 		}
 		return nil
 	})
@@ -200,3 +258,104 @@ func GetVethIPInNS(netns ns.NetNS, ifName string) (string, error) {
 	}
 	return ip, nil
 }
+
+// CheckIPInNS checks the interface ifName has the IP address in container Namespace
+func CheckIPInNS(netns ns.NetNS, ifName, ip string) error {
+	ipaddr, _, err := net.ParseCIDR(ip)
+	if err != nil {
+		return fmt.Errorf("failed to parse ip address %q: %v", ip, err)
+	}
+	return netns.Do(func(_ ns.NetNS) error {
+		l, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup link %q in %q: %v", ifName, netns.Path(), err)
+		}
+		addrs, err := netlink.AddrList(l, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("failed to list address for %q: %v", ifName, err)
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ipaddr) {
+				return nil
+			}
+		}
+		return fmt.Errorf("address %q is not set for %q", ip, ifName)
+	})
+}
+
+// GetLinkTypeInNS returns the type of the link ifName in container Namespace, such as veth and macvlan
+func GetLinkTypeInNS(netns ns.NetNS, ifName string) (string, error) {
+	linkType := ""
+	err := netns.Do(func(_ ns.NetNS) error {
+		l, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup link %q in %q: %v", ifName, netns.Path(), err)
+		}
+		linkType = l.Type()
+		return nil
+	})
+	return linkType, err
+}
+
+// LinkExistsInNS returns true if the link ifName exists in container Namespace
+func LinkExistsInNS(netns ns.NetNS, ifName string) (bool, error) {
+	exists := false
+	err := netns.Do(func(_ ns.NetNS) error {
+		if _, err := netlink.LinkByName(ifName); err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			}
+			return fmt.Errorf("failed to lookup link %q in %q: %v", ifName, netns.Path(), err)
+		}
+		exists = true
+		return nil
+	})
+	return exists, err
+}
+
+// GetHostVethName returns the name of the host-side peer of the veth ifName in container Namespace
+func GetHostVethName(netns ns.NetNS, ifName string) (string, error) {
+	peerIndex := 0
+	err := netns.Do(func(_ ns.NetNS) error {
+		l, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup veth %q in %q: %v", ifName, netns.Path(), err)
+		}
+		if _, ok := l.(*netlink.Veth); !ok {
+			return fmt.Errorf("link %s already exists but is not a veth type", ifName)
+		}
+		// the parent index of veth is the index of its peer
+		peerIndex = l.Attrs().ParentIndex
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	hostVeth, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup hostveth of %q: %v", ifName, err)
+	}
+	return hostVeth.Attrs().Name, nil
+}
+
+// DeleteLink deletes the link in the current netns, it's not an error if the link doesn't exist
+func DeleteLink(name string) error {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to lookup link %q: %v", name, err)
+	}
+	if err := netlink.LinkDel(l); err != nil {
+		return fmt.Errorf("failed to delete link %q: %v", name, err)
+	}
+	return nil
+}
+
+// DeleteLinkInNS deletes the link ifName in container Namespace together with the peer if it's a veth
+func DeleteLinkInNS(netns ns.NetNS, ifName string) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		return DeleteLink(ifName)
+	})
+}
@@ -0,0 +1,56 @@
+package nettool
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// macPrefix is the locally administered unicast prefix of the MACs derived from the pod IPs
+var macPrefix = []byte{0x0a, 0x58}
+
+// MACFromIP derives the MAC address from the last four bytes of the IP,
+// so the pod keeps its MAC as long as it keeps its IP.
+func MACFromIP(ip net.IP) (net.HardwareAddr, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if len(ip) != net.IPv6len {
+		return nil, fmt.Errorf("invalid IP address %q", ip)
+	}
+	mac := append(net.HardwareAddr{}, macPrefix...)
+	return append(mac, ip[len(ip)-4:]...), nil
+}
+
+// ParseUnicastMAC parses the MAC address and makes sure it can be set to an interface
+func ParseUnicastMAC(s string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse MAC address %q: %v", s, err)
+	}
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %q: not an ethernet address", s)
+	}
+	if mac[0]&0x01 != 0 {
+		return nil, fmt.Errorf("invalid MAC address %q: not a unicast address", s)
+	}
+	return mac, nil
+}
+
+// GetMACInNS return the MAC address for the ifName in container Namespace
+func GetMACInNS(netns ns.NetNS, ifName string) (net.HardwareAddr, error) {
+	var mac net.HardwareAddr
+	err := netns.Do(func(_ ns.NetNS) error {
+		l, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup link %q in %q: %v", ifName, netns.Path(), err)
+		}
+		mac = l.Attrs().HardwareAddr
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mac, nil
+}
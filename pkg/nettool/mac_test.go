@@ -0,0 +1,49 @@
+package nettool
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMACFromIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		ip      net.IP
+		want    string
+		wantErr bool
+	}{
+		{name: "ipv4", ip: net.ParseIP("10.244.1.5"), want: "0a:58:0a:f4:01:05"},
+		{name: "ipv6", ip: net.ParseIP("fd00::a:f401:5"), want: "0a:58:f4:01:00:05"},
+		{name: "invalid ip", ip: net.IP{1, 2}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MACFromIP(tt.ip)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MACFromIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("MACFromIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseUnicastMAC(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr bool
+	}{
+		{input: "0a:58:0a:f4:01:05"},
+		{input: "01:00:5e:00:00:01", wantErr: true},
+		{input: "00:00:00:00:00:00:00:01", wantErr: true},
+		{input: "not-a-mac", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if _, err := ParseUnicastMAC(tt.input); (err != nil) != tt.wantErr {
+				t.Errorf("ParseUnicastMAC() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
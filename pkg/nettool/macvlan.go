@@ -0,0 +1,81 @@
+package nettool
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// ParseMacvlanMode returns the macvlan mode of the name, the bridge mode is the default
+func ParseMacvlanMode(mode string) (netlink.MacvlanMode, error) {
+	switch mode {
+	case "", "bridge":
+		return netlink.MACVLAN_MODE_BRIDGE, nil
+	case "private":
+		return netlink.MACVLAN_MODE_PRIVATE, nil
+	case "vepa":
+		return netlink.MACVLAN_MODE_VEPA, nil
+	case "passthru":
+		return netlink.MACVLAN_MODE_PASSTHRU, nil
+	default:
+		return 0, fmt.Errorf("unknown macvlan mode: %q", mode)
+	}
+}
+
+// SetupMacvlan creates the macvlan sub-interface of the master in container netns, the MAC
+// of the master is used in passthru mode so the mac is ignored. The default route is only
+// added if defaultRoute is true.
+func SetupMacvlan(netns ns.NetNS, master, ifName, ip, gwip string, mode netlink.MacvlanMode, mac net.HardwareAddr, mtu int, defaultRoute bool) error {
+	m, err := netlink.LinkByName(master)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q: %v", master, err)
+	}
+	if mode == netlink.MACVLAN_MODE_PASSTHRU {
+		mac = nil
+	}
+	// the link is created with a temporary name which may collide with the host links otherwise
+	tmpName, err := generateRandomLinkName("mcv")
+	if err != nil {
+		return err
+	}
+	macvlan := &netlink.Macvlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        tmpName,
+			MTU:         mtu,
+			ParentIndex: m.Attrs().Index,
+			Namespace:   netlink.NsFd(int(netns.Fd())),
+		},
+		Mode: mode,
+	}
+	if err := netlink.LinkAdd(macvlan); err != nil {
+		return fmt.Errorf("failed to create macvlan on %q: %v", master, err)
+	}
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		link, err := renameLink(tmpName, ifName)
+		if err != nil {
+			// the rollback deletes the link by ifName, so it would leak under the temporary name
+			_ = DeleteLink(tmpName)
+			return err
+		}
+		return configureInterface(link, ip, gwip, mac, defaultRoute)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set macvlan %q: %v", ifName, err)
+	}
+	return nil
+}
+
+// renameLink renames the link and returns the renamed link
+func renameLink(name, newName string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup link %q: %v", name, err)
+	}
+	if err := netlink.LinkSetName(link, newName); err != nil {
+		return nil, fmt.Errorf("failed to rename link %q to %q: %v", name, newName, err)
+	}
+	return netlink.LinkByName(newName)
+}
@@ -0,0 +1,145 @@
+package nettool
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+)
+
+// newMaster creates the veth link whose peer is up so that it can be the master of the sub-interfaces
+func newMaster(name string) error {
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: name, MTU: 1500},
+		PeerName:  name + "p",
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("failed to create master %q: %v", name, err)
+	}
+	for _, n := range []string{name, name + "p"} {
+		l, err := netlink.LinkByName(n)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTCP connects from the client netns to the server listening on the IP in the server netns
+func checkTCP(server ns.NetNS, serverIP string, client ns.NetNS) error {
+	var l net.Listener
+	err := server.Do(func(ns.NetNS) error {
+		var err error
+		l, err = net.Listen("tcp", net.JoinHostPort(serverIP, "0"))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %v", serverIP, err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	return client.Do(func(ns.NetNS) error {
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), 3*time.Second)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %q: %v", l.Addr(), err)
+		}
+		return conn.Close()
+	})
+}
+
+func TestParseMacvlanMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		want    netlink.MacvlanMode
+		wantErr bool
+	}{
+		{mode: "", want: netlink.MACVLAN_MODE_BRIDGE},
+		{mode: "private", want: netlink.MACVLAN_MODE_PRIVATE},
+		{mode: "vepa", want: netlink.MACVLAN_MODE_VEPA},
+		{mode: "passthru", want: netlink.MACVLAN_MODE_PASSTHRU},
+		{mode: "source", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMacvlanMode(tt.mode)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseMacvlanMode(%q) error = %v, wantErr %v", tt.mode, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseMacvlanMode(%q) = %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestSetupMacvlan(t *testing.T) {
+	testns.Run(t, func() error {
+		if err := newMaster("master0"); err != nil {
+			return err
+		}
+		pods := []struct {
+			ip  string
+			mac net.HardwareAddr
+		}{
+			{ip: "10.30.0.2/24", mac: net.HardwareAddr{0x0a, 0x58, 0x0a, 0x1e, 0x00, 0x02}},
+			{ip: "10.30.0.3/24", mac: net.HardwareAddr{0x0a, 0x58, 0x0a, 0x1e, 0x00, 0x03}},
+		}
+		var podNSs []ns.NetNS
+		for _, pod := range pods {
+			podNS, err := testns.New(t)
+			if err != nil {
+				return err
+			}
+			if err := SetupMacvlan(podNS, "master0", "eth0", pod.ip, "10.30.0.1/24", netlink.MACVLAN_MODE_BRIDGE, pod.mac, 1500, true); err != nil {
+				return err
+			}
+			ip, err := GetIPInNS(podNS, "eth0")
+			if err != nil {
+				return err
+			}
+			if ip != pod.ip {
+				return fmt.Errorf("macvlan has IP %q, want %q", ip, pod.ip)
+			}
+			mac, err := GetMACInNS(podNS, "eth0")
+			if err != nil {
+				return err
+			}
+			if mac.String() != pod.mac.String() {
+				return fmt.Errorf("macvlan has MAC %q, want %q", mac, pod.mac)
+			}
+			podNSs = append(podNSs, podNS)
+		}
+
+		// the sub-interface is not left under its temporary name if it can't be renamed
+		if err := SetupMacvlan(podNSs[0], "master0", "eth0", "10.30.0.4/24", "10.30.0.1/24", netlink.MACVLAN_MODE_BRIDGE, nil, 1500, true); err == nil {
+			t.Errorf("SetupMacvlan succeeded with eth0 in the netns already")
+		}
+		err := podNSs[0].Do(func(ns.NetNS) error {
+			links, err := netlink.LinkList()
+			if err != nil {
+				return err
+			}
+			if len(links) != 2 {
+				t.Errorf("wanted lo and eth0 in the netns, got %d links", len(links))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// the sub-interfaces of the same master talk to each other in bridge mode
+		return checkTCP(podNSs[0], "10.30.0.2", podNSs[1])
+	})
+}
@@ -0,0 +1,49 @@
+package nettool
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultMTU is the MTU of the pods if the node has no default route to detect it from
+const DefaultMTU = 1500
+
+// DefaultRouteMTU returns the MTU of the link carrying the default route of the family,
+// DefaultMTU is returned if there is no default route.
+func DefaultRouteMTU(ipv4 bool) (int, error) {
+	family := netlink.FAMILY_V6
+	if ipv4 {
+		family = netlink.FAMILY_V4
+	}
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list routes: %v", err)
+	}
+	for _, r := range routes {
+		if r.Dst != nil {
+			continue
+		}
+		index := r.LinkIndex
+		// the multipath default route leaves the node through the first next hop
+		if index == 0 && len(r.MultiPath) > 0 {
+			index = r.MultiPath[0].LinkIndex
+		}
+		link, err := netlink.LinkByIndex(index)
+		if err != nil {
+			return 0, fmt.Errorf("failed to lookup link of default route %v: %v", r, err)
+		}
+		return link.Attrs().MTU, nil
+	}
+	return DefaultMTU, nil
+}
+
+// LinkMTU returns the MTU of the link
+func LinkMTU(name string) (int, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lookup link %q: %v", name, err)
+	}
+	return link.Attrs().MTU, nil
+}
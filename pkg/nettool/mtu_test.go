@@ -0,0 +1,57 @@
+package nettool
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+)
+
+func TestDefaultRouteMTU(t *testing.T) {
+	testns.Run(t, func() error {
+		if mtu, err := DefaultRouteMTU(true); err != nil || mtu != DefaultMTU {
+			t.Errorf("DefaultRouteMTU without default route = %d (%v), want %d", mtu, err, DefaultMTU)
+		}
+
+		if err := newMaster("eth0"); err != nil {
+			return err
+		}
+		eth0, err := netlink.LinkByName("eth0")
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetMTU(eth0, 9001); err != nil {
+			return err
+		}
+		if err := netlink.AddrAdd(eth0, &netlink.Addr{IPNet: &net.IPNet{IP: net.IPv4(192, 168, 0, 2), Mask: net.CIDRMask(24, 32)}}); err != nil {
+			return err
+		}
+		if err := AddDefaultRoute(net.IPv4(192, 168, 0, 1), eth0); err != nil {
+			return err
+		}
+		if mtu, err := DefaultRouteMTU(true); err != nil || mtu != 9001 {
+			t.Errorf("DefaultRouteMTU = %d (%v), want 9001", mtu, err)
+		}
+		if mtu, err := DefaultRouteMTU(false); err != nil || mtu != DefaultMTU {
+			t.Errorf("DefaultRouteMTU without IPv6 default route = %d (%v), want %d", mtu, err, DefaultMTU)
+		}
+
+		// the MTU of the existing bridge follows the detected one
+		for _, mtu := range []int{1500, 9001} {
+			br, err := CreateOrUpdateBridge("minicni0", "10.244.1.1/24", mtu)
+			if err != nil {
+				return err
+			}
+			l, err := netlink.LinkByName(br.Name)
+			if err != nil {
+				return err
+			}
+			if l.Attrs().MTU != mtu {
+				t.Errorf("bridge MTU = %d, want %d", l.Attrs().MTU, mtu)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,44 @@
+package nettool
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// RouteProtocol tags the routes to the pod subnets of the remote nodes so that the stale ones can be found
+const RouteProtocol = 77
+
+// SyncRoutes replaces the routes tagged with RouteProtocol with the desired ones, the tagged routes
+// to the other destinations are deleted. All the routes are tried before the errors are returned.
+func SyncRoutes(routes []*netlink.Route) error {
+	var errs []string
+	desired := map[string]bool{}
+	for _, route := range routes {
+		route.Protocol = RouteProtocol
+		desired[route.Dst.String()] = true
+		if err := netlink.RouteReplace(route); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to replace route to %q: %v", route.Dst, err))
+		}
+	}
+
+	current, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Protocol: RouteProtocol}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return fmt.Errorf("failed to list routes: %v", err)
+	}
+	for i := range current {
+		route := &current[i]
+		if route.Dst == nil || desired[route.Dst.String()] {
+			continue
+		}
+		if err := netlink.RouteDel(route); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to delete route to %q: %v", route.Dst, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
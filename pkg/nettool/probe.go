@@ -0,0 +1,81 @@
+package nettool
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ProbeAddress sends the ARP probe for the IPv4 address out of the link as RFC 5227 describes,
+// it returns true if another host claims the address before the timeout.
+func ProbeAddress(linkName string, ip net.IP, timeout time.Duration) (bool, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false, fmt.Errorf("ARP probe supports IPv4 address only, got %q", ip)
+	}
+	ifi, err := net.InterfaceByName(linkName)
+	if err != nil {
+		return false, fmt.Errorf("failed to lookup interface %q: %v", linkName, err)
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return false, fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ARP), Ifindex: ifi.Index}); err != nil {
+		return false, fmt.Errorf("failed to bind packet socket to %q: %v", linkName, err)
+	}
+
+	// the sender address of the probe is unspecified so that no host updates its ARP cache
+	probe := arpFrame(ifi.HardwareAddr, net.IPv4zero, ip4)
+	if err := unix.Sendto(fd, probe, 0, &unix.SockaddrLinklayer{Ifindex: ifi.Index}); err != nil {
+		return false, fmt.Errorf("failed to send ARP probe for %q: %v", ip, err)
+	}
+
+	buf := make([]byte, 1500)
+	for deadline := time.Now().Add(timeout); ; {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false, nil
+		}
+		tv := unix.NsecToTimeval(remaining.Nanoseconds())
+		if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			return false, fmt.Errorf("failed to set timeout of packet socket: %v", err)
+		}
+		n, from, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			return false, fmt.Errorf("failed to receive ARP packets on %q: %v", linkName, err)
+		}
+		if sll, ok := from.(*unix.SockaddrLinklayer); ok && sll.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+		if arpConflicts(buf[:n], ifi.HardwareAddr, ip4) {
+			return true, nil
+		}
+	}
+}
+
+// arpConflicts returns true if the ARP packet is sent by the owner of the IP, or is a probe
+// for the same IP from another host.
+func arpConflicts(frame []byte, mac net.HardwareAddr, ip net.IP) bool {
+	if len(frame) < 14+28 || binary.BigEndian.Uint16(frame[12:14]) != unix.ETH_P_ARP {
+		return false
+	}
+	arp := frame[14:]
+	sha, spa, tpa := net.HardwareAddr(arp[8:14]), net.IP(arp[14:18]), net.IP(arp[24:28])
+	if sha.String() == mac.String() {
+		return false
+	}
+	return spa.Equal(ip) || (spa.Equal(net.IPv4zero) && tpa.Equal(ip))
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
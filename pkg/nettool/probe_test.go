@@ -0,0 +1,40 @@
+package nettool
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+)
+
+func TestProbeAddress(t *testing.T) {
+	testns.Run(t, func() error {
+		br, err := CreateOrUpdateBridge("testbr0", "10.20.0.1/24", 1500)
+		if err != nil {
+			return err
+		}
+		if _, err := newPodNS(t, br, "10.20.0.2/24", "10.20.0.1/24"); err != nil {
+			return err
+		}
+
+		tests := []struct {
+			ip   string
+			want bool
+		}{
+			{ip: "10.20.0.2", want: true},
+			{ip: "10.20.0.3", want: false},
+		}
+		for _, tt := range tests {
+			got, err := ProbeAddress("testbr0", net.ParseIP(tt.ip), 200*time.Millisecond)
+			if err != nil {
+				return err
+			}
+			if got != tt.want {
+				return fmt.Errorf("ProbeAddress(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		}
+		return nil
+	})
+}
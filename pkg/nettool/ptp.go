@@ -0,0 +1,141 @@
+package nettool
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// ptpGatewayV4 and ptpGatewayV6 are the link-local gateways of the pods on every host veth
+	ptpGatewayV4 = net.IPv4(169, 254, 1, 1).To4()
+	ptpGatewayV6 = net.ParseIP("fe80::1")
+)
+
+// PTPGateway returns the link-local gateway of the pod IP in ptp mode
+func PTPGateway(ip net.IP) *net.IPNet {
+	if ip.To4() != nil {
+		return &net.IPNet{IP: ptpGatewayV4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ptpGatewayV6, Mask: net.CIDRMask(64, 128)}
+}
+
+// SetupPTP sets up a pair of virtual ethernet devices without a bridge, the pod routes all the traffic
+// via the link-local gateway on the host veth and the host routes the pod IP to the host veth, so
+// there is no L2 traffic between pods. The host veth is named hostVethName, and the default route
+// via the gateway is only added if defaultRoute is true.
+func SetupPTP(netns ns.NetNS, ifName, hostVethName, ip string, mac net.HardwareAddr, mtu int, defaultRoute bool) error {
+	ipaddr, _, err := net.ParseCIDR(ip)
+	if err != nil {
+		return fmt.Errorf("failed to parse ip address %q: %v", ip, err)
+	}
+	podIPNet := hostIPNet(ipaddr)
+	gw := PTPGateway(ipaddr)
+
+	err = netns.Do(func(hostNS ns.NetNS) error {
+		veth, err := makeVethPair(ifName, hostVethName, mtu)
+		if err != nil {
+			return err
+		}
+		if err = netlink.LinkSetHardwareAddr(veth, mac); err != nil {
+			return fmt.Errorf("failed to set MAC address %q for %q: %v", mac, ifName, err)
+		}
+		// the pod owns the host address only so that the other pods in the subnet are routed too,
+		// the host is the only neighbor on the link so there is nothing to detect
+		if err = netlink.AddrAdd(veth, &netlink.Addr{IPNet: podIPNet, Flags: unix.IFA_F_NODAD}); err != nil {
+			return fmt.Errorf("failed to set address: %q for veth %q: %v", podIPNet, ifName, err)
+		}
+		if err = netlink.LinkSetUp(veth); err != nil {
+			return fmt.Errorf("failed to set veth %q up: %v", ifName, err)
+		}
+		if gw.IP.To4() != nil {
+			if err = netlink.RouteAdd(&netlink.Route{
+				LinkIndex: veth.Attrs().Index,
+				Scope:     netlink.SCOPE_LINK,
+				Dst:       hostIPNet(gw.IP),
+			}); err != nil {
+				return fmt.Errorf("failed to add route to gateway %q for %q: %v", gw.IP, ifName, err)
+			}
+		}
+		if defaultRoute {
+			if err = AddDefaultRoute(gw.IP, veth); err != nil {
+				return fmt.Errorf("failed to add default route for %q: %v", ifName, err)
+			}
+		}
+
+		hostVeth, err := netlink.LinkByName(hostVethName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup hostveth %q: %v", hostVethName, err)
+		}
+		if err = netlink.LinkSetNsFd(hostVeth, int(hostNS.Fd())); err != nil {
+			return fmt.Errorf("failed to set hostveth %q to host netns: %v", hostVethName, err)
+		}
+		err = hostNS.Do(func(_ ns.NetNS) error {
+			hostVeth, err = netlink.LinkByName(hostVethName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup hostveth %q in %q: %v", hostVethName, hostNS.Path(), err)
+			}
+			if err = netlink.LinkSetUp(hostVeth); err != nil {
+				return fmt.Errorf("failed to set veth %q up: %v", hostVethName, err)
+			}
+			// the gateway is shared by all the host veths, there is nothing to detect
+			if err = netlink.AddrAdd(hostVeth, &netlink.Addr{IPNet: gw, Flags: unix.IFA_F_NODAD}); err != nil {
+				return fmt.Errorf("failed to set address: %q for veth %q: %v", gw, hostVethName, err)
+			}
+			if err = netlink.RouteAdd(&netlink.Route{
+				LinkIndex: hostVeth.Attrs().Index,
+				Scope:     netlink.SCOPE_LINK,
+				Dst:       podIPNet,
+			}); err != nil {
+				return fmt.Errorf("failed to add route to %q via %q: %v", podIPNet, hostVethName, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set hostveth %q: %v", hostVethName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set veth %q: %v", ifName, err)
+	}
+	return nil
+}
+
+// CheckPTPRoute checks the host routes the pod IP to the host veth
+func CheckPTPRoute(hostVethName, ip string) error {
+	ipaddr, _, err := net.ParseCIDR(ip)
+	if err != nil {
+		return fmt.Errorf("failed to parse ip address %q: %v", ip, err)
+	}
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup hostveth %q: %v", hostVethName, err)
+	}
+	family := netlink.FAMILY_V4
+	if ipaddr.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := netlink.RouteList(hostVeth, family)
+	if err != nil {
+		return fmt.Errorf("failed to list routes of %q: %v", hostVethName, err)
+	}
+	want := hostIPNet(ipaddr).String()
+	for _, r := range routes {
+		if r.Dst != nil && r.Dst.String() == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("no route to %q via %q", want, hostVethName)
+}
+
+// hostIPNet returns the single address network of the IP
+func hostIPNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
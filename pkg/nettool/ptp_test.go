@@ -0,0 +1,99 @@
+package nettool
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+)
+
+func TestSetupPTP(t *testing.T) {
+	tests := []struct {
+		name    string
+		pod1IP  string
+		pod2IP  string
+		forward string
+		family  int
+	}{
+		{
+			name:    "ipv4",
+			pod1IP:  "10.60.0.2/24",
+			pod2IP:  "10.60.0.3/24",
+			forward: "net.ipv4.ip_forward",
+			family:  netlink.FAMILY_V4,
+		},
+		{
+			name:    "ipv6",
+			pod1IP:  "fd00:60::2/64",
+			pod2IP:  "fd00:60::3/64",
+			forward: "net.ipv6.conf.all.forwarding",
+			family:  netlink.FAMILY_V6,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testns.Run(t, func() error {
+				hostNS, err := ns.GetCurrentNS()
+				if err != nil {
+					return err
+				}
+				defer hostNS.Close()
+				// the pods talk to each other through the host
+				if _, err := sysctl.Sysctl(tt.forward, "1"); err != nil {
+					return err
+				}
+
+				var podNSs []ns.NetNS
+				for _, ip := range []string{tt.pod1IP, tt.pod2IP} {
+					podNS, err := testns.New(t)
+					if err != nil {
+						return err
+					}
+					ipaddr, _, _ := net.ParseCIDR(ip)
+					mac, _ := MACFromIP(ipaddr)
+					hostVethName := HostVethName("veth", ip, "eth0")
+					if err := SetupPTP(podNS, "eth0", hostVethName, ip, mac, 1500, true); err != nil {
+						return err
+					}
+					if err := CheckPTPRoute(hostVethName, ip); err != nil {
+						return err
+					}
+					// there is no route to the pod subnet in the pod
+					err = podNS.Do(func(ns.NetNS) error {
+						_, subnet, _ := net.ParseCIDR(ip)
+						routes, err := netlink.RouteList(nil, tt.family)
+						if err != nil {
+							return err
+						}
+						for _, r := range routes {
+							if r.Dst != nil && r.Dst.String() == subnet.String() {
+								return fmt.Errorf("unexpected route to pod subnet %v", r)
+							}
+						}
+						return nil
+					})
+					if err != nil {
+						return err
+					}
+					podNSs = append(podNSs, podNS)
+				}
+
+				pod1IP, _, _ := net.ParseCIDR(tt.pod1IP)
+				pod2IP, _, _ := net.ParseCIDR(tt.pod2IP)
+				if err := checkTCP(podNSs[0], pod1IP.String(), hostNS); err != nil {
+					return fmt.Errorf("host to pod: %v", err)
+				}
+				if err := checkTCP(podNSs[1], pod2IP.String(), podNSs[0]); err != nil {
+					return fmt.Errorf("pod to pod: %v", err)
+				}
+				return nil
+			})
+		})
+	}
+}
@@ -2,18 +2,45 @@
 package nettool
 
 import (
+	"fmt"
 	"net"
 
+	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
+const (
+	// sourceRouteTableBase is added to the index of the interface to get its routing table
+	sourceRouteTableBase = 100
+	// sourceRulePriority is the priority of the rules looking up the routing tables of the interfaces
+	sourceRulePriority = 100
+)
+
+// PodRoute is an extra route of the pod, it goes out of the pod interface directly if there is no gateway
+type PodRoute struct {
+	Dst    *net.IPNet
+	GW     net.IP
+	Metric int
+}
+
 // AddRoute adds a universally-scoped route to a device.
 func AddRoute(ipn *net.IPNet, gw net.IP, dev netlink.Link) error {
+	return AddRouteWithMetric(ipn, gw, 0, dev)
+}
+
+// AddRouteWithMetric adds a route with the metric to a device, the route is link-scoped if there is no gateway.
+func AddRouteWithMetric(ipn *net.IPNet, gw net.IP, metric int, dev netlink.Link) error {
+	scope := netlink.SCOPE_UNIVERSE
+	if gw == nil {
+		scope = netlink.SCOPE_LINK
+	}
 	return netlink.RouteAdd(&netlink.Route{
 		LinkIndex: dev.Attrs().Index,
-		Scope:     netlink.SCOPE_UNIVERSE,
+		Scope:     scope,
 		Dst:       ipn,
 		Gw:        gw,
+		Priority:  metric,
 	})
 }
 
@@ -29,6 +56,168 @@ func AddHostRoute(ipn *net.IPNet, gw net.IP, dev netlink.Link) error {
 
 // AddDefaultRoute sets the default route on the given gateway.
 func AddDefaultRoute(gw net.IP, dev netlink.Link) error {
-	_, defNet, _ := net.ParseCIDR("0.0.0.0/0")
+	var defNet *net.IPNet
+	if gw.To4() != nil {
+		_, defNet, _ = net.ParseCIDR("0.0.0.0/0")
+	} else {
+		_, defNet, _ = net.ParseCIDR("::/0")
+	}
 	return AddRoute(defNet, gw, dev)
 }
+
+// AddDefaultDeviceRoute sets the default route out of the device without a gateway.
+func AddDefaultDeviceRoute(ipv4 bool, dev netlink.Link) error {
+	var defNet *net.IPNet
+	if ipv4 {
+		_, defNet, _ = net.ParseCIDR("0.0.0.0/0")
+	} else {
+		_, defNet, _ = net.ParseCIDR("::/0")
+	}
+	return netlink.RouteAdd(&netlink.Route{
+		LinkIndex: dev.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       defNet,
+	})
+}
+
+// AddRoutesInNS adds the routes out of the interface ifName in container Namespace
+func AddRoutesInNS(netns ns.NetNS, ifName string, routes []PodRoute) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup link %q in %q: %v", ifName, netns.Path(), err)
+		}
+		for _, r := range routes {
+			if err := AddRouteWithMetric(r.Dst, r.GW, r.Metric, link); err != nil {
+				return fmt.Errorf("failed to add route to %s via %s for %q: %v", r.Dst, r.GW, ifName, err)
+			}
+		}
+		return nil
+	})
+}
+
+// SetLoopbackUpInNS sets the loopback interface up in container Namespace
+func SetLoopbackUpInNS(netns ns.NetNS) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			return fmt.Errorf("failed to lookup loopback in %q: %v", netns.Path(), err)
+		}
+		if err := netlink.LinkSetUp(lo); err != nil {
+			return fmt.Errorf("failed to set loopback up in %q: %v", netns.Path(), err)
+		}
+		return nil
+	})
+}
+
+// HasDefaultRouteInNS returns true if there is a default route of the family in the main table of container Namespace
+func HasDefaultRouteInNS(netns ns.NetNS, ipv4 bool) (bool, error) {
+	family := netlink.FAMILY_V6
+	if ipv4 {
+		family = netlink.FAMILY_V4
+	}
+	found := false
+	err := netns.Do(func(_ ns.NetNS) error {
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return fmt.Errorf("failed to list routes in %q: %v", netns.Path(), err)
+		}
+		for _, r := range routes {
+			if r.Dst == nil || r.Dst.IP.IsUnspecified() {
+				found = true
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// AddSourceRoutingInNS routes the traffic from the addresses of the interface ifName out of it in container
+// Namespace, the default route via the gateway and the subnet route are added in the routing table of the
+// interface which the rules look up for the addresses. The default route goes out of the interface directly
+// if there is no gateway.
+func AddSourceRoutingInNS(netns ns.NetNS, ifName string, gw net.IP) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup link %q in %q: %v", ifName, netns.Path(), err)
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("failed to list address for %q: %v", ifName, err)
+		}
+		table := sourceRouteTableBase + link.Attrs().Index
+		for _, addr := range addrs {
+			if addr.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			ipv4 := addr.IP.To4() != nil
+			var routes []netlink.Route
+			// the addresses of the whole subnet are on the link unless the interface owns the host address only
+			if ones, bits := addr.Mask.Size(); ones < bits {
+				subnet := &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+				routes = append(routes, netlink.Route{Dst: subnet, Src: addr.IP, Scope: netlink.SCOPE_LINK})
+			}
+			switch {
+			case gw == nil:
+				routes = append(routes, netlink.Route{Dst: defaultNet(ipv4), Scope: netlink.SCOPE_LINK})
+			case (gw.To4() != nil) == ipv4:
+				// the gateway may be out of the subnet, e.g. the link-local gateway in ptp mode
+				routes = append(routes,
+					netlink.Route{Dst: hostIPNet(gw), Scope: netlink.SCOPE_LINK},
+					netlink.Route{Dst: defaultNet(ipv4), Gw: gw})
+			}
+			for _, r := range routes {
+				r.LinkIndex = link.Attrs().Index
+				r.Table = table
+				if err := netlink.RouteReplace(&r); err != nil {
+					return fmt.Errorf("failed to add route to %s in table %d for %q: %v", r.Dst, table, ifName, err)
+				}
+			}
+			rule := netlink.NewRule()
+			rule.Family = netlink.FAMILY_V6
+			if ipv4 {
+				rule.Family = netlink.FAMILY_V4
+			}
+			rule.Src = hostIPNet(addr.IP)
+			rule.Table = table
+			rule.Priority = sourceRulePriority
+			if err := netlink.RuleAdd(rule); err != nil {
+				return fmt.Errorf("failed to add rule from %s to table %d for %q: %v", addr.IP, table, ifName, err)
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteSourceRulesInNS deletes the rules looking up the routes of the traffic from the IP in container
+// Namespace, the routes of the interface are deleted together with the interface.
+func DeleteSourceRulesInNS(netns ns.NetNS, ip net.IP) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		family := netlink.FAMILY_V6
+		if ip.To4() != nil {
+			family = netlink.FAMILY_V4
+		}
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return fmt.Errorf("failed to list rules in %q: %v", netns.Path(), err)
+		}
+		for _, r := range rules {
+			if r.Src == nil || !r.Src.IP.Equal(ip) || r.Priority != sourceRulePriority {
+				continue
+			}
+			r := r
+			if err := netlink.RuleDel(&r); err != nil {
+				return fmt.Errorf("failed to delete rule from %s: %v", ip, err)
+			}
+		}
+		return nil
+	})
+}
+
+func defaultNet(ipv4 bool) *net.IPNet {
+	if ipv4 {
+		return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+	}
+	return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+}
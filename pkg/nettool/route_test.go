@@ -0,0 +1,166 @@
+package nettool
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+)
+
+func TestAddRoutesInNS(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("test requires root privileges")
+	}
+	podNS, err := testns.New(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = podNS.Do(func(ns.NetNS) error {
+		if err := newMaster("eth0"); err != nil {
+			return err
+		}
+		eth0, err := netlink.LinkByName("eth0")
+		if err != nil {
+			return err
+		}
+		return netlink.AddrAdd(eth0, &netlink.Addr{IPNet: &net.IPNet{IP: net.IPv4(10, 244, 1, 2), Mask: net.CIDRMask(24, 32)}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetLoopbackUpInNS(podNS); err != nil {
+		t.Fatal(err)
+	}
+	_, viaGW, _ := net.ParseCIDR("172.16.0.0/16")
+	_, direct, _ := net.ParseCIDR("192.168.100.0/24")
+	routes := []PodRoute{
+		{Dst: viaGW, GW: net.ParseIP("10.244.1.254"), Metric: 100},
+		{Dst: direct},
+	}
+	if err := AddRoutesInNS(podNS, "eth0", routes); err != nil {
+		t.Fatal(err)
+	}
+
+	err = podNS.Do(func(ns.NetNS) error {
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			return err
+		}
+		if lo.Attrs().Flags&net.FlagUp == 0 {
+			t.Errorf("loopback is not up")
+		}
+		for _, want := range routes {
+			got, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: want.Dst}, netlink.RT_FILTER_DST)
+			if err != nil {
+				return err
+			}
+			if len(got) != 1 || !got[0].Gw.Equal(want.GW) || got[0].Priority != want.Metric {
+				t.Errorf("routes to %s = %v, want via %v with metric %d", want.Dst, got, want.GW, want.Metric)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddRoutesInNS(podNS, "eth0", routes[:1]); err == nil {
+		t.Errorf("adding existing route succeeded")
+	}
+}
+
+func TestSourceRoutingInNS(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("test requires root privileges")
+	}
+	podNS, err := testns.New(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = podNS.Do(func(ns.NetNS) error {
+		for i, name := range []string{"eth0", "net1"} {
+			if err := newMaster(name); err != nil {
+				return err
+			}
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				return err
+			}
+			if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: &net.IPNet{IP: net.IPv4(10, 244, byte(i+1), 2), Mask: net.CIDRMask(24, 32)}}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := HasDefaultRouteInNS(podNS, true); err != nil || found {
+		t.Fatalf("HasDefaultRouteInNS before the default route = %v (%v), want false", found, err)
+	}
+	_, defaultDst, _ := net.ParseCIDR("0.0.0.0/0")
+	if err := AddRoutesInNS(podNS, "eth0", []PodRoute{{Dst: defaultDst, GW: net.ParseIP("10.244.1.1")}}); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := HasDefaultRouteInNS(podNS, true); err != nil || !found {
+		t.Fatalf("HasDefaultRouteInNS after the default route = %v (%v), want true", found, err)
+	}
+	if found, err := HasDefaultRouteInNS(podNS, false); err != nil || found {
+		t.Errorf("HasDefaultRouteInNS of IPv6 = %v (%v), want false", found, err)
+	}
+
+	if err := AddSourceRoutingInNS(podNS, "net1", net.ParseIP("10.244.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	// the rule of the address of net1 looks up the table with the default route out of net1
+	sourceTable := func(src string) (int, []netlink.Route, error) {
+		table := 0
+		var routes []netlink.Route
+		err := podNS.Do(func(ns.NetNS) error {
+			rules, err := netlink.RuleList(netlink.FAMILY_V4)
+			if err != nil {
+				return err
+			}
+			for _, r := range rules {
+				if r.Src != nil && r.Src.IP.Equal(net.ParseIP(src)) {
+					table = r.Table
+				}
+			}
+			if table == 0 {
+				return nil
+			}
+			routes, err = netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+			return err
+		})
+		return table, routes, err
+	}
+	table, routes, err := sourceTable("10.244.2.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var defaultGW net.IP
+	for _, r := range routes {
+		if r.Dst == nil || r.Dst.IP.IsUnspecified() {
+			defaultGW = r.Gw
+		}
+	}
+	if table == 0 || !defaultGW.Equal(net.ParseIP("10.244.2.1")) {
+		t.Errorf("table %d of 10.244.2.2 has routes %v, want the default route via 10.244.2.1", table, routes)
+	}
+	if table, _, err := sourceTable("10.244.1.2"); err != nil || table != 0 {
+		t.Errorf("10.244.1.2 of the primary interface has the rule to table %d (%v)", table, err)
+	}
+
+	if err := DeleteSourceRulesInNS(podNS, net.ParseIP("10.244.2.2")); err != nil {
+		t.Fatal(err)
+	}
+	if table, _, err := sourceTable("10.244.2.2"); err != nil || table != 0 {
+		t.Errorf("rule to table %d is left after deletion (%v)", table, err)
+	}
+}
@@ -0,0 +1,158 @@
+package nettool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"golang.org/x/sys/unix"
+)
+
+// HostSysctl is a sysctl of the host the pod network relies on
+type HostSysctl struct {
+	Key   string
+	Value string
+	// Accepted are the other values that work as well
+	Accepted []string
+	// MaxWith is the key the kernel combines with this one by taking the maximum, the maximum
+	// of both is checked then. Setting this key to Value is enough if Value is the highest.
+	MaxWith string
+}
+
+// ForwardingSysctls returns the sysctls that let the host route the pod traffic of the family off the node
+func ForwardingSysctls(ipv4 bool) []HostSysctl {
+	if ipv4 {
+		return []HostSysctl{{Key: "net.ipv4.ip_forward", Value: "1"}}
+	}
+	return []HostSysctl{{Key: "net.ipv6.conf.all.forwarding", Value: "1"}}
+}
+
+// BridgeSysctls returns the sysctls that pass the traffic bridged between the pods through the netfilter
+// hooks, which kube-proxy and the network policies rely on, and turn the strict reverse path filter off on
+// the bridge. The kernel applies the higher of the rp_filter of all the interfaces and of the bridge.
+func BridgeSysctls(bridge string, ipv4 bool) []HostSysctl {
+	sysctls := BridgeNetfilterSysctls(ipv4)
+	if ipv4 {
+		sysctls = append(sysctls, HostSysctl{Key: InterfaceSysctlKey("net.ipv4.conf", bridge, "rp_filter"), Value: "2", Accepted: []string{"0"}, MaxWith: "net.ipv4.conf.all.rp_filter"})
+	}
+	return sysctls
+}
+
+// BridgeNetfilterSysctls returns the sysctls that pass the traffic bridged between the pods of the family
+// through the netfilter hooks of the inet family
+func BridgeNetfilterSysctls(ipv4 bool) []HostSysctl {
+	if ipv4 {
+		return []HostSysctl{{Key: "net.bridge.bridge-nf-call-iptables", Value: "1"}}
+	}
+	return []HostSysctl{{Key: "net.bridge.bridge-nf-call-ip6tables", Value: "1"}}
+}
+
+// InterfaceSysctlKey returns the dotted sysctl key of the interface, the dots in the interface name
+// are written as slashes as sysctl(8) does.
+func InterfaceSysctlKey(prefix, ifName, name string) string {
+	return fmt.Sprintf("%s.%s.%s", prefix, strings.ReplaceAll(ifName, ".", "/"), name)
+}
+
+// EnsureHostSysctls checks the sysctls of the host and sets the ones with other values if enable is true,
+// the error lists all the sysctls which are not as wanted.
+func EnsureHostSysctls(sysctls []HostSysctl, enable bool) error {
+	var errs []string
+	for _, s := range sysctls {
+		value, err := readHostSysctl(s.Key)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		current := fmt.Sprintf("sysctl %s is %s", s.Key, value)
+		if s.MaxWith != "" {
+			other, err := readHostSysctl(s.MaxWith)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			current = fmt.Sprintf("%s and %s is %s", current, s.MaxWith, other)
+			value = maxSysctlValue(value, other)
+		}
+		if value == s.Value || containsString(s.Accepted, value) {
+			continue
+		}
+		if !enable {
+			errs = append(errs, fmt.Sprintf("%s, want %s", current, s.Value))
+			continue
+		}
+		if _, err := sysctl.Sysctl(s.Key, s.Value); err != nil {
+			if os.IsPermission(err) || errors.Is(err, unix.EROFS) {
+				errs = append(errs, fmt.Sprintf("no permission to set sysctl %s to %s, set it on the host or run with the privileges: %v", s.Key, s.Value, err))
+			} else {
+				errs = append(errs, fmt.Sprintf("failed to set sysctl %s to %s: %v", s.Key, s.Value, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("host is not set up for the pod network: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// readHostSysctl reads the sysctl, the missing bridge sysctls point to the br_netfilter module
+func readHostSysctl(key string) (string, error) {
+	value, err := sysctl.Sysctl(key)
+	if err != nil {
+		if os.IsNotExist(err) && strings.HasPrefix(key, "net.bridge.") {
+			return "", fmt.Errorf("sysctl %s doesn't exist, the br_netfilter module is not loaded", key)
+		}
+		return "", fmt.Errorf("failed to read sysctl %s: %v", key, err)
+	}
+	return value, nil
+}
+
+// maxSysctlValue returns the higher of the integer values, the first one is returned if either is not an integer
+func maxSysctlValue(a, b string) string {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	if errA != nil || errB != nil || x >= y {
+		return a
+	}
+	return b
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// EnableRouteLocalnet allows the traffic from the loopback addresses to be routed through the interface,
+// it's needed to reach the host ports of the containers from the localhost.
+func EnableRouteLocalnet(ifName string) error {
+	key := fmt.Sprintf("net/ipv4/conf/%s/route_localnet", ifName)
+	if _, err := sysctl.Sysctl(key, "1"); err != nil {
+		return fmt.Errorf("failed to set %s: %v", key, err)
+	}
+	return nil
+}
+
+// SetSysctlsInNS sets the sysctls in the netns, they must be namespaced so that the host is not affected
+func SetSysctlsInNS(netns ns.NetNS, sysctls map[string]string) error {
+	keys := make([]string, 0, len(sysctls))
+	for key := range sysctls {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return netns.Do(func(ns.NetNS) error {
+		for _, key := range keys {
+			if _, err := sysctl.Sysctl(key, sysctls[key]); err != nil {
+				return fmt.Errorf("failed to set sysctl %s to %q: %v", key, sysctls[key], err)
+			}
+		}
+		return nil
+	})
+}
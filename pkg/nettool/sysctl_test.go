@@ -0,0 +1,149 @@
+package nettool
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+
+	"github.com/morvencao/minicni/pkg/internal/testns"
+)
+
+func TestSetSysctlsInNS(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("test requires root privileges")
+	}
+	hostValue, err := sysctl.Sysctl("net.core.somaxconn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	podNS, err := testns.New(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1234"
+	if want == hostValue {
+		want = "4321"
+	}
+	if err := SetSysctlsInNS(podNS, map[string]string{"net.core.somaxconn": want, "net.ipv4.conf.lo.rp_filter": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	err = podNS.Do(func(ns.NetNS) error {
+		for key, value := range map[string]string{"net.core.somaxconn": want, "net.ipv4.conf.lo.rp_filter": "2"} {
+			if got, err := sysctl.Sysctl(key); err != nil || got != value {
+				t.Errorf("%s in pod netns = %q (%v), want %q", key, got, err, value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := sysctl.Sysctl("net.core.somaxconn"); got != hostValue {
+		t.Errorf("net.core.somaxconn on host = %q, want %q", got, hostValue)
+	}
+
+	if err := SetSysctlsInNS(podNS, map[string]string{"net.ipv4.conf.eth9.rp_filter": "1"}); err == nil {
+		t.Errorf("setting sysctl of missing interface succeeded")
+	}
+}
+
+func TestEnsureHostSysctls(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("test requires root privileges")
+	}
+	hostNS, err := testns.New(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hostNS.Do(func(ns.NetNS) error {
+		if _, err := sysctl.Sysctl("net.ipv4.ip_forward", "0"); err != nil {
+			return err
+		}
+		if _, err := sysctl.Sysctl("net.ipv4.conf.lo.rp_filter", "0"); err != nil {
+			return err
+		}
+		sysctls := []HostSysctl{
+			{Key: "net.ipv4.ip_forward", Value: "1"},
+			{Key: "net.ipv4.conf.lo.rp_filter", Value: "2", Accepted: []string{"0"}},
+		}
+		if err := EnsureHostSysctls(sysctls, false); err == nil || !strings.Contains(err.Error(), "net.ipv4.ip_forward is 0") {
+			t.Errorf("check of unset ip_forward returned %v", err)
+		}
+		if err := EnsureHostSysctls(sysctls, true); err != nil {
+			t.Errorf("enable returned %v", err)
+		}
+		if err := EnsureHostSysctls(sysctls, false); err != nil {
+			t.Errorf("check after enable returned %v", err)
+		}
+		if got, _ := sysctl.Sysctl("net.ipv4.conf.lo.rp_filter"); got != "0" {
+			t.Errorf("accepted rp_filter is changed to %q", got)
+		}
+		missing := []HostSysctl{{Key: "net.bridge.bridge-nf-call-missing", Value: "1"}}
+		if err := EnsureHostSysctls(missing, true); err == nil || !strings.Contains(err.Error(), "br_netfilter") {
+			t.Errorf("missing bridge sysctl returned %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnsureBridgeRPFilter(t *testing.T) {
+	if key := BridgeSysctls("br.100", true)[1].Key; key != "net.ipv4.conf.br/100.rp_filter" {
+		t.Errorf("rp_filter key of bridge br.100 = %q", key)
+	}
+	tests := []struct {
+		name      string
+		all       string
+		bridge    string
+		wantCheck bool
+		// wantBridge is the rp_filter of the bridge after enable
+		wantBridge string
+	}{
+		{name: "loose bridge", all: "0", bridge: "2", wantCheck: true, wantBridge: "2"},
+		{name: "off on both", all: "0", bridge: "0", wantCheck: true, wantBridge: "0"},
+		{name: "loose all", all: "2", bridge: "1", wantCheck: true, wantBridge: "1"},
+		{name: "strict bridge", all: "0", bridge: "1", wantBridge: "2"},
+		{name: "strict all with bridge off", all: "1", bridge: "0", wantBridge: "2"},
+		{name: "strict all with loose bridge", all: "1", bridge: "2", wantCheck: true, wantBridge: "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testns.Run(t, func() error {
+				// the bridge name has a dot which is a separator in the dotted sysctl keys
+				if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br.100"}}); err != nil {
+					return err
+				}
+				bridgeKey := "net/ipv4/conf/br.100/rp_filter"
+				if _, err := sysctl.Sysctl("net.ipv4.conf.all.rp_filter", tt.all); err != nil {
+					return err
+				}
+				if _, err := sysctl.Sysctl(bridgeKey, tt.bridge); err != nil {
+					return err
+				}
+				sysctls := BridgeSysctls("br.100", true)[1:]
+				if err := EnsureHostSysctls(sysctls, false); (err == nil) != tt.wantCheck {
+					t.Errorf("check returned %v, want passed %v", err, tt.wantCheck)
+				}
+				if err := EnsureHostSysctls(sysctls, true); err != nil {
+					t.Errorf("enable returned %v", err)
+				}
+				if err := EnsureHostSysctls(sysctls, false); err != nil {
+					t.Errorf("check after enable returned %v", err)
+				}
+				if got, _ := sysctl.Sysctl(bridgeKey); got != tt.wantBridge {
+					t.Errorf("rp_filter of the bridge = %q, want %q", got, tt.wantBridge)
+				}
+				if got, _ := sysctl.Sysctl("net.ipv4.conf.all.rp_filter"); got != tt.all {
+					t.Errorf("rp_filter of all the interfaces is changed to %q", got)
+				}
+				return nil
+			})
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package nettool
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// VXLANDeviceName is the VXLAN device carrying the pod traffic between the nodes
+	VXLANDeviceName = "minicni.vxlan"
+	// VXLANOverhead is the size of the outer IPv4, UDP and VXLAN headers and the inner ethernet header
+	VXLANOverhead = 50
+)
+
+// VTEP is the VXLAN tunnel endpoint of the remote node
+type VTEP struct {
+	// PodCIDR is the pod subnet of the node, its network address is the IP of the VXLAN device of the node
+	PodCIDR *net.IPNet
+	// NodeIP is the underlay IP of the node the VXLAN packets are sent to
+	NodeIP net.IP
+}
+
+// EnsureVXLAN creates the VXLAN device on the uplink with the node IP or updates the existing one.
+// The MAC of the device is derived from the node IP so that the remote nodes know it without asking,
+// and the device gets the network address of the pod CIDR as the next hop for the remote nodes.
+func EnsureVXLAN(vni, port int, nodeIP net.IP, podCIDR *net.IPNet) (netlink.Link, error) {
+	uplink, err := linkByIP(nodeIP)
+	if err != nil {
+		return nil, err
+	}
+	mac, err := MACFromIP(nodeIP)
+	if err != nil {
+		return nil, err
+	}
+	mtu := uplink.Attrs().MTU - VXLANOverhead
+	want := &netlink.Vxlan{
+		LinkAttrs:    netlink.LinkAttrs{Name: VXLANDeviceName, MTU: mtu, HardwareAddr: mac},
+		VxlanId:      vni,
+		VtepDevIndex: uplink.Attrs().Index,
+		SrcAddr:      nodeIP,
+		Port:         port,
+		Learning:     false,
+	}
+
+	link, err := netlink.LinkByName(VXLANDeviceName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return nil, fmt.Errorf("failed to lookup VXLAN device %q: %v", VXLANDeviceName, err)
+		}
+		link = nil
+	} else if current, ok := link.(*netlink.Vxlan); !ok || !sameVXLAN(current, want) {
+		// the tunnel parameters can't be changed in place
+		if err := netlink.LinkDel(link); err != nil {
+			return nil, fmt.Errorf("failed to delete stale VXLAN device %q: %v", VXLANDeviceName, err)
+		}
+		link = nil
+	}
+	if link == nil {
+		if err := netlink.LinkAdd(want); err != nil {
+			return nil, fmt.Errorf("failed to create VXLAN device %q: %v", VXLANDeviceName, err)
+		}
+		if link, err = netlink.LinkByName(VXLANDeviceName); err != nil {
+			return nil, fmt.Errorf("failed to lookup VXLAN device %q: %v", VXLANDeviceName, err)
+		}
+	}
+
+	if link.Attrs().MTU != mtu {
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return nil, fmt.Errorf("failed to set MTU of VXLAN device %q: %v", VXLANDeviceName, err)
+		}
+	}
+	if link.Attrs().HardwareAddr.String() != mac.String() {
+		if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+			return nil, fmt.Errorf("failed to set MAC of VXLAN device %q: %v", VXLANDeviceName, err)
+		}
+	}
+	if err := setOnlyAddr(link, &net.IPNet{IP: podCIDR.IP, Mask: net.CIDRMask(32, 32)}); err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("failed to set VXLAN device %q up: %v", VXLANDeviceName, err)
+	}
+	return link, nil
+}
+
+// SyncVTEPs programs the neighbor and FDB entries of the remote VTEPs on the VXLAN device and routes
+// their pod subnets through it, the entries of the other VTEPs are deleted.
+func SyncVTEPs(link netlink.Link, vteps []VTEP) error {
+	var errs []string
+	var routes []*netlink.Route
+	index := link.Attrs().Index
+	neighs := map[string]bool{}
+	fdbs := map[string]bool{}
+	for _, vtep := range vteps {
+		mac, err := MACFromIP(vtep.NodeIP)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		// the VXLAN device of the remote node is resolved without ARP
+		neigh := &netlink.Neigh{
+			LinkIndex:    index,
+			Family:       netlink.FAMILY_V4,
+			State:        netlink.NUD_PERMANENT,
+			IP:           vtep.PodCIDR.IP,
+			HardwareAddr: mac,
+		}
+		if err := netlink.NeighSet(neigh); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to set neighbor %q: %v", vtep.PodCIDR.IP, err))
+		}
+		neighs[vtep.PodCIDR.IP.String()] = true
+		// the frames to the remote VXLAN device are sent to the remote node
+		fdb := &netlink.Neigh{
+			LinkIndex:    index,
+			Family:       syscall.AF_BRIDGE,
+			Flags:        netlink.NTF_SELF,
+			State:        netlink.NUD_PERMANENT,
+			IP:           vtep.NodeIP,
+			HardwareAddr: mac,
+		}
+		if err := netlink.NeighSet(fdb); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to set FDB entry %q: %v", mac, err))
+		}
+		fdbs[mac.String()+vtep.NodeIP.String()] = true
+		routes = append(routes, &netlink.Route{
+			LinkIndex: index,
+			Dst:       vtep.PodCIDR,
+			Gw:        vtep.PodCIDR.IP,
+			Flags:     int(netlink.FLAG_ONLINK),
+		})
+	}
+
+	current, err := netlink.NeighList(index, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list neighbors of %q: %v", link.Attrs().Name, err)
+	}
+	for i := range current {
+		neigh := &current[i]
+		if neigh.State&netlink.NUD_PERMANENT == 0 || neighs[neigh.IP.String()] {
+			continue
+		}
+		if err := netlink.NeighDel(neigh); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to delete neighbor %q: %v", neigh.IP, err))
+		}
+	}
+	current, err = netlink.NeighList(index, syscall.AF_BRIDGE)
+	if err != nil {
+		return fmt.Errorf("failed to list FDB entries of %q: %v", link.Attrs().Name, err)
+	}
+	for i := range current {
+		fdb := &current[i]
+		if fdb.State&netlink.NUD_PERMANENT == 0 || fdbs[fdb.HardwareAddr.String()+fdb.IP.String()] {
+			continue
+		}
+		if err := netlink.NeighDel(fdb); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to delete FDB entry %q: %v", fdb.HardwareAddr, err))
+		}
+	}
+
+	if err := SyncRoutes(routes); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// sameVXLAN returns true if the existing VXLAN device has the tunnel parameters of the desired one
+func sameVXLAN(current, want *netlink.Vxlan) bool {
+	return current.VxlanId == want.VxlanId &&
+		current.VtepDevIndex == want.VtepDevIndex &&
+		current.SrcAddr.Equal(want.SrcAddr) &&
+		current.Port == want.Port &&
+		current.Learning == want.Learning
+}
+
+// linkByIP returns the link with the IP
+func linkByIP(ip net.IP) (netlink.Link, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, link := range links {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list addresses of %q: %v", link.Attrs().Name, err)
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return link, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no link with IP %q", ip)
+}
+
+// setOnlyAddr makes the address the only IPv4 address of the link
+func setOnlyAddr(link netlink.Link, ipnet *net.IPNet) error {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of %q: %v", link.Attrs().Name, err)
+	}
+	found := false
+	for i := range addrs {
+		if addrs[i].IPNet.String() == ipnet.String() {
+			found = true
+			continue
+		}
+		if err := netlink.AddrDel(link, &addrs[i]); err != nil {
+			return fmt.Errorf("failed to delete address %q from %q: %v", addrs[i].IPNet, link.Attrs().Name, err)
+		}
+	}
+	if found {
+		return nil
+	}
+	if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: ipnet}); err != nil {
+		return fmt.Errorf("failed to add address %q to %q: %v", ipnet, link.Attrs().Name, err)
+	}
+	return nil
+}
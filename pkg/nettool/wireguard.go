@@ -0,0 +1,120 @@
+package nettool
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// WireGuardDeviceName is the WireGuard device encrypting the pod traffic between the nodes
+	WireGuardDeviceName = "minicni.wg"
+	// WireGuardOverhead is the size of the outer IPv6 and UDP headers and the WireGuard header and tag
+	WireGuardOverhead = 80
+)
+
+// WireGuardPeer is the remote node reached through the WireGuard device
+type WireGuardPeer struct {
+	// PodCIDR is the pod subnet of the node, the only source allowed from the peer
+	PodCIDR *net.IPNet
+	// Endpoint is the underlay address of the node the encrypted packets are sent to
+	Endpoint *net.UDPAddr
+	// PublicKey is the public key of the node
+	PublicKey wgtypes.Key
+}
+
+// EnsureWireGuard creates the WireGuard device with the private key listening on the port or updates the existing one.
+// The device gets the network address of the pod CIDR, so the traffic from the node itself is allowed by the remote nodes.
+func EnsureWireGuard(key wgtypes.Key, port int, nodeIP net.IP, podCIDR *net.IPNet) (netlink.Link, error) {
+	uplink, err := linkByIP(nodeIP)
+	if err != nil {
+		return nil, err
+	}
+	mtu := uplink.Attrs().MTU - WireGuardOverhead
+
+	link, err := netlink.LinkByName(WireGuardDeviceName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return nil, fmt.Errorf("failed to lookup WireGuard device %q: %v", WireGuardDeviceName, err)
+		}
+		wg := &netlink.GenericLink{
+			LinkAttrs: netlink.LinkAttrs{Name: WireGuardDeviceName, MTU: mtu},
+			LinkType:  "wireguard",
+		}
+		if err := netlink.LinkAdd(wg); err != nil {
+			return nil, fmt.Errorf("failed to create WireGuard device %q: %v", WireGuardDeviceName, err)
+		}
+		if link, err = netlink.LinkByName(WireGuardDeviceName); err != nil {
+			return nil, fmt.Errorf("failed to lookup WireGuard device %q: %v", WireGuardDeviceName, err)
+		}
+	}
+
+	if link.Attrs().MTU != mtu {
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return nil, fmt.Errorf("failed to set MTU of WireGuard device %q: %v", WireGuardDeviceName, err)
+		}
+	}
+	if err := setOnlyAddr(link, &net.IPNet{IP: podCIDR.IP, Mask: net.CIDRMask(32, 32)}); err != nil {
+		return nil, err
+	}
+	err = configureWireGuard(wgtypes.Config{PrivateKey: &key, ListenPort: &port})
+	if err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("failed to set WireGuard device %q up: %v", WireGuardDeviceName, err)
+	}
+	return link, nil
+}
+
+// SyncWireGuardPeers replaces the peers of the WireGuard device and routes their pod subnets through it
+func SyncWireGuardPeers(link netlink.Link, peers []WireGuardPeer) error {
+	cfg := wgtypes.Config{ReplacePeers: true}
+	var routes []*netlink.Route
+	for _, peer := range peers {
+		cfg.Peers = append(cfg.Peers, wgtypes.PeerConfig{
+			PublicKey:         peer.PublicKey,
+			Endpoint:          peer.Endpoint,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        []net.IPNet{*peer.PodCIDR},
+		})
+		routes = append(routes, &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       peer.PodCIDR,
+			Scope:     netlink.SCOPE_LINK,
+		})
+	}
+	if err := configureWireGuard(cfg); err != nil {
+		return err
+	}
+	return SyncRoutes(routes)
+}
+
+// GetWireGuardDevice returns the configuration of the WireGuard device
+func GetWireGuardDevice() (*wgtypes.Device, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WireGuard client: %v", err)
+	}
+	defer client.Close()
+	device, err := client.Device(WireGuardDeviceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get WireGuard device %q: %v", WireGuardDeviceName, err)
+	}
+	return device, nil
+}
+
+func configureWireGuard(cfg wgtypes.Config) error {
+	client, err := wgctrl.New()
+	if err != nil {
+		return fmt.Errorf("failed to open WireGuard client: %v", err)
+	}
+	defer client.Close()
+	if err := client.ConfigureDevice(WireGuardDeviceName, cfg); err != nil {
+		return fmt.Errorf("failed to configure WireGuard device %q: %v", WireGuardDeviceName, err)
+	}
+	return nil
+}
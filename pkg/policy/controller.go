@@ -0,0 +1,103 @@
+package policy
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/morvencao/minicni/pkg/firewall"
+)
+
+// retryInterval is how long to wait before syncing the policies again after a failure
+const retryInterval = 5 * time.Second
+
+// Controller watches the pods, namespaces and network policies of the cluster and keeps
+// the policy rules of the pods on the local node in sync with them
+type Controller struct {
+	client       kubernetes.Interface
+	nodeName     string
+	firewall     firewall.Firewall
+	resyncPeriod time.Duration
+	// trigger has a pending sync if it's not empty
+	trigger chan struct{}
+}
+
+// New returns the policy controller of the local node, the policies are synced every resync period
+// besides the changes of the pods, namespaces and network policies.
+func New(client kubernetes.Interface, nodeName string, fw firewall.Firewall, resyncPeriod time.Duration) *Controller {
+	return &Controller{
+		client:       client,
+		nodeName:     nodeName,
+		firewall:     fw,
+		resyncPeriod: resyncPeriod,
+		trigger:      make(chan struct{}, 1),
+	}
+}
+
+// Run syncs the policy rules whenever the pods, namespaces or network policies change until the stop channel is closed
+func (c *Controller) Run(stopCh <-chan struct{}) error {
+	factory := informers.NewSharedInformerFactory(c.client, c.resyncPeriod)
+	pods := factory.Core().V1().Pods()
+	namespaces := factory.Core().V1().Namespaces()
+	policies := factory.Networking().V1().NetworkPolicies()
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.enqueue() },
+		UpdateFunc: func(interface{}, interface{}) { c.enqueue() },
+		DeleteFunc: func(interface{}) { c.enqueue() },
+	}
+	for _, informer := range []cache.SharedIndexInformer{pods.Informer(), namespaces.Informer(), policies.Informer()} {
+		informer.AddEventHandler(handler)
+	}
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, pods.Informer().HasSynced, namespaces.Informer().HasSynced, policies.Informer().HasSynced) {
+		return fmt.Errorf("failed to wait for the pods, namespaces and network policies caches to sync")
+	}
+
+	c.enqueue()
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-stopCh:
+			return nil
+		case <-c.trigger:
+		case <-retry:
+		}
+		retry = nil
+		if err := c.sync(pods.Lister(), namespaces.Lister(), policies.Lister()); err != nil {
+			log.Printf("failed to sync network policies: %v", err)
+			retry = time.After(retryInterval)
+		}
+	}
+}
+
+// enqueue requests a sync, the requests are merged while a sync is pending
+func (c *Controller) enqueue() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// sync programs the policies of the local pods computed from the objects in the caches
+func (c *Controller) sync(podLister listersv1.PodLister, nsLister listersv1.NamespaceLister, npLister networkinglisters.NetworkPolicyLister) error {
+	pods, err := podLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %v", err)
+	}
+	namespaces, err := nsLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list namespaces: %v", err)
+	}
+	policies, err := npLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list network policies: %v", err)
+	}
+	return c.firewall.SyncPodPolicies(podPolicies(c.nodeName, pods, namespaces, policies))
+}
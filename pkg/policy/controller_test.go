@@ -0,0 +1,89 @@
+package policy
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/morvencao/minicni/pkg/firewall"
+)
+
+// fakeFirewall records the described policies of every sync, the other methods are not used by the controller
+type fakeFirewall struct {
+	firewall.Firewall
+	syncs chan []string
+}
+
+func (f *fakeFirewall) SyncPodPolicies(policies []firewall.PodPolicy) error {
+	f.syncs <- describe(policies)
+	return nil
+}
+
+func (f *fakeFirewall) TeardownPodPolicy(podIP net.IP) error {
+	return nil
+}
+
+// waitForSync waits for the firewall to be synced with the policies
+func waitForSync(t *testing.T, fw *fakeFirewall, want []string) {
+	timeout := time.After(5 * time.Second)
+	var got []string
+	for {
+		select {
+		case got = <-fw.syncs:
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("firewall is not synced with policies\n%s\nlast synced with\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+		}
+	}
+}
+
+func TestControllerSyncsPolicies(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newNamespace("default", nil),
+		newPod("default", "server", "node1", "10.244.1.2", map[string]string{"app": "server"}),
+		newPod("default", "client", "node2", "10.244.2.2", map[string]string{"role": "client"}),
+	)
+	fw := &fakeFirewall{syncs: make(chan []string, 10)}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go func() {
+		if err := New(client, "node1", fw, 0).Run(stopCh); err != nil {
+			t.Errorf("controller stopped with error: %v", err)
+		}
+	}()
+	waitForSync(t, fw, []string{"10.244.1.2 in=open out=open"})
+
+	// a policy allows the clients only
+	policies := client.NetworkingV1().NetworkPolicies("default")
+	np := newPolicy("default", "clients", map[string]string{"app": "server"}, networkingv1.NetworkPolicySpec{
+		Ingress: []networkingv1.NetworkPolicyIngressRule{{
+			From: []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "client"}}}},
+		}},
+	})
+	if _, err := policies.Create(context.TODO(), np, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForSync(t, fw, []string{"10.244.1.2 in=[10.244.2.2/32:*] out=open"})
+
+	// another client starts
+	pods := client.CoreV1().Pods("default")
+	if _, err := pods.Create(context.TODO(), newPod("default", "client2", "node2", "10.244.2.3", map[string]string{"role": "client"}), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForSync(t, fw, []string{"10.244.1.2 in=[10.244.2.2/32,10.244.2.3/32:*] out=open"})
+
+	// the policy is deleted
+	if err := policies.Delete(context.TODO(), "clients", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForSync(t, fw, []string{"10.244.1.2 in=open out=open"})
+}
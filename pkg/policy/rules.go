@@ -0,0 +1,314 @@
+package policy
+
+import (
+	"log"
+	"net"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/morvencao/minicni/pkg/firewall"
+)
+
+// podPolicies returns the policies of the pods on the node, one for each IP of the pod. The pods not
+// selected by any network policy are in the list as well so that their traffic is no longer blocked.
+func podPolicies(nodeName string, pods []*corev1.Pod, namespaces []*corev1.Namespace, policies []*networkingv1.NetworkPolicy) []firewall.PodPolicy {
+	r := &resolver{namespaces: map[string]labels.Set{}}
+	for _, pod := range pods {
+		if onPodNetwork(pod) {
+			r.pods = append(r.pods, pod)
+		}
+	}
+	// the lister returns the pods in no particular order, sorting them keeps the peers of the rules stable
+	sort.Slice(r.pods, func(i, j int) bool {
+		if r.pods[i].Namespace != r.pods[j].Namespace {
+			return r.pods[i].Namespace < r.pods[j].Namespace
+		}
+		return r.pods[i].Name < r.pods[j].Name
+	})
+	for _, ns := range namespaces {
+		r.namespaces[ns.Name] = labels.Set(ns.Labels)
+	}
+
+	var result []firewall.PodPolicy
+	for _, pod := range r.pods {
+		if pod.Spec.NodeName != nodeName {
+			continue
+		}
+		var policy firewall.PodPolicy
+		for _, np := range policies {
+			if np.Namespace != pod.Namespace {
+				continue
+			}
+			selector, err := metav1.LabelSelectorAsSelector(&np.Spec.PodSelector)
+			if err != nil {
+				log.Printf("skipping network policy %s/%s: %v", np.Namespace, np.Name, err)
+				continue
+			}
+			if !selector.Matches(labels.Set(pod.Labels)) {
+				continue
+			}
+			ingress, egress := policyTypes(np)
+			if ingress {
+				policy.IngressIsolated = true
+				for _, rule := range np.Spec.Ingress {
+					policy.Ingress = append(policy.Ingress, r.rules(np.Namespace, rule.From, rule.Ports, pod)...)
+				}
+			}
+			if egress {
+				policy.EgressIsolated = true
+				for _, rule := range np.Spec.Egress {
+					policy.Egress = append(policy.Egress, r.rules(np.Namespace, rule.To, rule.Ports, nil)...)
+				}
+			}
+		}
+		for _, ip := range podIPs(pod) {
+			policy.IP = ip
+			result = append(result, policy)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].IP.String() < result[j].IP.String() })
+	return result
+}
+
+// policyTypes returns whether the network policy isolates the ingress and the egress traffic,
+// the policy without types isolates the egress traffic only if it has egress rules.
+func policyTypes(np *networkingv1.NetworkPolicy) (bool, bool) {
+	if len(np.Spec.PolicyTypes) == 0 {
+		return true, len(np.Spec.Egress) > 0
+	}
+	ingress, egress := false, false
+	for _, t := range np.Spec.PolicyTypes {
+		switch t {
+		case networkingv1.PolicyTypeIngress:
+			ingress = true
+		case networkingv1.PolicyTypeEgress:
+			egress = true
+		}
+	}
+	return ingress, egress
+}
+
+// resolver resolves the peers and the ports of the network policy rules
+type resolver struct {
+	// pods are the pods on the pod network of all the nodes
+	pods       []*corev1.Pod
+	namespaces map[string]labels.Set
+}
+
+// rules returns the firewall rules of the network policy rule in the namespace. The named ports of
+// the ingress rules are looked up in the target pod, those of the egress rules in each peer pod.
+func (r *resolver) rules(namespace string, peers []networkingv1.NetworkPolicyPeer, ports []networkingv1.NetworkPolicyPort, target *corev1.Pod) []firewall.PolicyRule {
+	all, pods, cidrs := r.peers(namespace, peers)
+	peerIPNets := cidrs
+	for _, pod := range pods {
+		peerIPNets = append(peerIPNets, podIPNets(pod)...)
+	}
+
+	var rules []firewall.PolicyRule
+	if resolved, ok := resolvePorts(ports, target); ok {
+		rules = appendRule(rules, all, peerIPNets, resolved)
+	}
+	if target != nil || !hasNamedPort(ports) {
+		return rules
+	}
+	if all {
+		pods = r.pods
+	}
+	for _, pod := range pods {
+		if resolved, ok := resolvePorts(namedPorts(ports), pod); ok {
+			rules = appendRule(rules, false, podIPNets(pod), resolved)
+		}
+	}
+	return rules
+}
+
+// peers returns the pods and the CIDRs selected by the peers in the namespace,
+// all is true if there are no peers which means everybody.
+func (r *resolver) peers(namespace string, peers []networkingv1.NetworkPolicyPeer) (all bool, pods []*corev1.Pod, cidrs []*net.IPNet) {
+	if len(peers) == 0 {
+		return true, nil, nil
+	}
+	for _, peer := range peers {
+		if peer.IPBlock != nil {
+			cidrs = append(cidrs, ipBlockCIDRs(peer.IPBlock)...)
+			continue
+		}
+		nsSelector, podSelector := labels.Nothing(), labels.Everything()
+		var err error
+		if peer.NamespaceSelector != nil {
+			if nsSelector, err = metav1.LabelSelectorAsSelector(peer.NamespaceSelector); err != nil {
+				log.Printf("skipping network policy peer in namespace %q: %v", namespace, err)
+				continue
+			}
+		}
+		if peer.PodSelector != nil {
+			if podSelector, err = metav1.LabelSelectorAsSelector(peer.PodSelector); err != nil {
+				log.Printf("skipping network policy peer in namespace %q: %v", namespace, err)
+				continue
+			}
+		}
+		for _, pod := range r.pods {
+			// the peer without namespace selector selects the pods in the namespace of the policy
+			inNamespace := pod.Namespace == namespace
+			if peer.NamespaceSelector != nil {
+				inNamespace = nsSelector.Matches(r.namespaces[pod.Namespace])
+			}
+			if inNamespace && podSelector.Matches(labels.Set(pod.Labels)) {
+				pods = append(pods, pod)
+			}
+		}
+	}
+	return false, pods, cidrs
+}
+
+// appendRule appends the rule unless it has no peers while not matching all of them
+func appendRule(rules []firewall.PolicyRule, all bool, peers []*net.IPNet, ports []firewall.PolicyPort) []firewall.PolicyRule {
+	if all {
+		return append(rules, firewall.PolicyRule{Ports: ports})
+	}
+	if len(peers) == 0 {
+		return rules
+	}
+	return append(rules, firewall.PolicyRule{Peers: peers, Ports: ports})
+}
+
+// resolvePorts returns the ports with the named ones looked up in the container ports of the pod,
+// the named ports are dropped if the pod is nil. ok is false if none of the given ports is resolved.
+func resolvePorts(ports []networkingv1.NetworkPolicyPort, pod *corev1.Pod) ([]firewall.PolicyPort, bool) {
+	if len(ports) == 0 {
+		return nil, true
+	}
+	var resolved []firewall.PolicyPort
+	for _, p := range ports {
+		protocol := corev1.ProtocolTCP
+		if p.Protocol != nil {
+			protocol = *p.Protocol
+		}
+		switch {
+		case p.Port == nil:
+			resolved = append(resolved, firewall.PolicyPort{Protocol: string(protocol)})
+		case p.Port.Type == intstr.Int:
+			resolved = append(resolved, firewall.PolicyPort{Protocol: string(protocol), Port: p.Port.IntValue()})
+		case pod != nil:
+			if port := containerPort(pod, p.Port.StrVal, protocol); port != 0 {
+				resolved = append(resolved, firewall.PolicyPort{Protocol: string(protocol), Port: port})
+			}
+		}
+	}
+	return resolved, len(resolved) > 0
+}
+
+func hasNamedPort(ports []networkingv1.NetworkPolicyPort) bool {
+	return len(namedPorts(ports)) > 0
+}
+
+func namedPorts(ports []networkingv1.NetworkPolicyPort) []networkingv1.NetworkPolicyPort {
+	var named []networkingv1.NetworkPolicyPort
+	for _, p := range ports {
+		if p.Port != nil && p.Port.Type == intstr.String {
+			named = append(named, p)
+		}
+	}
+	return named
+}
+
+// containerPort returns the number of the named container port of the pod, 0 if there is no such port
+func containerPort(pod *corev1.Pod, name string, protocol corev1.Protocol) int {
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			proto := p.Protocol
+			if proto == "" {
+				proto = corev1.ProtocolTCP
+			}
+			if p.Name == name && proto == protocol {
+				return int(p.ContainerPort)
+			}
+		}
+	}
+	return 0
+}
+
+// ipBlockCIDRs returns the disjoint CIDRs covering the CIDR of the IP block but its exceptions
+func ipBlockCIDRs(block *networkingv1.IPBlock) []*net.IPNet {
+	_, cidr, err := net.ParseCIDR(block.CIDR)
+	if err != nil {
+		log.Printf("skipping invalid IP block %q: %v", block.CIDR, err)
+		return nil
+	}
+	cidrs := []*net.IPNet{cidr}
+	for _, e := range block.Except {
+		_, except, err := net.ParseCIDR(e)
+		if err != nil {
+			log.Printf("skipping invalid IP block exception %q: %v", e, err)
+			continue
+		}
+		var rest []*net.IPNet
+		for _, c := range cidrs {
+			rest = append(rest, subtractCIDR(c, except)...)
+		}
+		cidrs = rest
+	}
+	return cidrs
+}
+
+// subtractCIDR returns the disjoint CIDRs covering the CIDR but the exception
+func subtractCIDR(cidr, except *net.IPNet) []*net.IPNet {
+	ones, bits := cidr.Mask.Size()
+	exceptOnes, exceptBits := except.Mask.Size()
+	if bits != exceptBits || !cidr.Contains(except.IP) && !except.Contains(cidr.IP) {
+		return []*net.IPNet{cidr}
+	}
+	if exceptOnes <= ones {
+		return nil
+	}
+	// split the CIDR in halves down to the exception, keeping the half without it each time
+	var rest []*net.IPNet
+	for ; ones < exceptOnes; ones++ {
+		mask := net.CIDRMask(ones+1, bits)
+		sibling := except.IP.Mask(mask)
+		sibling[ones/8] ^= 0x80 >> uint(ones%8)
+		rest = append(rest, &net.IPNet{IP: sibling, Mask: mask})
+	}
+	return rest
+}
+
+// onPodNetwork returns true if the pod is running on the pod network with its IPs
+func onPodNetwork(pod *corev1.Pod) bool {
+	if pod.Spec.HostNetwork || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false
+	}
+	return len(podIPs(pod)) > 0
+}
+
+func podIPs(pod *corev1.Pod) []net.IP {
+	var ips []net.IP
+	for _, podIP := range pod.Status.PodIPs {
+		if ip := net.ParseIP(podIP.IP); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 && pod.Status.PodIP != "" {
+		if ip := net.ParseIP(pod.Status.PodIP); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// podIPNets returns the single address subnets of the pod IPs
+func podIPNets(pod *corev1.Pod) []*net.IPNet {
+	var ipnets []*net.IPNet
+	for _, ip := range podIPs(pod) {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		ipnets = append(ipnets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return ipnets
+}
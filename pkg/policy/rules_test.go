@@ -0,0 +1,244 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/morvencao/minicni/pkg/firewall"
+)
+
+func newPod(namespace, name, node, ip string, labels map[string]string, ports ...corev1.ContainerPort) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+		Spec: corev1.PodSpec{
+			NodeName:   node,
+			Containers: []corev1.Container{{Name: name, Ports: ports}},
+		},
+		Status: corev1.PodStatus{
+			Phase:  corev1.PodRunning,
+			PodIP:  ip,
+			PodIPs: []corev1.PodIP{{IP: ip}},
+		},
+	}
+}
+
+func newNamespace(name string, labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+func newPolicy(namespace, name string, selector map[string]string, spec networkingv1.NetworkPolicySpec) *networkingv1.NetworkPolicy {
+	spec.PodSelector = metav1.LabelSelector{MatchLabels: selector}
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       spec,
+	}
+}
+
+func policyPort(protocol corev1.Protocol, port intstr.IntOrString) networkingv1.NetworkPolicyPort {
+	return networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &port}
+}
+
+// describe formats the policies as "<ip> in=<rules> out=<rules>", the rules are "open" if not isolated
+func describe(policies []firewall.PodPolicy) []string {
+	rules := func(isolated bool, rules []firewall.PolicyRule) string {
+		if !isolated {
+			return "open"
+		}
+		var s []string
+		for _, r := range rules {
+			peers, ports := []string{}, []string{}
+			for _, p := range r.Peers {
+				peers = append(peers, p.String())
+			}
+			for _, p := range r.Ports {
+				ports = append(ports, fmt.Sprintf("%s/%d", p.Protocol, p.Port))
+			}
+			if len(peers) == 0 {
+				peers = []string{"*"}
+			}
+			if len(ports) == 0 {
+				ports = []string{"*"}
+			}
+			s = append(s, strings.Join(peers, ",")+":"+strings.Join(ports, ","))
+		}
+		return "[" + strings.Join(s, " ") + "]"
+	}
+	var result []string
+	for _, p := range policies {
+		result = append(result, fmt.Sprintf("%s in=%s out=%s", p.IP, rules(p.IngressIsolated, p.Ingress), rules(p.EgressIsolated, p.Egress)))
+	}
+	return result
+}
+
+func TestPodPolicies(t *testing.T) {
+	hostPod := newPod("default", "host", "node1", "192.168.0.1", nil)
+	hostPod.Spec.HostNetwork = true
+	pods := []*corev1.Pod{
+		newPod("default", "server", "node1", "10.244.1.2", map[string]string{"app": "server"}, corev1.ContainerPort{Name: "http", ContainerPort: 8080}),
+		newPod("default", "client", "node1", "10.244.1.3", map[string]string{"role": "client"}),
+		newPod("default", "remote-client", "node2", "10.244.2.3", map[string]string{"role": "client"}),
+		newPod("other", "db", "node2", "10.244.2.4", map[string]string{"app": "db"}, corev1.ContainerPort{Name: "sql", ContainerPort: 5432}),
+		hostPod,
+	}
+	namespaces := []*corev1.Namespace{
+		newNamespace("default", nil),
+		newNamespace("other", map[string]string{"team": "a"}),
+	}
+	server := map[string]string{"app": "server"}
+	clients := &metav1.LabelSelector{MatchLabels: map[string]string{"role": "client"}}
+
+	tests := []struct {
+		name     string
+		policies []*networkingv1.NetworkPolicy
+		want     []string
+	}{
+		{
+			name: "no policies",
+			want: []string{"10.244.1.2 in=open out=open", "10.244.1.3 in=open out=open"},
+		},
+		{
+			name:     "deny all ingress",
+			policies: []*networkingv1.NetworkPolicy{newPolicy("default", "deny", nil, networkingv1.NetworkPolicySpec{})},
+			want:     []string{"10.244.1.2 in=[] out=open", "10.244.1.3 in=[] out=open"},
+		},
+		{
+			name: "policy of the other namespace",
+			policies: []*networkingv1.NetworkPolicy{
+				newPolicy("other", "deny", nil, networkingv1.NetworkPolicySpec{}),
+			},
+			want: []string{"10.244.1.2 in=open out=open", "10.244.1.3 in=open out=open"},
+		},
+		{
+			name: "ingress from the clients on a port",
+			policies: []*networkingv1.NetworkPolicy{newPolicy("default", "clients", server, networkingv1.NetworkPolicySpec{
+				Ingress: []networkingv1.NetworkPolicyIngressRule{{
+					From:  []networkingv1.NetworkPolicyPeer{{PodSelector: clients}},
+					Ports: []networkingv1.NetworkPolicyPort{policyPort(corev1.ProtocolTCP, intstr.FromInt(80))},
+				}},
+			})},
+			want: []string{"10.244.1.2 in=[10.244.1.3/32,10.244.2.3/32:TCP/80] out=open", "10.244.1.3 in=open out=open"},
+		},
+		{
+			name: "ingress from the selected namespaces on a named port",
+			policies: []*networkingv1.NetworkPolicy{newPolicy("default", "team", server, networkingv1.NetworkPolicySpec{
+				Ingress: []networkingv1.NetworkPolicyIngressRule{{
+					From:  []networkingv1.NetworkPolicyPeer{{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}}}},
+					Ports: []networkingv1.NetworkPolicyPort{policyPort(corev1.ProtocolTCP, intstr.FromString("http"))},
+				}},
+			})},
+			want: []string{"10.244.1.2 in=[10.244.2.4/32:TCP/8080] out=open", "10.244.1.3 in=open out=open"},
+		},
+		{
+			name: "ingress from an IP block with an exception",
+			policies: []*networkingv1.NetworkPolicy{newPolicy("default", "block", server, networkingv1.NetworkPolicySpec{
+				Ingress: []networkingv1.NetworkPolicyIngressRule{{
+					From: []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/24", Except: []string{"10.0.0.0/26"}}}},
+				}},
+			})},
+			want: []string{"10.244.1.2 in=[10.0.0.128/25,10.0.0.64/26:*] out=open", "10.244.1.3 in=open out=open"},
+		},
+		{
+			name: "peers selecting nothing allow nothing",
+			policies: []*networkingv1.NetworkPolicy{newPolicy("default", "nobody", server, networkingv1.NetworkPolicySpec{
+				Ingress: []networkingv1.NetworkPolicyIngressRule{{
+					From: []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "nobody"}}}},
+				}},
+			})},
+			want: []string{"10.244.1.2 in=[] out=open", "10.244.1.3 in=open out=open"},
+		},
+		{
+			name: "egress to DNS and the named port of the peers",
+			policies: []*networkingv1.NetworkPolicy{newPolicy("default", "egress", map[string]string{"role": "client"}, networkingv1.NetworkPolicySpec{
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+				Egress: []networkingv1.NetworkPolicyEgressRule{
+					{Ports: []networkingv1.NetworkPolicyPort{policyPort(corev1.ProtocolUDP, intstr.FromInt(53))}},
+					{
+						To:    []networkingv1.NetworkPolicyPeer{{NamespaceSelector: &metav1.LabelSelector{}}},
+						Ports: []networkingv1.NetworkPolicyPort{policyPort(corev1.ProtocolTCP, intstr.FromString("sql"))},
+					},
+				},
+			})},
+			want: []string{"10.244.1.2 in=open out=open", "10.244.1.3 in=open out=[*:UDP/53 10.244.2.4/32:TCP/5432]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := describe(podPolicies("node1", pods, namespaces, tt.policies))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("podPolicies =\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestPodPoliciesPodOrder(t *testing.T) {
+	pods := []*corev1.Pod{
+		newPod("default", "server", "node1", "10.244.1.2", map[string]string{"app": "server"}),
+		newPod("default", "client", "node2", "10.244.2.2", map[string]string{"role": "client"}),
+		newPod("default", "client2", "node2", "10.244.2.3", map[string]string{"role": "client"}),
+		newPod("other", "client", "node1", "10.244.1.3", map[string]string{"role": "client"}),
+	}
+	namespaces := []*corev1.Namespace{newNamespace("default", nil), newNamespace("other", nil)}
+	policies := []*networkingv1.NetworkPolicy{newPolicy("default", "clients", map[string]string{"app": "server"}, networkingv1.NetworkPolicySpec{
+		Ingress: []networkingv1.NetworkPolicyIngressRule{{
+			From: []networkingv1.NetworkPolicyPeer{{
+				NamespaceSelector: &metav1.LabelSelector{},
+				PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"role": "client"}},
+			}},
+		}},
+	})}
+	// the peers are ordered by the namespace and the name of the pods, whatever the order of the lister
+	want := []string{"10.244.1.2 in=[10.244.2.2/32,10.244.2.3/32,10.244.1.3/32:*] out=open", "10.244.1.3 in=open out=open"}
+
+	var permute func(k int)
+	permute = func(k int) {
+		if k == len(pods) {
+			if got := describe(podPolicies("node1", pods, namespaces, policies)); !reflect.DeepEqual(got, want) {
+				t.Errorf("podPolicies of the pods listed in order %v =\n%v\nwant\n%v", podNames(pods), strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+			return
+		}
+		for i := k; i < len(pods); i++ {
+			pods[k], pods[i] = pods[i], pods[k]
+			permute(k + 1)
+			pods[k], pods[i] = pods[i], pods[k]
+		}
+	}
+	permute(0)
+}
+
+func podNames(pods []*corev1.Pod) []string {
+	var names []string
+	for _, pod := range pods {
+		names = append(names, pod.Namespace+"/"+pod.Name)
+	}
+	return names
+}
+
+func TestSubtractCIDR(t *testing.T) {
+	tests := []struct {
+		cidr, except string
+		want         string
+	}{
+		{cidr: "10.0.0.0/24", except: "10.0.1.0/24", want: "[10.0.0.0/24]"},
+		{cidr: "10.0.0.0/24", except: "10.0.0.0/16", want: "[]"},
+		{cidr: "10.0.0.0/24", except: "10.0.0.128/25", want: "[10.0.0.0/25]"},
+		{cidr: "10.0.0.0/24", except: "10.0.0.4/30", want: "[10.0.0.128/25 10.0.0.64/26 10.0.0.32/27 10.0.0.16/28 10.0.0.8/29 10.0.0.0/30]"},
+		{cidr: "fd00::/64", except: "fd00::/65", want: "[fd00::8000:0:0:0/65]"},
+	}
+	for _, tt := range tests {
+		_, cidr, _ := net.ParseCIDR(tt.cidr)
+		_, except, _ := net.ParseCIDR(tt.except)
+		if got := fmt.Sprint(subtractCIDR(cidr, except)); got != tt.want {
+			t.Errorf("subtractCIDR(%s, %s) = %s, want %s", tt.cidr, tt.except, got, tt.want)
+		}
+	}
+}